@@ -0,0 +1,55 @@
+package raftbench
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// withFileLogStore runs a benchmark against a fresh FileLogStore
+func withFileLogStore(b *testing.B, policy raft.LogSyncPolicy, fn func(*testing.B, raft.LogStore)) {
+	dir, err := ioutil.TempDir("", "raftbench")
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := raft.DefaultFileLogStoreConfig()
+	conf.SyncPolicy = policy
+	store, err := raft.NewFileLogStore(dir, conf)
+	if err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	fn(b, store)
+}
+
+func BenchmarkFileLogStore_FirstIndex(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, FirstIndex)
+}
+
+func BenchmarkFileLogStore_LastIndex(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, LastIndex)
+}
+
+func BenchmarkFileLogStore_GetLog(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, GetLog)
+}
+
+func BenchmarkFileLogStore_StoreLog(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, StoreLog)
+}
+
+func BenchmarkFileLogStore_StoreLog_SyncInterval(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncInterval, StoreLog)
+}
+
+func BenchmarkFileLogStore_StoreLogs(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, StoreLogs)
+}
+
+func BenchmarkFileLogStore_DeleteRange(b *testing.B) {
+	withFileLogStore(b, raft.LogSyncBatch, DeleteRange)
+}
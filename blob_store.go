@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrBlobNotFound is returned by a BlobStore when a key does not exist.
+	ErrBlobNotFound = errors.New("blob not found")
+)
+
+// BlobStore is the small subset of an object storage API, such as S3 or
+// GCS, which the ObjectSnapshotStore is built on. Keys are flat strings
+// that may contain slashes. Blobs are written whole, so a reader sees
+// either all of a blob or none of it.
+type BlobStore interface {
+	// Put stores the contents of the reader under the key, replacing
+	// any existing blob.
+	Put(key string, r io.Reader) error
+
+	// Get opens the blob with the given key, or returns ErrBlobNotFound.
+	Get(key string) (io.ReadCloser, error)
+
+	// List returns the sorted keys starting with the given prefix.
+	List(prefix string) ([]string, error)
+
+	// Delete removes a blob. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// DirBlobStore implements the BlobStore interface with a directory on
+// the local disk, where every key is a file. It stands in for a real
+// object store in tests, or can be used with a shared network mount.
+type DirBlobStore struct {
+	path string
+}
+
+// NewDirBlobStore creates a new DirBlobStore in the given directory,
+// which is created if it does not exist.
+func NewDirBlobStore(path string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("blob path not accessible: %v", err)
+	}
+	return &DirBlobStore{path: path}, nil
+}
+
+// keyPath maps a key to a file in the directory
+func (d *DirBlobStore) keyPath(key string) (string, error) {
+	if key == "" || strings.HasSuffix(key, tmpSuffix) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(d.path, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file, and moves it into place once
+// it is complete.
+func (d *DirBlobStore) Put(key string, r io.Reader) error {
+	path, err := d.keyPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, r); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	if err := os.Rename(fh.Name(), path); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	return nil
+}
+
+// Get opens the file of a blob.
+func (d *DirBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := d.keyPath(key)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fh, nil
+}
+
+// List walks the directory for the keys with the given prefix, skipping
+// blobs which are still being written.
+func (d *DirBlobStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, tmpSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.path, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the file of a blob, and any directories left empty.
+func (d *DirBlobStore) Delete(key string) error {
+	path, err := d.keyPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != d.path; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDirBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var impl interface{} = &DirBlobStore{}
+	if _, ok := impl.(BlobStore); !ok {
+		t.Fatalf("DirBlobStore not a BlobStore")
+	}
+	blobs, err := NewDirBlobStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Put some blobs, and replace one
+	for _, key := range []string{"a/1", "a/2", "b", "a/1"} {
+		if err := blobs.Put(key, bytes.NewReader([]byte("data "+key))); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if keys, _ := blobs.List(""); !reflect.DeepEqual(keys, []string{"a/1", "a/2", "b"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+	if keys, _ := blobs.List("a/"); !reflect.DeepEqual(keys, []string{"a/1", "a/2"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+
+	// Read one back
+	r, err := blobs.Get("a/2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "data a/2" {
+		t.Fatalf("bad: %q", data)
+	}
+	if _, err := blobs.Get("a/3"); err != ErrBlobNotFound {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Delete removes empty directories, and missing keys are fine
+	for _, key := range []string{"a/1", "a/2", "a/3"} {
+		if err := blobs.Delete(key); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if keys, _ := blobs.List(""); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Fatalf("bad: %v", keys)
+	}
+	if _, err := os.Stat(dir + "/a"); !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Keys may not escape the directory
+	for _, key := range []string{"", "../x", "a//b", "/a", "a/", "x" + tmpSuffix} {
+		if err := blobs.Put(key, bytes.NewReader(nil)); err == nil {
+			t.Fatalf("expected error for %q", key)
+		}
+	}
+}
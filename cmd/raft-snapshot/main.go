@@ -0,0 +1,253 @@
+// Command raft-snapshot works with the snapshots of a FileSnapshotStore
+// while the node is offline. It can list and inspect snapshots, verify
+// their CRCs, and export them to or import them from archives.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+const usage = `Usage: raft-snapshot [-v] <command> <dir> [args]
+
+The dir is the base directory given to NewFileSnapshotStore.
+
+Commands:
+  list <dir>                       List the snapshots, newest first
+  inspect <dir> <id>               Show a snapshot and verify its CRC
+  verify <dir> [id ...]            Verify the CRC of snapshots, all by default
+  export <dir> <id> <archive|->    Write a snapshot to an archive
+  import <dir> <archive|->         Add a snapshot from an archive
+`
+
+func main() {
+	verbose := flag.Bool("v", false, "log the snapshot store activity")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Open the store without reaping anything
+	conf := &raft.FileSnapshotStoreConfig{
+		Retention: raft.RetainCount(math.MaxInt32),
+		LogOutput: ioutil.Discard,
+	}
+	if *verbose {
+		conf.LogOutput = os.Stderr
+	}
+	store, err := raft.NewFileSnapshotStoreWithConfig(args[1], conf)
+	if err != nil {
+		fatalf("failed to open snapshot store: %v", err)
+	}
+
+	switch cmd, rest := args[0], args[2:]; {
+	case cmd == "list" && len(rest) == 0:
+		err = list(store)
+	case cmd == "inspect" && len(rest) == 1:
+		err = inspect(store, rest[0])
+	case cmd == "verify":
+		err = verify(store, rest)
+	case cmd == "export" && len(rest) == 2:
+		err = export(store, rest[0], rest[1])
+	case cmd == "import" && len(rest) == 1:
+		err = importArchive(store, rest[0])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "raft-snapshot: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func list(store *raft.FileSnapshotStore) error {
+	snaps, err := store.List()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-32s %12s %8s %12s  %s\n", "ID", "Index", "Term", "Size", "Labels")
+	for _, meta := range snaps {
+		fmt.Printf("%-32s %12d %8d %12d  %s\n", meta.ID, meta.Index, meta.Term, meta.Size,
+			strings.Join(formatLabels(meta.Labels), ","))
+	}
+	return nil
+}
+
+func inspect(store *raft.FileSnapshotStore, id string) error {
+	meta, n, err := readSnapshot(store, id)
+	fmt.Printf("ID:    %s\n", id)
+	if meta != nil {
+		fmt.Printf("Index: %d\n", meta.Index)
+		fmt.Printf("Term:  %d\n", meta.Term)
+		fmt.Printf("Size:  %d\n", meta.Size)
+		if h := meta.Header; h.FormatVersion > 0 {
+			fmt.Printf("Format:  %d\n", h.FormatVersion)
+			fmt.Printf("Schema:  %d\n", h.SchemaVersion)
+			fmt.Printf("Flags:   %#x\n", h.Flags)
+			fmt.Printf("Created: %s\n", h.Created.Format(time.RFC3339))
+			fmt.Printf("Node:    %s\n", h.NodeID)
+		}
+		fmt.Printf("Peers:\n")
+		for _, peer := range decodePeers(meta.Peers) {
+			fmt.Printf("  %s\n", peer)
+		}
+		if len(meta.Labels) > 0 {
+			fmt.Printf("Labels:\n")
+			for _, label := range formatLabels(meta.Labels) {
+				fmt.Printf("  %s\n", label)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("CRC:   failed\n")
+		return err
+	}
+	if n != meta.Size {
+		return fmt.Errorf("read %d bytes, expected %d", n, meta.Size)
+	}
+	fmt.Printf("CRC:   ok\n")
+	return nil
+}
+
+func verify(store *raft.FileSnapshotStore, ids []string) error {
+	if len(ids) == 0 {
+		snaps, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, meta := range snaps {
+			ids = append(ids, meta.ID)
+		}
+	}
+
+	failed := 0
+	for _, id := range ids {
+		meta, n, err := readSnapshot(store, id)
+		if err == nil && n != meta.Size {
+			err = fmt.Errorf("read %d bytes, expected %d", n, meta.Size)
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: ok\n", id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d snapshots failed verification", failed, len(ids))
+	}
+	return nil
+}
+
+func export(store *raft.FileSnapshotStore, id, path string) error {
+	meta, state, err := store.Open(id)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	out, done, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	if err := raft.ExportSnapshot(out, meta, state); err != nil {
+		done()
+		if path != "-" {
+			os.Remove(path)
+		}
+		return err
+	}
+	return done()
+}
+
+func importArchive(store *raft.FileSnapshotStore, path string) error {
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		fh, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		in = fh
+	}
+	meta, err := raft.ImportSnapshot(store, in)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported snapshot %s at index %d, term %d\n", meta.ID, meta.Index, meta.Term)
+	return nil
+}
+
+// readSnapshot opens a snapshot, which verifies its CRC, and reads it
+// through to check its size
+func readSnapshot(store *raft.FileSnapshotStore, id string) (*raft.SnapshotMeta, int64, error) {
+	meta, state, err := store.Open(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer state.Close()
+	n, err := io.Copy(ioutil.Discard, state)
+	return meta, n, err
+}
+
+// createOutput opens the archive to export to, with a function which
+// closes it
+func createOutput(path string) (io.Writer, func() error, error) {
+	if path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	fh, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	done := func() error {
+		if err := fh.Sync(); err != nil {
+			fh.Close()
+			return err
+		}
+		return fh.Close()
+	}
+	return fh, done, nil
+}
+
+// formatLabels returns the labels of a snapshot as sorted key=value pairs
+func formatLabels(labels map[string]string) []string {
+	var pairs []string
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// decodePeers decodes the peer set of a snapshot. Peers are encoded by
+// the transport, which for the network transports is the address.
+func decodePeers(buf []byte) []string {
+	var encPeers [][]byte
+	if err := codec.NewDecoderBytes(buf, &codec.MsgpackHandle{}).Decode(&encPeers); err != nil {
+		return []string{fmt.Sprintf("<failed to decode peers: %v>", err)}
+	}
+	var peers []string
+	for _, enc := range encPeers {
+		peers = append(peers, string(enc))
+	}
+	return peers
+}
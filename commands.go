@@ -1,8 +1,25 @@
 package raft
 
+// RPCHeader is a common sub-structure used to pass along protocol version
+// and other information about the cluster. It is embedded in every request
+// and response, so peers that predate it simply decode a zero header, which
+// is protocol version 0.
+type RPCHeader struct {
+	// ProtocolVersion is the version of the protocol the sender is
+	// speaking.
+	ProtocolVersion ProtocolVersion
+}
+
+// WithRPCHeader is an interface that exposes the RPC header.
+type WithRPCHeader interface {
+	GetRPCHeader() RPCHeader
+}
+
 // AppendEntriesRequest is the command used to append entries to the
 // replicated log.
 type AppendEntriesRequest struct {
+	RPCHeader
+
 	// Provide the current term and leader
 	Term   uint64
 	Leader []byte
@@ -21,6 +38,8 @@ type AppendEntriesRequest struct {
 // AppendEntriesResponse is the response returned from an
 // AppendEntriesRequest.
 type AppendEntriesResponse struct {
+	RPCHeader
+
 	// Newer term if leader is out of date
 	Term uint64
 
@@ -29,11 +48,24 @@ type AppendEntriesResponse struct {
 
 	// We may not succeed if we have a conflicting entry
 	Success bool
+
+	// Priority is the election priority of the follower, used by the
+	// leader to transfer leadership to a preferred server
+	Priority int
+
+	// The newest snapshot of the follower, which the leader may point
+	// other followers at to fetch it
+	SnapshotID    string
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	SnapshotSize  int64
 }
 
 // RequestVoteRequest is the command used by a candidate to ask a Raft peer
 // for a vote in an election.
 type RequestVoteRequest struct {
+	RPCHeader
+
 	// Provide the term and our id
 	Term      uint64
 	Candidate []byte
@@ -41,10 +73,21 @@ type RequestVoteRequest struct {
 	// Used to ensure safety
 	LastLogIndex uint64
 	LastLogTerm  uint64
+
+	// Priority is the election priority of the candidate. It is advisory
+	// only, a vote is never granted or denied based on it.
+	Priority int
+
+	// LeadershipTransfer is set when the candidate was asked to start an
+	// election by the current leader, so voters should not reject it just
+	// because they know of a leader.
+	LeadershipTransfer bool
 }
 
 // RequestVoteResponse is the response returned from a RequestVoteRequest.
 type RequestVoteResponse struct {
+	RPCHeader
+
 	// Newer term if leader is out of date
 	Term uint64
 
@@ -58,6 +101,8 @@ type RequestVoteResponse struct {
 // InstallSnapshotRequest is the command sent to a Raft peer to bootstrap its
 // log (and state machine) from a snapshot on another peer.
 type InstallSnapshotRequest struct {
+	RPCHeader
+
 	Term   uint64
 	Leader []byte
 
@@ -70,11 +115,129 @@ type InstallSnapshotRequest struct {
 
 	// Size of the snapshot
 	Size int64
+
+	// Header describes the format of the snapshot
+	Header SnapshotHeader
+
+	// Labels set by the FSM that took the snapshot
+	Labels map[string]string
+
+	// Source, if set, is a peer to fetch the snapshot with SourceID from,
+	// instead of the leader streaming it. LastLogIndex and LastLogTerm are
+	// then those of that snapshot, Size is zero, and SourceSize is its
+	// size, which transports use to scale timeouts. The peer set, header
+	// and labels come with the fetched snapshot.
+	Source     []byte
+	SourceID   string
+	SourceSize int64
 }
 
 // InstallSnapshotResponse is the response returned from an
 // InstallSnapshotRequest.
 type InstallSnapshotResponse struct {
+	RPCHeader
+
 	Term    uint64
 	Success bool
 }
+
+// TimeoutNowRequest is the command used by a leader to signal another server
+// to start an election.
+type TimeoutNowRequest struct {
+	RPCHeader
+
+	// Provide the current term and leader
+	Term   uint64
+	Leader []byte
+}
+
+// TimeoutNowResponse is the response to TimeoutNowRequest.
+type TimeoutNowResponse struct {
+	RPCHeader
+
+	// Newer term if leader is out of date
+	Term uint64
+}
+
+// FetchSnapshotRequest is the command used by a follower to pull a
+// snapshot from the peer the leader pointed it at.
+type FetchSnapshotRequest struct {
+	RPCHeader
+
+	// ID of the snapshot, and the last index/term it must include
+	ID           string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// FetchSnapshotResponse is the response returned from a
+// FetchSnapshotRequest. It is followed by the snapshot itself.
+type FetchSnapshotResponse struct {
+	RPCHeader
+
+	// These are the last index/term included in the snapshot
+	LastLogIndex uint64
+	LastLogTerm  uint64
+
+	// Peer Set in the snapshot
+	Peers []byte
+
+	// Size of the snapshot
+	Size int64
+
+	// Header describes the format of the snapshot
+	Header SnapshotHeader
+
+	// Labels set by the FSM that took the snapshot
+	Labels map[string]string
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *AppendEntriesRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *AppendEntriesResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *RequestVoteRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *RequestVoteResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *InstallSnapshotRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *InstallSnapshotResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *TimeoutNowRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *TimeoutNowResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *FetchSnapshotRequest) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
+
+// GetRPCHeader - See WithRPCHeader.
+func (r *FetchSnapshotResponse) GetRPCHeader() RPCHeader {
+	return r.RPCHeader
+}
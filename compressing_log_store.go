@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+)
+
+// CompressingLogStore wraps any LogStore implementation to compress
+// the Data of large logs with DEFLATE before they are stored, and to
+// decompress them when read. Each log records its codec, so a store can
+// hold a mix of compressed and plain logs, and compression can be turned
+// on or off for an existing store.
+type CompressingLogStore struct {
+	store     LogStore
+	threshold int
+	level     int
+}
+
+// NewCompressingLogStore is used to create a new CompressingLogStore
+// that compresses the data of logs at least threshold bytes long.
+func NewCompressingLogStore(store LogStore, threshold int) (*CompressingLogStore, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("threshold must be positive")
+	}
+	c := &CompressingLogStore{
+		store:     store,
+		threshold: threshold,
+		level:     flate.DefaultCompression,
+	}
+	return c, nil
+}
+
+func (c *CompressingLogStore) FirstIndex() (uint64, error) {
+	return c.store.FirstIndex()
+}
+
+func (c *CompressingLogStore) LastIndex() (uint64, error) {
+	return c.store.LastIndex()
+}
+
+func (c *CompressingLogStore) GetLog(idx uint64, log *Log) error {
+	if err := c.store.GetLog(idx, log); err != nil {
+		return err
+	}
+	if err := decompressLog(log); err != nil {
+		return err
+	}
+	return log.verifyCRC()
+}
+
+func (c *CompressingLogStore) StoreLog(log *Log) error {
+	return c.StoreLogs([]*Log{log})
+}
+
+func (c *CompressingLogStore) StoreLogs(logs []*Log) error {
+	// Compress copies, the callers' logs are still in use
+	out := make([]*Log, len(logs))
+	for i, l := range logs {
+		out[i] = l
+		if len(l.Data) < c.threshold || l.Codec != LogCodecNone {
+			continue
+		}
+		compressed := *l
+		ok, err := compressLog(&compressed, c.level)
+		if err != nil {
+			return err
+		}
+		if ok {
+			out[i] = &compressed
+		}
+	}
+	return c.store.StoreLogs(out)
+}
+
+func (c *CompressingLogStore) DeleteRange(min, max uint64) error {
+	return c.store.DeleteRange(min, max)
+}
+
+// compressLog replaces the data of a log with its compressed form. It
+// returns false and leaves the log alone if compression does not help.
+func compressLog(l *Log, level int) (bool, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(l.Data); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	if buf.Len() >= len(l.Data) {
+		return false, nil
+	}
+	l.Data = buf.Bytes()
+	l.Codec = LogCodecFlate
+	return true, nil
+}
+
+// decompressLog restores the plain data of a log in place.
+func decompressLog(l *Log) error {
+	switch l.Codec {
+	case LogCodecNone:
+		return nil
+	case LogCodecFlate:
+		r := flate.NewReader(bytes.NewReader(l.Data))
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decompress log at index %d: %v", l.Index, err)
+		}
+		l.Data = data
+		l.Codec = LogCodecNone
+		return nil
+	default:
+		return fmt.Errorf("unknown codec %d for log at index %d", l.Codec, l.Index)
+	}
+}
@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressingLogStoreImpl(t *testing.T) {
+	var impl interface{} = &CompressingLogStore{}
+	if _, ok := impl.(LogStore); !ok {
+		t.Fatalf("CompressingLogStore not a LogStore")
+	}
+}
+
+func TestCompressingLogStore(t *testing.T) {
+	store := NewInmemStore()
+	c, err := NewCompressingLogStore(store, 64)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Store a small log, a large compressible one and a large random one
+	big := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	random := make([]byte, 128)
+	for i := range random {
+		random[i] = byte(i*7919 + i*i*31)
+	}
+	logs := []*Log{
+		&Log{Index: 1, Term: 1, Data: []byte("small")},
+		&Log{Index: 2, Term: 1, Data: big},
+		&Log{Index: 3, Term: 1, Data: random},
+	}
+	for _, l := range logs {
+		l.setCRC()
+	}
+	if err := c.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The callers' logs should be left alone
+	if logs[1].Codec != LogCodecNone || !bytes.Equal(logs[1].Data, big) {
+		t.Fatalf("bad: %#v", logs[1])
+	}
+
+	// Only the compressible log should be compressed underneath
+	for idx, codec := range map[uint64]LogCodec{1: LogCodecNone, 2: LogCodecFlate} {
+		var raw Log
+		if err := store.GetLog(idx, &raw); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if raw.Codec != codec {
+			t.Fatalf("bad codec for %d: %v", idx, raw.Codec)
+		}
+	}
+
+	// Everything should read back plain and intact
+	for _, l := range logs {
+		var out Log
+		if err := c.GetLog(l.Index, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Codec != LogCodecNone || !bytes.Equal(out.Data, l.Data) {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
+	// Logs written before compression was enabled are still readable
+	plain := NewInmemStore()
+	plain.StoreLog(&Log{Index: 1, Data: big})
+	c, _ = NewCompressingLogStore(plain, 64)
+	var out Log
+	if err := c.GetLog(1, &out); err != nil || !bytes.Equal(out.Data, big) {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+
+	// Corrupt compressed data should not decode
+	store.logs[2].Data = []byte("nonsense")
+	c, _ = NewCompressingLogStore(store, 64)
+	if err := c.GetLog(2, &out); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -7,9 +7,71 @@ import (
 	"time"
 )
 
+// ProtocolVersion is the version of the protocol (which includes RPC
+// messages as well as Raft-specific log entries) that this server can
+// understand. Every RPC carries the sender's version in its RPCHeader.
+//
+// The rules for interoperability are:
+//
+// Version 0: Original protocol, without an RPCHeader. Peers at this version
+// decode a newer header as an unknown field and ignore it, so they can talk
+// to version 1 peers.
+//
+// Version 1: Adds the RPCHeader to every request and response.
+//
+// Version 2: Adds election priorities and the TimeoutNow RPC used to
+// transfer leadership. Version 0 and 1 peers ignore the new fields. A leader
+// only transfers leadership once every server speaks at least version 2.
+//
+// Version 3: AppendEntries may carry logs with compressed data, marked by
+// Log.Codec. A leader only sends them to followers that advertised version 3
+// or later in a response, and only when both sides speak it. Until a
+// follower has responded, it is assumed to speak ProtocolVersionMin.
+//
+// Version 4: Followers advertise their newest snapshot in AppendEntries
+// responses, and serve snapshots to each other with the FetchSnapshot RPC.
+// A leader only points a follower at another one to fetch a snapshot from
+// when it and both followers speak version 4, since older followers would
+// take the empty stream of such an InstallSnapshot as the snapshot.
+//
+// A server accepts RPCs from peers speaking any version between
+// ProtocolVersionMin and ProtocolVersionMax, and rejects the rest with
+// ErrUnsupportedProtocol. A server speaks the version set in
+// Config.ProtocolVersion, so a rolling upgrade first deploys the new code
+// with the old version configured, and then bumps the configured version
+// once every server understands it. Features that change the shape of the
+// protocol must be gated on the minimum version seen in the cluster.
+type ProtocolVersion int
+
+const (
+	// ProtocolVersionMin is the minimum protocol version this server
+	// can understand.
+	ProtocolVersionMin ProtocolVersion = 0
+
+	// ProtocolVersionMax is the maximum protocol version this server
+	// can understand.
+	ProtocolVersionMax ProtocolVersion = 4
+
+	// MaxElectionPriority is the highest ElectionPriority a server can
+	// be configured with.
+	MaxElectionPriority = 10
+
+	// MinSnapshotRate is the lowest snapshot transfer rate, in bytes per
+	// second, that can be configured. A NetworkTransport allows a
+	// snapshot one timeout for every TimeoutScale bytes, so slower
+	// transfers would never finish in time. This holds for the default
+	// TimeoutScale and a timeout of at least a second.
+	MinSnapshotRate = 2 * DefaultTimeoutScale
+)
+
 // Config provides any necessary configuration to
 // the Raft server
 type Config struct {
+	// ProtocolVersion allows a Raft server to inter-operate with older
+	// Raft servers running an older version of the code. See the
+	// ProtocolVersion type for the compatibility rules.
+	ProtocolVersion ProtocolVersion
+
 	// Time in follower state without a leader before we attempt an election
 	HeartbeatTimeout time.Duration
 
@@ -38,6 +100,9 @@ type Config struct {
 	// if the node is removed from the Raft cluster via RemovePeer. Setting
 	// it to false will keep the bootstrap mode, allowing the node to self-elect
 	// and potentially bootstrap a seperate cluster.
+	//
+	// Deprecated: use BootstrapCluster instead, which does not depend on
+	// runtime flags.
 	DisableBootstrapAfterElect bool
 
 	// TrailingLogs controls how many logs we leave after a snapshot. This is
@@ -55,17 +120,96 @@ type Config struct {
 	// just replay a small set of logs.
 	SnapshotThreshold uint64
 
+	// SnapshotLogBytesThreshold controls how many bytes of log data must
+	// be stored since the last snapshot before we perform one, however few
+	// logs that is. It is checked every SnapshotInterval, and zero disables
+	// it. The count starts over when a node restarts.
+	SnapshotLogBytesThreshold uint64
+
+	// MaxSnapshotAge makes us perform a snapshot once the last one, or the
+	// start of the node, is this long ago and there are new logs since. It
+	// is checked every SnapshotInterval, and zero disables it.
+	MaxSnapshotAge time.Duration
+
+	// SnapshotWriteRate limits how fast snapshots are written to the
+	// SnapshotStore, in bytes per second, so that taking one does not
+	// starve log writes on the same disk. Zero is unlimited.
+	SnapshotWriteRate int64
+
+	// SnapshotSendRate limits how fast the leader sends snapshots to all
+	// followers together, and SnapshotReceiveRate how fast a follower
+	// receives one, in bytes per second, so that installing a snapshot
+	// does not starve heartbeats and replication. Zero is unlimited.
+	// Otherwise each of the MaxConcurrentSnapshotSends must get at least
+	// MinSnapshotRate, and so must a follower receiving a snapshot.
+	SnapshotSendRate    int64
+	SnapshotReceiveRate int64
+
+	// MaxConcurrentSnapshotSends limits how many snapshots the leader
+	// sends to followers at once. Further sends wait in line, where voters
+	// go before peers which are being removed. Zero is unlimited.
+	MaxConcurrentSnapshotSends int
+
+	// PeerSnapshotSourcing lets the leader point a follower which needs a
+	// snapshot at another healthy follower with the same or a newer one,
+	// to fetch it from there rather than from the leader. The follower
+	// falls back to the leader if that fails. It needs protocol version 4
+	// on the leader and both followers.
+	PeerSnapshotSourcing bool
+
+	// MaxSnapshotDeltas limits how many delta snapshots are taken in a
+	// row before a full snapshot compacts them again. Deltas are only
+	// taken if the FSM implements IncrementalFSM, its snapshots implement
+	// IncrementalFSMSnapshot and the SnapshotStore implements
+	// DeltaSnapshotStore. Zero always takes full snapshots.
+	MaxSnapshotDeltas int
+
+	// NoSnapshotSync turns off fsyncing finished snapshots, in stores that
+	// support it such as the FileSnapshotStore. A snapshot may then be lost
+	// or corrupt after a power failure, although the logs it replaced are
+	// already compacted, so this is only meant for tests.
+	NoSnapshotSync bool
+
 	// EnableSingleNode allows for a single node mode of operation. This
 	// is false by default, which prevents a lone node from electing itself
 	// leader.
+	//
+	// Deprecated: restarting a node with this flag still set can cause a
+	// split brain. Use BootstrapCluster to write an initial peer set instead.
 	EnableSingleNode bool
 
+	// ElectionPriority is used to prefer some servers as leader over others.
+	// It must be between 0 and MaxElectionPriority. A follower waits longer
+	// before starting an election the lower its priority is, scaling up to
+	// twice the HeartbeatTimeout at priority 0. A leader that sees a caught
+	// up follower with a higher priority transfers leadership to it. The
+	// priority never overrides the log up-to-date check when granting votes.
+	// DefaultConfig sets MaxElectionPriority, so every server is equal unless
+	// some are lowered.
+	ElectionPriority int
+
+	// ReplicationCompressionThreshold makes the leader compress the data
+	// of logs at least this many bytes long when sending them to followers,
+	// which cuts the bandwidth used by AppendEntries. Followers must speak
+	// protocol version 3. Zero disables compression on the wire.
+	ReplicationCompressionThreshold int
+
 	// LeaderLeaseTimeout is used to control how long the "lease" lasts
 	// for being the leader without being able to contact a quorum
 	// of nodes. If we reach this interval without contact, we will
 	// step down as leader.
 	LeaderLeaseTimeout time.Duration
 
+	// VerifyLogStore makes NewRaft check the log store before the node
+	// joins the cluster. It fails with a detailed error if the logs have
+	// gaps, terms that go backwards, or disagree with the newest snapshot.
+	VerifyLogStore bool
+
+	// VerifyLogStoreSampleSize limits how many logs VerifyLogStore reads.
+	// A longer log is checked at this many evenly spaced indexes instead
+	// of in full. Zero always checks every log.
+	VerifyLogStoreSampleSize int
+
 	// LogOutput is used as a sink for logs, unless Logger is specified.
 	// Defaults to os.Stderr.
 	LogOutput io.Writer
@@ -75,9 +219,100 @@ type Config struct {
 	Logger *log.Logger
 }
 
+// ReloadableConfig is the subset of Config that may be changed at runtime
+// using Raft.ReloadConfig. The meaning of each field is the same as in
+// Config.
+type ReloadableConfig struct {
+	// TrailingLogs controls how many logs we leave after a snapshot.
+	TrailingLogs uint64
+
+	// SnapshotInterval controls how often we check if we should perform
+	// a snapshot.
+	SnapshotInterval time.Duration
+
+	// SnapshotThreshold controls how many outstanding logs there must be
+	// before we perform a snapshot.
+	SnapshotThreshold uint64
+
+	// SnapshotLogBytesThreshold controls how many bytes of log data there
+	// must be since the last snapshot before we perform one.
+	SnapshotLogBytesThreshold uint64
+
+	// MaxSnapshotAge controls how old the last snapshot may get before we
+	// perform one.
+	MaxSnapshotAge time.Duration
+
+	// SnapshotWriteRate limits how fast snapshots are written, in bytes
+	// per second. It also applies to a snapshot already being written.
+	SnapshotWriteRate int64
+
+	// SnapshotSendRate and SnapshotReceiveRate limit how fast snapshots
+	// are sent and received, in bytes per second. They also apply to
+	// snapshots already being transferred.
+	SnapshotSendRate    int64
+	SnapshotReceiveRate int64
+
+	// MaxConcurrentSnapshotSends limits how many snapshots the leader
+	// sends at once. Raising it lets waiting sends start right away.
+	MaxConcurrentSnapshotSends int
+
+	// PeerSnapshotSourcing lets the leader have followers fetch snapshots
+	// from each other.
+	PeerSnapshotSourcing bool
+
+	// HeartbeatTimeout is the time in follower state without a leader
+	// before we attempt an election.
+	HeartbeatTimeout time.Duration
+
+	// ElectionTimeout is the time in candidate state without a leader
+	// before we attempt an election.
+	ElectionTimeout time.Duration
+
+	// MaxAppendEntries controls the maximum number of append entries
+	// to send at once.
+	MaxAppendEntries int
+}
+
+// apply returns a copy of base with the reloadable fields replaced
+func (rc *ReloadableConfig) apply(base *Config) *Config {
+	conf := *base
+	conf.TrailingLogs = rc.TrailingLogs
+	conf.SnapshotInterval = rc.SnapshotInterval
+	conf.SnapshotThreshold = rc.SnapshotThreshold
+	conf.SnapshotLogBytesThreshold = rc.SnapshotLogBytesThreshold
+	conf.MaxSnapshotAge = rc.MaxSnapshotAge
+	conf.SnapshotWriteRate = rc.SnapshotWriteRate
+	conf.SnapshotSendRate = rc.SnapshotSendRate
+	conf.SnapshotReceiveRate = rc.SnapshotReceiveRate
+	conf.MaxConcurrentSnapshotSends = rc.MaxConcurrentSnapshotSends
+	conf.PeerSnapshotSourcing = rc.PeerSnapshotSourcing
+	conf.HeartbeatTimeout = rc.HeartbeatTimeout
+	conf.ElectionTimeout = rc.ElectionTimeout
+	conf.MaxAppendEntries = rc.MaxAppendEntries
+	return &conf
+}
+
+// fromConfig copies the reloadable fields out of conf
+func (rc *ReloadableConfig) fromConfig(conf *Config) {
+	rc.TrailingLogs = conf.TrailingLogs
+	rc.SnapshotInterval = conf.SnapshotInterval
+	rc.SnapshotThreshold = conf.SnapshotThreshold
+	rc.SnapshotLogBytesThreshold = conf.SnapshotLogBytesThreshold
+	rc.MaxSnapshotAge = conf.MaxSnapshotAge
+	rc.SnapshotWriteRate = conf.SnapshotWriteRate
+	rc.SnapshotSendRate = conf.SnapshotSendRate
+	rc.SnapshotReceiveRate = conf.SnapshotReceiveRate
+	rc.MaxConcurrentSnapshotSends = conf.MaxConcurrentSnapshotSends
+	rc.PeerSnapshotSourcing = conf.PeerSnapshotSourcing
+	rc.HeartbeatTimeout = conf.HeartbeatTimeout
+	rc.ElectionTimeout = conf.ElectionTimeout
+	rc.MaxAppendEntries = conf.MaxAppendEntries
+}
+
 // DefaultConfig returns a Config with usable defaults.
 func DefaultConfig() *Config {
 	return &Config{
+		ProtocolVersion:            ProtocolVersionMax,
 		HeartbeatTimeout:           1000 * time.Millisecond,
 		ElectionTimeout:            1000 * time.Millisecond,
 		CommitTimeout:              50 * time.Millisecond,
@@ -87,13 +322,22 @@ func DefaultConfig() *Config {
 		TrailingLogs:               10240,
 		SnapshotInterval:           120 * time.Second,
 		SnapshotThreshold:          8192,
+		MaxSnapshotDeltas:          8,
+		MaxConcurrentSnapshotSends: 2,
 		EnableSingleNode:           false,
+		ElectionPriority:           MaxElectionPriority,
 		LeaderLeaseTimeout:         500 * time.Millisecond,
+		VerifyLogStoreSampleSize:   16384,
 	}
 }
 
 // ValidateConfig is used to validate a sane configuration
 func ValidateConfig(config *Config) error {
+	if config.ProtocolVersion < ProtocolVersionMin ||
+		config.ProtocolVersion > ProtocolVersionMax {
+		return fmt.Errorf("Protocol version %d must be >= %d and <= %d",
+			config.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
+	}
 	if config.HeartbeatTimeout < 5*time.Millisecond {
 		return fmt.Errorf("Heartbeat timeout is too low")
 	}
@@ -112,6 +356,9 @@ func ValidateConfig(config *Config) error {
 	if config.SnapshotInterval < 5*time.Millisecond {
 		return fmt.Errorf("Snapshot interval is too low")
 	}
+	if config.ElectionPriority < 0 || config.ElectionPriority > MaxElectionPriority {
+		return fmt.Errorf("ElectionPriority must be between 0 and %d", MaxElectionPriority)
+	}
 	if config.LeaderLeaseTimeout < 5*time.Millisecond {
 		return fmt.Errorf("Leader lease timeout is too low")
 	}
@@ -121,5 +368,34 @@ func ValidateConfig(config *Config) error {
 	if config.ElectionTimeout < config.HeartbeatTimeout {
 		return fmt.Errorf("Election timeout must be equal or greater than Heartbeat Timeout")
 	}
+	if config.MaxSnapshotAge < 0 {
+		return fmt.Errorf("MaxSnapshotAge must not be negative")
+	}
+	if config.SnapshotWriteRate < 0 || config.SnapshotSendRate < 0 || config.SnapshotReceiveRate < 0 {
+		return fmt.Errorf("Snapshot rates must not be negative")
+	}
+	if config.MaxConcurrentSnapshotSends < 0 {
+		return fmt.Errorf("MaxConcurrentSnapshotSends must not be negative")
+	}
+	if config.SnapshotSendRate > 0 {
+		if config.MaxConcurrentSnapshotSends == 0 {
+			return fmt.Errorf("SnapshotSendRate requires MaxConcurrentSnapshotSends, as sends share the rate")
+		}
+		if config.SnapshotSendRate < MinSnapshotRate*int64(config.MaxConcurrentSnapshotSends) {
+			return fmt.Errorf("SnapshotSendRate must be at least %d per concurrent send", MinSnapshotRate)
+		}
+	}
+	if config.SnapshotReceiveRate > 0 && config.SnapshotReceiveRate < MinSnapshotRate {
+		return fmt.Errorf("SnapshotReceiveRate must be at least %d", MinSnapshotRate)
+	}
+	if config.MaxSnapshotDeltas < 0 {
+		return fmt.Errorf("MaxSnapshotDeltas must not be negative")
+	}
+	if config.ReplicationCompressionThreshold < 0 {
+		return fmt.Errorf("ReplicationCompressionThreshold must not be negative")
+	}
+	if config.VerifyLogStoreSampleSize < 0 || config.VerifyLogStoreSampleSize == 1 {
+		return fmt.Errorf("VerifyLogStoreSampleSize must be zero or at least 2")
+	}
 	return nil
 }
@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"fmt"
+	"io"
+)
+
+// DiscardSnapshotStore is used to successfully snapshot while
+// always discarding the snapshot. This is useful for when the
+// log should be truncated but no snapshot should be retained.
+// This should never be used for production use, and is only
+// suitable for testing and benchmarks.
+type DiscardSnapshotStore struct{}
+
+// DiscardSnapshotSink implements SnapshotSink by discarding
+// everything written to it.
+type DiscardSnapshotSink struct{}
+
+// NewDiscardSnapshotStore is used to create a new DiscardSnapshotStore.
+func NewDiscardSnapshotStore() *DiscardSnapshotStore {
+	return &DiscardSnapshotStore{}
+}
+
+// Create returns a sink which discards the snapshot.
+func (d *DiscardSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSink, error) {
+	return &DiscardSnapshotSink{}, nil
+}
+
+// List never returns any snapshots.
+func (d *DiscardSnapshotStore) List() ([]*SnapshotMeta, error) {
+	return nil, nil
+}
+
+// Open always fails, as no snapshots are kept.
+func (d *DiscardSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	return nil, nil, fmt.Errorf("can not open from discard snapshot store")
+}
+
+// Write discards the data.
+func (d *DiscardSnapshotSink) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Close does nothing.
+func (d *DiscardSnapshotSink) Close() error {
+	return nil
+}
+
+// ID returns a fixed ID, as the snapshot can not be opened.
+func (d *DiscardSnapshotSink) ID() string {
+	return "discard"
+}
+
+// Cancel does nothing.
+func (d *DiscardSnapshotSink) Cancel() error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package raft
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// encryptedLogVersion is the version of the header in front of
+	// encrypted log data.
+	encryptedLogVersion = 1
+)
+
+// EncryptingLogStore wraps any LogStore implementation to encrypt the
+// Data of every log with AES-GCM before it is stored, and to decrypt it
+// when read. Each log carries a header with the ID of the key used, so
+// logs written under older keys stay readable after a rotation, and logs
+// written before encryption was enabled are returned as they are. The
+// index, term and type of the log are authenticated along with the data.
+// To combine it with compression, wrap it in a CompressingLogStore so
+// data is compressed before it is encrypted.
+type EncryptingLogStore struct {
+	store LogStore
+	aeads *aeadCache
+}
+
+// NewEncryptingLogStore is used to create a new EncryptingLogStore
+// using keys from the given provider.
+func NewEncryptingLogStore(store LogStore, keys KeyProvider) (*EncryptingLogStore, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("key provider is required")
+	}
+	e := &EncryptingLogStore{
+		store: store,
+		aeads: newAEADCache(keys),
+	}
+	return e, nil
+}
+
+func (e *EncryptingLogStore) FirstIndex() (uint64, error) {
+	return e.store.FirstIndex()
+}
+
+func (e *EncryptingLogStore) LastIndex() (uint64, error) {
+	return e.store.LastIndex()
+}
+
+func (e *EncryptingLogStore) GetLog(idx uint64, log *Log) error {
+	if err := e.store.GetLog(idx, log); err != nil {
+		return err
+	}
+	if log.Codec == LogCodecAESGCM {
+		if err := e.decrypt(log); err != nil {
+			return err
+		}
+	}
+	return log.verifyCRC()
+}
+
+func (e *EncryptingLogStore) StoreLog(log *Log) error {
+	return e.StoreLogs([]*Log{log})
+}
+
+func (e *EncryptingLogStore) StoreLogs(logs []*Log) error {
+	// Encrypt copies, the callers' logs are still in use
+	out := make([]*Log, len(logs))
+	for i, l := range logs {
+		encrypted := *l
+		if err := e.encrypt(&encrypted); err != nil {
+			return err
+		}
+		out[i] = &encrypted
+	}
+	return e.store.StoreLogs(out)
+}
+
+func (e *EncryptingLogStore) DeleteRange(min, max uint64) error {
+	return e.store.DeleteRange(min, max)
+}
+
+// encryptedLogAAD returns the data authenticated along with a log: its
+// position in the log and the header in front of the ciphertext.
+func encryptedLogAAD(l *Log, header []byte) []byte {
+	aad := make([]byte, 17, 17+len(header))
+	binary.BigEndian.PutUint64(aad[0:8], l.Index)
+	binary.BigEndian.PutUint64(aad[8:16], l.Term)
+	aad[16] = uint8(l.Type)
+	return append(aad, header...)
+}
+
+// encrypt replaces the data of a log with a header and the ciphertext.
+// The header holds the version, the codec of the plain data and the key
+// ID, followed by the nonce.
+func (e *EncryptingLogStore) encrypt(l *Log) error {
+	id, aead, err := e.aeads.current()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, 3+len(id)+aead.NonceSize())
+	header = append(header, encryptedLogVersion, uint8(l.Codec), uint8(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	aad := encryptedLogAAD(l, header)
+	header = append(header, nonce...)
+
+	l.Data = aead.Seal(header, nonce, l.Data, aad)
+	l.Codec = LogCodecAESGCM
+	return nil
+}
+
+// decrypt restores the data and codec of an encrypted log in place.
+func (e *EncryptingLogStore) decrypt(l *Log) error {
+	data := l.Data
+	if len(data) < 3 || data[0] != encryptedLogVersion {
+		return fmt.Errorf("bad encryption header for log at index %d", l.Index)
+	}
+	idLen := int(data[2])
+	if len(data) < 3+idLen {
+		return fmt.Errorf("bad encryption header for log at index %d", l.Index)
+	}
+	header := data[:3+idLen]
+	aead, err := e.aeads.byID(string(header[3:]))
+	if err != nil {
+		return fmt.Errorf("failed to get key for log at index %d: %v", l.Index, err)
+	}
+	if len(data) < len(header)+aead.NonceSize() {
+		return fmt.Errorf("bad encryption header for log at index %d", l.Index)
+	}
+	nonce := data[len(header) : len(header)+aead.NonceSize()]
+	ciphertext := data[len(header)+aead.NonceSize():]
+
+	plain, err := aead.Open(nil, nonce, ciphertext, encryptedLogAAD(l, header))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt log at index %d: %v", l.Index, err)
+	}
+	l.Data = plain
+	l.Codec = LogCodec(header[1])
+	return nil
+}
@@ -0,0 +1,134 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptingLogStoreImpl(t *testing.T) {
+	var impl interface{} = &EncryptingLogStore{}
+	if _, ok := impl.(LogStore); !ok {
+		t.Fatalf("EncryptingLogStore not a LogStore")
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	if _, err := NewKeyRing("k1", []byte("short")); err == nil {
+		t.Fatalf("expected error")
+	}
+	keys, err := NewKeyRing("k1", testKey(1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := keys.Rotate("k2", testKey(2)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id, key, _ := keys.CurrentKey(); id != "k2" || !bytes.Equal(key, testKey(2)) {
+		t.Fatalf("bad: %v", id)
+	}
+	if key, err := keys.Key("k1"); err != nil || !bytes.Equal(key, testKey(1)) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// An ID can not be reused for another key
+	if err := keys.Rotate("k1", testKey(3)); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestEncryptingLogStore(t *testing.T) {
+	store := NewInmemStore()
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, err := NewEncryptingLogStore(store, keys)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Store a log written before encryption was enabled
+	plain := &Log{Index: 1, Term: 1, Data: []byte("plain")}
+	plain.setCRC()
+	if err := store.StoreLog(plain); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Store logs under two keys
+	l2 := &Log{Index: 2, Term: 1, Data: []byte("secret two")}
+	l2.setCRC()
+	if err := e.StoreLog(l2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keys.Rotate("k2", testKey(2))
+	l3 := &Log{Index: 3, Term: 1, Data: []byte("secret three")}
+	l3.setCRC()
+	if err := e.StoreLog(l3); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The callers' logs are untouched, the stored ones are not readable
+	if !bytes.Equal(l2.Data, []byte("secret two")) || l2.Codec != LogCodecNone {
+		t.Fatalf("bad: %#v", l2)
+	}
+	raw := store.logs[3]
+	if raw.Codec != LogCodecAESGCM || bytes.Contains(raw.Data, []byte("secret")) {
+		t.Fatalf("bad: %#v", raw)
+	}
+	if !bytes.Contains(raw.Data, []byte("k2")) {
+		t.Fatalf("key ID should be in the header")
+	}
+
+	// Everything reads back
+	for _, l := range []*Log{plain, l2, l3} {
+		var out Log
+		if err := e.GetLog(l.Index, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(out.Data, l.Data) || out.Codec != LogCodecNone {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+
+	// Moving the ciphertext to another index must fail
+	moved := *store.logs[2]
+	moved.Index = 4
+	store.logs[4] = &moved
+	var out Log
+	if err := e.GetLog(4, &out); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Unknown keys fail
+	other, _ := NewKeyRing("k3", testKey(3))
+	e, _ = NewEncryptingLogStore(store, other)
+	if err := e.GetLog(2, &out); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestEncryptingLogStore_Compressed(t *testing.T) {
+	store := NewInmemStore()
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, _ := NewEncryptingLogStore(store, keys)
+	c, _ := NewCompressingLogStore(e, 64)
+
+	// Compress first, then encrypt
+	big := bytes.Repeat([]byte("compressible "), 100)
+	l := &Log{Index: 1, Term: 1, Data: big}
+	l.setCRC()
+	if err := c.StoreLog(l); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if raw := store.logs[1]; len(raw.Data) >= len(big) {
+		t.Fatalf("should be compressed: %d", len(raw.Data))
+	}
+	var out Log
+	if err := c.GetLog(1, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out.Data, big) {
+		t.Fatalf("bad: %#v", out)
+	}
+}
@@ -0,0 +1,359 @@
+package raft
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// encryptedSnapshotMagic starts every encrypted snapshot, and
+	// includes the format version in its last byte.
+	encryptedSnapshotMagic = "raftenc\x01"
+
+	// encryptedSnapshotChunk is the amount of plain data sealed in
+	// each chunk of an encrypted snapshot.
+	encryptedSnapshotChunk = 64 * 1024
+
+	// encryptedChunkFinal marks the last chunk in its length prefix.
+	encryptedChunkFinal = 1 << 31
+)
+
+// snapshotKeyIDSetter is implemented by sinks that can record the ID of
+// the key used to encrypt a snapshot in their metadata.
+type snapshotKeyIDSetter interface {
+	setKeyID(id string)
+}
+
+// EncryptingSnapshotStore wraps any SnapshotStore implementation to
+// encrypt snapshots with AES-GCM. The stream starts with a header naming
+// the key, so snapshots taken under older keys stay readable after a
+// rotation. The data is sealed in chunks whose order and count are
+// authenticated, so a reordered or truncated snapshot fails to read.
+// Snapshots without the header, taken before encryption was enabled, are
+// returned as they are, unless their meta data flags them as encrypted. The wrapped store only ever sees ciphertext, so
+// checks such as the CRC of a FileSnapshotStore cover the ciphertext.
+type EncryptingSnapshotStore struct {
+	store SnapshotStore
+	aeads *aeadCache
+}
+
+// NewEncryptingSnapshotStore is used to create a new
+// EncryptingSnapshotStore using keys from the given provider.
+func NewEncryptingSnapshotStore(store SnapshotStore, keys KeyProvider) (*EncryptingSnapshotStore, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("key provider is required")
+	}
+	e := &EncryptingSnapshotStore{
+		store: store,
+		aeads: newAEADCache(keys),
+	}
+	return e, nil
+}
+
+// Create is used to start a new encrypted snapshot
+func (e *EncryptingSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSink, error) {
+	id, aead, err := e.aeads.current()
+	if err != nil {
+		return nil, err
+	}
+	sink, err := e.store.Create(index, term, peers)
+	if err != nil {
+		return nil, err
+	}
+	if setter, ok := sink.(snapshotKeyIDSetter); ok {
+		setter.setKeyID(id)
+	}
+
+	// Write out the header
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+	header := encryptedSnapshotHeader(id, nonce)
+	if _, err := sink.Write(header); err != nil {
+		sink.Cancel()
+		return nil, err
+	}
+
+	enc := &encryptingSnapshotSink{
+		SnapshotSink: sink,
+		aead:         aead,
+		nonce:        nonce,
+		buf:          make([]byte, 0, encryptedSnapshotChunk),
+	}
+	return enc, nil
+}
+
+// List returns available snapshots in the wrapped store. The sizes are
+// those of the ciphertext.
+func (e *EncryptingSnapshotStore) List() ([]*SnapshotMeta, error) {
+	return e.store.List()
+}
+
+// setNoSync stops the wrapped store from fsyncing finished snapshots, if
+// it can.
+func (e *EncryptingSnapshotStore) setNoSync() {
+	if setter, ok := e.store.(snapshotNoSyncSetter); ok {
+		setter.setNoSync()
+	}
+}
+
+// Open takes a snapshot ID and returns a ReadCloser that decrypts it.
+// The returned meta data has the size of the plain data, and is no
+// longer flagged as encrypted.
+func (e *EncryptingSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, rc, err := e.store.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check for the header, passing through plain snapshots. One
+	// flagged as encrypted must have it, or it was tampered with.
+	buffered := bufio.NewReader(rc)
+	magic, err := buffered.Peek(len(encryptedSnapshotMagic))
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, nil, err
+	}
+	if string(magic) != encryptedSnapshotMagic {
+		if meta.Header.Flags&SnapshotEncrypted != 0 {
+			rc.Close()
+			return nil, nil, fmt.Errorf("encrypted snapshot %v is missing its encryption header", id)
+		}
+		return meta, &readCloser{buffered, rc}, nil
+	}
+
+	dec, headerLen, err := e.newDecryptingReader(buffered)
+	if err != nil {
+		rc.Close()
+		return nil, nil, fmt.Errorf("failed to open encrypted snapshot %v: %v", id, err)
+	}
+	plainMeta := *meta
+	plainMeta.Size = encryptedPlainSize(meta.Size-headerLen, dec.aead.Overhead())
+	plainMeta.Header.Flags &^= SnapshotEncrypted
+	return &plainMeta, &readCloser{dec, rc}, nil
+}
+
+// encryptedSnapshotHeader returns the header of an encrypted snapshot
+func encryptedSnapshotHeader(id string, nonce []byte) []byte {
+	header := make([]byte, 0, len(encryptedSnapshotMagic)+1+len(id)+len(nonce))
+	header = append(header, encryptedSnapshotMagic...)
+	header = append(header, uint8(len(id)))
+	header = append(header, id...)
+	return append(header, nonce...)
+}
+
+// encryptedPlainSize returns the size of the plain data given the size
+// of the chunks that follow the header. Every chunk but the last holds
+// a full encryptedSnapshotChunk.
+func encryptedPlainSize(size int64, overhead int) int64 {
+	full := int64(4 + encryptedSnapshotChunk + overhead)
+	last := int64(4 + overhead)
+	if size < last {
+		return 0
+	}
+	n := (size - last) / full
+	return n*encryptedSnapshotChunk + (size-last)%full
+}
+
+// chunkNonce derives the nonce of a chunk from the base nonce
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := append([]byte{}, base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^counter)
+	return nonce
+}
+
+// chunkAAD returns the data authenticated with each chunk
+func chunkAAD(counter uint64, final bool) []byte {
+	var aad [9]byte
+	binary.BigEndian.PutUint64(aad[0:8], counter)
+	if final {
+		aad[8] = 1
+	}
+	return aad[:]
+}
+
+// encryptingSnapshotSink seals the written data in chunks
+type encryptingSnapshotSink struct {
+	SnapshotSink
+	aead    cipher.AEAD
+	nonce   []byte
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// SetHeader flags the snapshot as encrypted, and records the header in
+// the wrapped sink if it can.
+func (s *encryptingSnapshotSink) SetHeader(header SnapshotHeader) {
+	if sink, ok := s.SnapshotSink.(SnapshotHeaderSink); ok {
+		header.Flags |= SnapshotEncrypted
+		sink.SetHeader(header)
+	}
+}
+
+// SetLabel records a label in the wrapped sink if it can. Labels are
+// stored as they are, without encryption.
+func (s *encryptingSnapshotSink) SetLabel(key, value string) {
+	if sink, ok := s.SnapshotSink.(SnapshotLabelSink); ok {
+		sink.SetLabel(key, value)
+	}
+}
+
+// Write buffers the data, sealing each full chunk once more data follows
+func (s *encryptingSnapshotSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(s.buf) == encryptedSnapshotChunk {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := encryptedSnapshotChunk - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// seal encrypts the buffered data as the next chunk
+func (s *encryptingSnapshotSink) seal(final bool) error {
+	sealed := s.aead.Seal(make([]byte, 4, 4+len(s.buf)+s.aead.Overhead()),
+		chunkNonce(s.nonce, s.counter), s.buf, chunkAAD(s.counter, final))
+	length := uint32(len(sealed) - 4)
+	if final {
+		length |= encryptedChunkFinal
+	}
+	binary.BigEndian.PutUint32(sealed[0:4], length)
+	if _, err := s.SnapshotSink.Write(sealed); err != nil {
+		return err
+	}
+	s.counter++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Close seals the final chunk and closes the wrapped sink
+func (s *encryptingSnapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.seal(true); err != nil {
+		s.SnapshotSink.Cancel()
+		return err
+	}
+	return s.SnapshotSink.Close()
+}
+
+// Cancel cancels the wrapped sink
+func (s *encryptingSnapshotSink) Cancel() error {
+	s.closed = true
+	return s.SnapshotSink.Cancel()
+}
+
+// decryptingReader opens the chunks of an encrypted snapshot
+type decryptingReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	buf     []byte
+	counter uint64
+	final   bool
+}
+
+// newDecryptingReader reads the header of an encrypted snapshot and
+// returns a reader for the plain data, along with the header length.
+func (e *EncryptingSnapshotStore) newDecryptingReader(r io.Reader) (*decryptingReader, int64, error) {
+	var prefix [len(encryptedSnapshotMagic) + 1]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, 0, err
+	}
+	if string(prefix[:len(encryptedSnapshotMagic)]) != encryptedSnapshotMagic {
+		return nil, 0, fmt.Errorf("not an encrypted snapshot")
+	}
+	id := make([]byte, prefix[len(encryptedSnapshotMagic)])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, 0, err
+	}
+	aead, err := e.aeads.byID(string(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, 0, err
+	}
+	dec := &decryptingReader{
+		r:     r,
+		aead:  aead,
+		nonce: nonce,
+	}
+	return dec, int64(len(prefix) + len(id) + len(nonce)), nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (d *decryptingReader) next() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	final := length&encryptedChunkFinal != 0
+	length &^= encryptedChunkFinal
+	if length > encryptedSnapshotChunk+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("encrypted snapshot chunk is too large")
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.nonce, d.counter), sealed, chunkAAD(d.counter, final))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt snapshot chunk %d: %v", d.counter, err)
+	}
+	d.counter++
+	d.buf = plain
+	d.final = final
+
+	// Nothing may follow the final chunk
+	if final {
+		var extra [1]byte
+		if n, _ := d.r.Read(extra[:]); n > 0 {
+			return fmt.Errorf("unexpected data after the final snapshot chunk")
+		}
+	}
+	return nil
+}
+
+// readCloser pairs a reader with the closer of the underlying stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
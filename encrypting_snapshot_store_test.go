@@ -0,0 +1,208 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptingSnapshotStoreImpl(t *testing.T) {
+	var impl interface{} = &EncryptingSnapshotStore{}
+	if _, ok := impl.(SnapshotStore); !ok {
+		t.Fatalf("EncryptingSnapshotStore not a SnapshotStore")
+	}
+}
+
+func encryptedSnapTest(t *testing.T, e *EncryptingSnapshotStore, index uint64, data []byte) string {
+	sink, err := e.Create(index, 3, []byte("peers"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := sink.Write(data); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return sink.ID()
+}
+
+func checkEncryptedSnap(t *testing.T, e *EncryptingSnapshotStore, id string, data []byte) {
+	meta, r, err := e.Open(id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("bad data for %v", id)
+	}
+	if meta.Size != int64(len(data)) {
+		t.Fatalf("bad size: %d %d", meta.Size, len(data))
+	}
+}
+
+func TestEncryptingSnapshotStore(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, err := NewEncryptingSnapshotStore(snap, keys)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A snapshot spanning several chunks, under the first key
+	big := bytes.Repeat([]byte("snapshot data "), 20000)
+	id1 := encryptedSnapTest(t, e, 10, big)
+
+	// An empty and an exactly chunk sized snapshot, under a second key
+	keys.Rotate("k2", testKey(2))
+	id2 := encryptedSnapTest(t, e, 20, nil)
+	exact := bytes.Repeat([]byte{7}, encryptedSnapshotChunk)
+	id3 := encryptedSnapTest(t, e, 30, exact)
+
+	checkEncryptedSnap(t, e, id1, big)
+	checkEncryptedSnap(t, e, id2, nil)
+	checkEncryptedSnap(t, e, id3, exact)
+
+	// The key ID should be recorded in the meta data
+	meta, err := snap.readMeta(id1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.KeyID != "k1" {
+		t.Fatalf("bad: %v", meta.KeyID)
+	}
+
+	// The state on disk should be ciphertext
+	state, err := ioutil.ReadFile(filepath.Join(dir, snapPath, id1, stateFilePath))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(state, []byte("snapshot data")) {
+		t.Fatalf("state is not encrypted")
+	}
+
+	// The CRC still covers the ciphertext
+	state[len(state)/2] ^= 0x1
+	if err := ioutil.WriteFile(filepath.Join(dir, snapPath, id1, stateFilePath), state, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := e.Open(id1); err == nil {
+		t.Fatalf("expected CRC error")
+	}
+
+	// The header is flagged as encrypted in the store, but not once the
+	// snapshot is opened
+	sink, _ := e.Create(40, 3, nil)
+	sink.(SnapshotHeaderSink).SetHeader(SnapshotHeader{FormatVersion: SnapshotFormatVersion})
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snaps, _ := e.List(); snaps[0].Header.Flags != SnapshotEncrypted {
+		t.Fatalf("bad: %v", snaps[0].Header)
+	}
+	plainMeta, r, err := e.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r.Close()
+	if plainMeta.Header.Flags != 0 || plainMeta.Header.FormatVersion != SnapshotFormatVersion {
+		t.Fatalf("bad: %v", plainMeta.Header)
+	}
+}
+
+func TestEncryptingSnapshotStore_Plain(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	// Take a snapshot before encryption is enabled
+	sink, err := snap.Create(10, 3, []byte("peers"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.Write([]byte("plain"))
+	sink.Close()
+
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, _ := NewEncryptingSnapshotStore(snap, keys)
+	checkEncryptedSnap(t, e, sink.ID(), []byte("plain"))
+
+	// Plain data is refused if the meta data says it is encrypted,
+	// by either its header or its key ID
+	sink, _ = snap.Create(11, 3, []byte("peers"))
+	sink.(SnapshotHeaderSink).SetHeader(SnapshotHeader{Flags: SnapshotEncrypted})
+	sink.Write([]byte("plain"))
+	sink.Close()
+	if _, _, err := e.Open(sink.ID()); err == nil {
+		t.Fatalf("expected error")
+	}
+	sink, _ = snap.Create(12, 3, []byte("peers"))
+	sink.(snapshotKeyIDSetter).setKeyID("k1")
+	sink.Write([]byte("plain"))
+	sink.Close()
+	if _, _, err := e.Open(sink.ID()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestEncryptingSnapshotStore_Truncated(t *testing.T) {
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, _ := NewEncryptingSnapshotStore(nil, keys)
+
+	// Build an encrypted stream in memory
+	var out bytes.Buffer
+	_, aead, _ := e.aeads.current()
+	nonce := make([]byte, aead.NonceSize())
+	out.Write(encryptedSnapshotHeader("k1", nonce))
+	sink := &encryptingSnapshotSink{
+		SnapshotSink: &bufferSink{&out},
+		aead:         aead,
+		nonce:        nonce,
+	}
+	data := bytes.Repeat([]byte("x"), 3*encryptedSnapshotChunk)
+	sink.Write(data)
+	sink.Close()
+	stream := out.Bytes()
+
+	// The whole stream reads back
+	dec, _, err := e.newDecryptingReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if plain, err := ioutil.ReadAll(dec); err != nil || !bytes.Equal(plain, data) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// Dropping the final chunk is detected
+	header := len(encryptedSnapshotHeader("k1", nonce))
+	chunk := 4 + encryptedSnapshotChunk + aead.Overhead()
+	dec, _, _ = e.newDecryptingReader(bytes.NewReader(stream[:header+2*chunk]))
+	if _, err := ioutil.ReadAll(dec); err != io.ErrUnexpectedEOF {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Swapping chunks is detected
+	swapped := append([]byte{}, stream...)
+	copy(swapped[header:], stream[header+chunk:header+2*chunk])
+	copy(swapped[header+chunk:], stream[header:header+chunk])
+	dec, _, _ = e.newDecryptingReader(bytes.NewReader(swapped))
+	if _, err := ioutil.ReadAll(dec); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// bufferSink is a SnapshotSink writing to a buffer
+type bufferSink struct {
+	*bytes.Buffer
+}
+
+func (b *bufferSink) ID() string    { return "buffer" }
+func (b *bufferSink) Cancel() error { return nil }
+func (b *bufferSink) Close() error  { return nil }
@@ -0,0 +1,755 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logPath            = "logs"
+	segmentSuffix      = ".seg"
+	firstIndexFilePath = "first_index"
+
+	// recordHeaderSize is the length and CRC in front of every record.
+	// entryHeaderSize is the index, term, type, log CRC and codec in
+	// front of the data.
+	recordHeaderSize = 8
+	entryHeaderSize  = 22
+)
+
+var (
+	// ErrLogStoreClosed is returned when using a FileLogStore after Close.
+	ErrLogStoreClosed = fmt.Errorf("log store is closed")
+)
+
+// LogSyncPolicy controls when a FileLogStore fsyncs appended logs.
+type LogSyncPolicy uint8
+
+const (
+	// LogSyncBatch fsyncs after every StoreLog or StoreLogs call. This is
+	// the only policy that is safe against power loss.
+	LogSyncBatch LogSyncPolicy = iota
+
+	// LogSyncInterval fsyncs in the background every SyncInterval. A
+	// crash may lose the logs written since the last sync.
+	LogSyncInterval
+
+	// LogSyncNever leaves flushing to the operating system. Only useful
+	// for testing or when durability is provided some other way.
+	LogSyncNever
+)
+
+// FileLogStoreConfig is used to tune a FileLogStore.
+type FileLogStoreConfig struct {
+	// SegmentSize is the size in bytes after which a new segment
+	// file is started. Prefix deletes free whole segments at a time.
+	SegmentSize int64
+
+	// SyncPolicy controls when appended logs are fsynced.
+	SyncPolicy LogSyncPolicy
+
+	// SyncInterval is how often logs are fsynced with LogSyncInterval.
+	SyncInterval time.Duration
+
+	// LogOutput is used as the sink for logs. Defaults to os.Stderr.
+	LogOutput io.Writer
+}
+
+// DefaultFileLogStoreConfig returns a FileLogStoreConfig with usable defaults.
+func DefaultFileLogStoreConfig() *FileLogStoreConfig {
+	return &FileLogStoreConfig{
+		SegmentSize:  64 * 1024 * 1024,
+		SyncPolicy:   LogSyncBatch,
+		SyncInterval: 50 * time.Millisecond,
+	}
+}
+
+// FileLogStore implements the LogStore interface using append-only
+// segment files on the local disk. Every record carries a CRC, and
+// torn writes at the tail are truncated when the store is opened.
+type FileLogStore struct {
+	path   string
+	conf   FileLogStoreConfig
+	logger *log.Logger
+
+	l        sync.RWMutex
+	segments []*logSegment
+
+	// lowIndex is persisted in the first index file. Records below
+	// it have been deleted but may still be present in a segment.
+	lowIndex uint64
+
+	dirty      bool
+	closed     bool
+	shutdownCh chan struct{}
+	syncDoneCh chan struct{}
+}
+
+// logSegment is a single segment file. Records are appended to the
+// last segment only, and every segment holds at least one log.
+type logSegment struct {
+	path    string
+	fh      *os.File
+	size    int64
+	indexes []uint64
+	offsets []int64
+}
+
+// NewFileLogStore creates a FileLogStore in the logs directory under
+// base, recovering any existing segments. A nil conf uses the defaults.
+func NewFileLogStore(base string, conf *FileLogStoreConfig) (*FileLogStore, error) {
+	if conf == nil {
+		conf = DefaultFileLogStoreConfig()
+	}
+	if conf.SegmentSize <= 0 {
+		return nil, fmt.Errorf("segment size must be positive")
+	}
+	if conf.SyncPolicy == LogSyncInterval && conf.SyncInterval <= 0 {
+		return nil, fmt.Errorf("sync interval must be positive")
+	}
+	logOutput := conf.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+
+	// Ensure our path exists
+	path := filepath.Join(base, logPath)
+	if err := os.MkdirAll(path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("log path not accessible: %v", err)
+	}
+
+	// Setup the store
+	store := &FileLogStore{
+		path:       path,
+		conf:       *conf,
+		logger:     log.New(logOutput, "", log.LstdFlags),
+		shutdownCh: make(chan struct{}),
+	}
+	if err := store.recover(); err != nil {
+		store.closeSegments()
+		return nil, err
+	}
+
+	// Start the background sync
+	if conf.SyncPolicy == LogSyncInterval {
+		store.syncDoneCh = make(chan struct{})
+		go store.runSync()
+	}
+	return store, nil
+}
+
+// segmentName returns the file name for a segment starting at index
+func segmentName(index uint64) string {
+	return fmt.Sprintf("%020d%s", index, segmentSuffix)
+}
+
+// recover opens the existing segments, rebuilding the index and
+// truncating a torn write at the tail of the last segment. Corruption
+// anywhere else is an error, since committed logs would be lost.
+func (f *FileLogStore) recover() error {
+	// Read the first index, if any
+	buf, err := ioutil.ReadFile(filepath.Join(f.path, firstIndexFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(buf) == 8 {
+		f.lowIndex = binary.BigEndian.Uint64(buf)
+	} else if len(buf) != 0 {
+		return fmt.Errorf("invalid first index file")
+	}
+
+	// Find the segments, ordered by start index
+	entries, err := ioutil.ReadDir(f.path)
+	if err != nil {
+		return err
+	}
+	var starts []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			f.logger.Printf("[WARN] log store: Removing temporary file: %v", name)
+			os.Remove(filepath.Join(f.path, name))
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid segment name %q", name)
+		}
+		starts = append(starts, start)
+	}
+	sort.Sort(uint64Slice(starts))
+
+	var lastIndex uint64
+	for i, start := range starts {
+		path := filepath.Join(f.path, segmentName(start))
+		fh, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &logSegment{path: path, fh: fh}
+		f.segments = append(f.segments, seg)
+
+		torn, err := f.scanSegment(seg, lastIndex, i == len(starts)-1)
+		if err != nil {
+			return err
+		}
+		if len(seg.indexes) > 0 {
+			lastIndex = seg.lastIndex()
+		}
+		if !torn {
+			continue
+		}
+
+		// Only the last write can be torn by a crash, so cut it off
+		f.logger.Printf("[WARN] log store: Truncating torn segment %v at offset %d", path, seg.size)
+		if err := fh.Truncate(seg.size); err != nil {
+			return err
+		}
+		if err := fh.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Drop segments that no longer hold any logs
+	var kept []*logSegment
+	for _, seg := range f.segments {
+		if len(seg.indexes) > 0 {
+			kept = append(kept, seg)
+			continue
+		}
+		seg.fh.Close()
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+	f.segments = kept
+	return fsyncDir(f.path)
+}
+
+// scanSegment reads every record in a segment to build its index. It
+// returns true if the last segment ends in a torn write, leaving seg.size
+// at the end of the last valid record. A bad record is only torn if it
+// is in the last segment and no valid record follows it.
+func (f *FileLogStore) scanSegment(seg *logSegment, prevIndex uint64, last bool) (bool, error) {
+	stat, err := seg.fh.Stat()
+	if err != nil {
+		return false, err
+	}
+	fileSize := stat.Size()
+
+	// bad reports a record which failed to read or verify, given where
+	// it claims to end
+	bad := func(end int64) (bool, error) {
+		if last && (end >= fileSize || !validRecordAt(seg.fh, end, fileSize)) {
+			return true, nil
+		}
+		return false, fmt.Errorf("corrupt record in log segment %v at offset %d", seg.path, seg.size)
+	}
+
+	buffered := bufio.NewReader(io.NewSectionReader(seg.fh, 0, fileSize))
+	var hdr [recordHeaderSize]byte
+	var entry Log
+	for {
+		if _, err := io.ReadFull(buffered, hdr[:]); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return bad(fileSize)
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		end := seg.size + recordHeaderSize + length
+		if length < entryHeaderSize || end > fileSize {
+			return bad(fileSize)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(buffered, payload); err != nil {
+			return bad(fileSize)
+		}
+		if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+			return bad(end)
+		}
+		decodeEntry(payload, &entry)
+		if entry.Index <= prevIndex && (prevIndex != 0 || len(seg.indexes) > 0) {
+			return false, fmt.Errorf("out of order log %d in log segment %v at offset %d", entry.Index, seg.path, seg.size)
+		}
+		prevIndex = entry.Index
+
+		// Skip over logs that were deleted as a prefix
+		if entry.Index >= f.lowIndex {
+			seg.indexes = append(seg.indexes, entry.Index)
+			seg.offsets = append(seg.offsets, seg.size)
+		}
+		seg.size = end
+	}
+}
+
+// validRecordAt returns whether a record with a valid checksum starts at
+// the given offset of a segment.
+func validRecordAt(fh *os.File, offset, fileSize int64) bool {
+	var hdr [recordHeaderSize]byte
+	if _, err := fh.ReadAt(hdr[:], offset); err != nil {
+		return false
+	}
+	length := int64(binary.BigEndian.Uint32(hdr[0:4]))
+	if length < entryHeaderSize || offset+recordHeaderSize+length > fileSize {
+		return false
+	}
+	payload := make([]byte, length)
+	if _, err := fh.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return false
+	}
+	return crc32.Checksum(payload, castagnoliTable) == binary.BigEndian.Uint32(hdr[4:8])
+}
+
+// appendRecord encodes a log as a record onto buf.
+func appendRecord(buf []byte, l *Log) []byte {
+	var hdr [recordHeaderSize + entryHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(entryHeaderSize+len(l.Data)))
+	binary.BigEndian.PutUint64(hdr[8:16], l.Index)
+	binary.BigEndian.PutUint64(hdr[16:24], l.Term)
+	hdr[24] = uint8(l.Type)
+	binary.BigEndian.PutUint32(hdr[25:29], l.CRC)
+	hdr[29] = uint8(l.Codec)
+	crc := crc32.Update(0, castagnoliTable, hdr[recordHeaderSize:])
+	crc = crc32.Update(crc, castagnoliTable, l.Data)
+	binary.BigEndian.PutUint32(hdr[4:8], crc)
+	buf = append(buf, hdr[:]...)
+	return append(buf, l.Data...)
+}
+
+// decodeEntry decodes a record payload which has already been checked.
+func decodeEntry(payload []byte, l *Log) {
+	l.Index = binary.BigEndian.Uint64(payload[0:8])
+	l.Term = binary.BigEndian.Uint64(payload[8:16])
+	l.Type = LogType(payload[16])
+	l.CRC = binary.BigEndian.Uint32(payload[17:21])
+	l.Codec = LogCodec(payload[21])
+	l.Data = payload[entryHeaderSize:]
+}
+
+func (s *logSegment) lastIndex() uint64 {
+	return s.indexes[len(s.indexes)-1]
+}
+
+// find returns the position of the first log at or after index.
+func (s *logSegment) find(index uint64) int {
+	return sort.Search(len(s.indexes), func(i int) bool {
+		return s.indexes[i] >= index
+	})
+}
+
+// FirstIndex implements the LogStore interface.
+func (f *FileLogStore) FirstIndex() (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	if len(f.segments) == 0 {
+		return 0, nil
+	}
+	return f.segments[0].indexes[0], nil
+}
+
+// LastIndex implements the LogStore interface.
+func (f *FileLogStore) LastIndex() (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.lastIndex(), nil
+}
+
+func (f *FileLogStore) lastIndex() uint64 {
+	if len(f.segments) == 0 {
+		return 0
+	}
+	return f.segments[len(f.segments)-1].lastIndex()
+}
+
+// GetLog implements the LogStore interface.
+func (f *FileLogStore) GetLog(index uint64, log *Log) error {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	if f.closed {
+		return ErrLogStoreClosed
+	}
+
+	// Find the segment and the record offset
+	n := sort.Search(len(f.segments), func(i int) bool {
+		return f.segments[i].lastIndex() >= index
+	})
+	if n == len(f.segments) {
+		return ErrLogNotFound
+	}
+	seg := f.segments[n]
+	i := seg.find(index)
+	if i == len(seg.indexes) || seg.indexes[i] != index {
+		return ErrLogNotFound
+	}
+	end := seg.size
+	if i+1 < len(seg.offsets) {
+		end = seg.offsets[i+1]
+	}
+
+	// Read and verify the record
+	buf := make([]byte, end-seg.offsets[i])
+	if _, err := seg.fh.ReadAt(buf, seg.offsets[i]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(buf[0:4])
+	if int(length) != len(buf)-recordHeaderSize {
+		return fmt.Errorf("log store: bad record length at index %d", index)
+	}
+	payload := buf[recordHeaderSize:]
+	if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(buf[4:8]) {
+		return fmt.Errorf("log store: CRC mismatch at index %d", index)
+	}
+	decodeEntry(payload, log)
+	return nil
+}
+
+// StoreLog implements the LogStore interface.
+func (f *FileLogStore) StoreLog(log *Log) error {
+	return f.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. The logs are written in
+// a single write per segment and synced once for the whole batch. Storing
+// a log at or below the last index replaces that log and all after it.
+func (f *FileLogStore) StoreLogs(logs []*Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.closed {
+		return ErrLogStoreClosed
+	}
+
+	// Check the batch before writing anything
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Index <= logs[i-1].Index {
+			return fmt.Errorf("log store: non-increasing log index %d after %d", logs[i].Index, logs[i-1].Index)
+		}
+	}
+
+	// Overwrite any conflicting suffix
+	first := logs[0].Index
+	if len(f.segments) > 0 && first <= f.lastIndex() {
+		if err := f.truncateSuffix(first); err != nil {
+			return err
+		}
+	}
+
+	// Lower the first index so recovery does not skip the new logs
+	if len(f.segments) == 0 && first != f.lowIndex {
+		if err := f.setLowIndex(first); err != nil {
+			return err
+		}
+	}
+
+	var seg *logSegment
+	var buf []byte
+	var indexes []uint64
+	var offsets []int64
+	for _, l := range logs {
+		// Start a new segment when needed
+		if seg == nil {
+			var err error
+			if seg, err = f.activeSegment(l.Index); err != nil {
+				return err
+			}
+		}
+
+		offsets = append(offsets, seg.size+int64(len(buf)))
+		indexes = append(indexes, l.Index)
+		buf = appendRecord(buf, l)
+
+		// Roll over once the segment is full
+		if seg.size+int64(len(buf)) >= f.conf.SegmentSize {
+			if err := f.writeSegment(seg, buf, indexes, offsets); err != nil {
+				return err
+			}
+			if err := f.syncSegment(seg); err != nil {
+				return err
+			}
+			seg, buf, indexes, offsets = nil, buf[:0], nil, nil
+		}
+	}
+	if seg != nil {
+		if err := f.writeSegment(seg, buf, indexes, offsets); err != nil {
+			return err
+		}
+	}
+
+	// Sync according to the policy
+	switch f.conf.SyncPolicy {
+	case LogSyncBatch:
+		return f.syncSegment(f.segments[len(f.segments)-1])
+	case LogSyncInterval:
+		f.dirty = true
+	}
+	return nil
+}
+
+// activeSegment returns the segment to append to, creating a new one
+// starting at index if there is none or the last one is full.
+func (f *FileLogStore) activeSegment(index uint64) (*logSegment, error) {
+	if n := len(f.segments); n > 0 && f.segments[n-1].size < f.conf.SegmentSize {
+		return f.segments[n-1], nil
+	}
+	path := filepath.Join(f.path, segmentName(index))
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if f.conf.SyncPolicy != LogSyncNever {
+		if err := fsyncDir(f.path); err != nil {
+			fh.Close()
+			return nil, err
+		}
+	}
+	return &logSegment{path: path, fh: fh}, nil
+}
+
+// writeSegment writes encoded records to the end of a segment and
+// updates the index once the write succeeded.
+func (f *FileLogStore) writeSegment(seg *logSegment, buf []byte, indexes []uint64, offsets []int64) error {
+	if _, err := seg.fh.WriteAt(buf, seg.size); err != nil {
+		return err
+	}
+	if len(seg.indexes) == 0 {
+		f.segments = append(f.segments, seg)
+	}
+	seg.size += int64(len(buf))
+	seg.indexes = append(seg.indexes, indexes...)
+	seg.offsets = append(seg.offsets, offsets...)
+	return nil
+}
+
+// syncSegment fsyncs a segment unless syncing is disabled
+func (f *FileLogStore) syncSegment(seg *logSegment) error {
+	if f.conf.SyncPolicy == LogSyncNever {
+		return nil
+	}
+	return seg.fh.Sync()
+}
+
+// DeleteRange implements the LogStore interface. Only a prefix or a
+// suffix of the log can be deleted, which is all Raft ever needs.
+func (f *FileLogStore) DeleteRange(min, max uint64) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.closed {
+		return ErrLogStoreClosed
+	}
+	if len(f.segments) == 0 || min > max {
+		return nil
+	}
+
+	first, last := f.segments[0].indexes[0], f.lastIndex()
+	switch {
+	case max < first || min > last:
+		return nil
+	case min <= first:
+		return f.deletePrefix(max)
+	case max >= last:
+		return f.truncateSuffix(min)
+	default:
+		return fmt.Errorf("log store: can only delete a prefix or suffix, not [%d, %d]", min, max)
+	}
+}
+
+// deletePrefix deletes all the logs up to and including max
+func (f *FileLogStore) deletePrefix(max uint64) error {
+	// Persist the new first index before removing any files, so a
+	// crash never brings deleted logs back.
+	if err := f.setLowIndex(max + 1); err != nil {
+		return err
+	}
+
+	n := 0
+	for _, seg := range f.segments {
+		if seg.lastIndex() > max {
+			break
+		}
+		seg.fh.Close()
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		n++
+	}
+	f.segments = f.segments[n:]
+
+	// Trim the index of a partially deleted segment
+	if len(f.segments) > 0 {
+		seg := f.segments[0]
+		i := seg.find(max + 1)
+		seg.indexes = seg.indexes[i:]
+		seg.offsets = seg.offsets[i:]
+	}
+	return nil
+}
+
+// truncateSuffix deletes all the logs from min onwards
+func (f *FileLogStore) truncateSuffix(min uint64) error {
+	// Remove whole segments from the end first, so a crash leaves a
+	// prefix of the log behind.
+	for len(f.segments) > 0 {
+		seg := f.segments[len(f.segments)-1]
+		if seg.indexes[0] < min {
+			break
+		}
+		seg.fh.Close()
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		f.segments = f.segments[:len(f.segments)-1]
+	}
+
+	// Cut the tail off the last remaining segment
+	if len(f.segments) > 0 {
+		seg := f.segments[len(f.segments)-1]
+		if i := seg.find(min); i < len(seg.indexes) {
+			if err := seg.fh.Truncate(seg.offsets[i]); err != nil {
+				return err
+			}
+			if err := f.syncSegment(seg); err != nil {
+				return err
+			}
+			seg.size = seg.offsets[i]
+			seg.indexes = seg.indexes[:i]
+			seg.offsets = seg.offsets[:i]
+		}
+	}
+	if f.conf.SyncPolicy == LogSyncNever {
+		return nil
+	}
+	return fsyncDir(f.path)
+}
+
+// setLowIndex atomically persists the first index of the log
+func (f *FileLogStore) setLowIndex(index uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	if err := writeFileAtomic(filepath.Join(f.path, firstIndexFilePath), buf[:]); err != nil {
+		return err
+	}
+	f.lowIndex = index
+	return nil
+}
+
+// Sync fsyncs any logs that have not been synced yet. This is only
+// needed with the LogSyncInterval or LogSyncNever policies.
+func (f *FileLogStore) Sync() error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.closed {
+		return ErrLogStoreClosed
+	}
+	return f.sync()
+}
+
+func (f *FileLogStore) sync() error {
+	f.dirty = false
+	if len(f.segments) == 0 {
+		return nil
+	}
+	return f.segments[len(f.segments)-1].fh.Sync()
+}
+
+// runSync is a long running routine that syncs the log periodically
+func (f *FileLogStore) runSync() {
+	defer close(f.syncDoneCh)
+	ticker := time.NewTicker(f.conf.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.l.Lock()
+			if f.dirty && !f.closed {
+				if err := f.sync(); err != nil {
+					f.logger.Printf("[ERR] log store: Failed to sync: %v", err)
+				}
+			}
+			f.l.Unlock()
+
+		case <-f.shutdownCh:
+			return
+		}
+	}
+}
+
+// Close syncs any pending writes and closes the segment files.
+func (f *FileLogStore) Close() error {
+	f.l.Lock()
+	if f.closed {
+		f.l.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.shutdownCh)
+	err := f.sync()
+	f.closeSegments()
+	f.l.Unlock()
+
+	if f.syncDoneCh != nil {
+		<-f.syncDoneCh
+	}
+	return err
+}
+
+func (f *FileLogStore) closeSegments() {
+	for _, seg := range f.segments {
+		seg.fh.Close()
+	}
+}
+
+// writeFileAtomic writes a file by writing a temporary file, syncing it
+// and renaming it into place, then syncing the directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + tmpSuffix
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fsyncDir(filepath.Dir(path))
+}
+
+// fsyncDir fsyncs a directory so that created, renamed and removed
+// entries survive a crash.
+func fsyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,345 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func FileLogTest(t *testing.T, conf *FileLogStoreConfig) (string, *FileLogStore) {
+	// Create a test dir
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+
+	store, err := NewFileLogStore(dir, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return dir, store
+}
+
+// fileLogTestConf uses small segments so tests span several files
+func fileLogTestConf() *FileLogStoreConfig {
+	conf := DefaultFileLogStoreConfig()
+	conf.SegmentSize = 256
+	return conf
+}
+
+func fileLogTestLogs(first, last uint64) []*Log {
+	var logs []*Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, &Log{
+			Index: i,
+			Term:  i / 10,
+			Type:  LogCommand,
+			Data:  []byte(fmt.Sprintf("data %d", i)),
+		})
+		logs[len(logs)-1].setCRC()
+	}
+	return logs
+}
+
+// checkFileLogs verifies the store holds exactly first through last
+func checkFileLogs(t *testing.T, store *FileLogStore, first, last uint64) {
+	if idx, _ := store.FirstIndex(); idx != first {
+		t.Fatalf("bad first: %d", idx)
+	}
+	if idx, _ := store.LastIndex(); idx != last {
+		t.Fatalf("bad last: %d", idx)
+	}
+	if first == 0 {
+		return
+	}
+	for i := first; i <= last; i++ {
+		var out Log
+		if err := store.GetLog(i, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out.Index != i || out.Term != i/10 || !bytes.Equal(out.Data, []byte(fmt.Sprintf("data %d", i))) || out.verifyCRC() != nil {
+			t.Fatalf("bad: %#v", out)
+		}
+	}
+	var out Log
+	if err := store.GetLog(first-1, &out); err != ErrLogNotFound {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.GetLog(last+1, &out); err != ErrLogNotFound {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestFileLogStoreImpl(t *testing.T) {
+	var impl interface{} = &FileLogStore{}
+	if _, ok := impl.(LogStore); !ok {
+		t.Fatalf("FileLogStore not a LogStore")
+	}
+}
+
+func TestFileLogStore_StoreGet(t *testing.T) {
+	dir, store := FileLogTest(t, fileLogTestConf())
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	// Should be empty
+	checkFileLogs(t, store, 0, 0)
+
+	// Store a single log, then a batch
+	logs := fileLogTestLogs(1, 50)
+	if err := store.StoreLog(logs[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.StoreLogs(logs[1:]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 1, 50)
+
+	// Should have rolled over to several segments
+	if len(store.segments) < 3 {
+		t.Fatalf("bad: %d", len(store.segments))
+	}
+
+	// Should not allow going backwards in a batch
+	bad := append(fileLogTestLogs(51, 52), fileLogTestLogs(51, 51)...)
+	if err := store.StoreLogs(bad); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Should recover everything
+	store.Close()
+	store, err := NewFileLogStore(dir, fileLogTestConf())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	checkFileLogs(t, store, 1, 50)
+}
+
+func TestFileLogStore_DeleteRange(t *testing.T) {
+	dir, store := FileLogTest(t, fileLogTestConf())
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	if err := store.StoreLogs(fileLogTestLogs(1, 100)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Compact a prefix, and truncate a suffix
+	if err := store.DeleteRange(1, 33); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.DeleteRange(81, 100); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 34, 80)
+
+	// Deleting the middle is not supported
+	if err := store.DeleteRange(40, 50); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Overwriting the tail replaces the conflicting logs
+	if err := store.StoreLogs(fileLogTestLogs(75, 90)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 34, 90)
+
+	// The deletes should be durable
+	store.Close()
+	store, err := NewFileLogStore(dir, fileLogTestConf())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 34, 90)
+
+	// Delete everything, and start over at a lower index
+	if err := store.DeleteRange(34, 90); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 0, 0)
+	if err := store.StoreLogs(fileLogTestLogs(20, 25)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.Close()
+	store, err = NewFileLogStore(dir, fileLogTestConf())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	checkFileLogs(t, store, 20, 25)
+}
+
+func TestFileLogStore_SyncPolicy(t *testing.T) {
+	for _, policy := range []LogSyncPolicy{LogSyncInterval, LogSyncNever} {
+		conf := fileLogTestConf()
+		conf.SyncPolicy = policy
+		dir, store := FileLogTest(t, conf)
+		defer os.RemoveAll(dir)
+
+		if err := store.StoreLogs(fileLogTestLogs(1, 20)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.Sync(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := store.StoreLogs(fileLogTestLogs(21, 21)); err != ErrLogStoreClosed {
+			t.Fatalf("err: %v", err)
+		}
+
+		store, err := NewFileLogStore(dir, conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		checkFileLogs(t, store, 1, 20)
+		store.Close()
+	}
+
+	// Should validate the interval
+	conf := fileLogTestConf()
+	conf.SyncPolicy = LogSyncInterval
+	conf.SyncInterval = 0
+	if _, err := NewFileLogStore(os.TempDir(), conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFileLogStore_CrashRecovery(t *testing.T) {
+	// Write a reference log, and record where every record ends
+	dir, store := FileLogTest(t, fileLogTestConf())
+	defer os.RemoveAll(dir)
+	if err := store.StoreLogs(fileLogTestLogs(1, 30)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	last := store.segments[len(store.segments)-1]
+	lastPath, first := last.path, last.indexes[0]
+	ends := append(append([]int64{}, last.offsets[1:]...), last.size)
+	store.Close()
+
+	orig, err := ioutil.ReadFile(lastPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Inject a crash at every possible offset of the last segment, with
+	// both a torn tail and garbage after it
+	for cut := 0; cut < len(orig); cut++ {
+		for _, tail := range [][]byte{nil, []byte("garbage!garbage!")} {
+			torn := append(append([]byte{}, orig[:cut]...), tail...)
+			if err := ioutil.WriteFile(lastPath, torn, 0644); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Expect every complete record to survive
+			expect := first - 1
+			for i, end := range ends {
+				if end <= int64(cut) {
+					expect = first + uint64(i)
+				}
+			}
+			store, err := NewFileLogStore(dir, fileLogTestConf())
+			if err != nil {
+				t.Fatalf("cut %d: err: %v", cut, err)
+			}
+			checkFileLogs(t, store, 1, expect)
+
+			// The log should be writable again
+			if err := store.StoreLogs(fileLogTestLogs(expect+1, expect+1)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			store.Close()
+
+			store, err = NewFileLogStore(dir, fileLogTestConf())
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			checkFileLogs(t, store, 1, expect+1)
+			store.Close()
+
+			// Restore the segments for the next round
+			if err := store.resetForTest(lastPath, orig); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+}
+
+func TestFileLogStore_CorruptRecord(t *testing.T) {
+	dir, store := FileLogTest(t, fileLogTestConf())
+	defer os.RemoveAll(dir)
+	if err := store.StoreLogs(fileLogTestLogs(1, 32)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first := store.segments[0]
+	last := store.segments[len(store.segments)-1]
+	if first == last || len(last.offsets) < 2 {
+		t.Fatalf("bad: %d segments", len(store.segments))
+	}
+	store.Close()
+
+	// Flip a bit in the middle of the first segment, and in a record
+	// before the end of the last one. Neither is a torn write, so the
+	// store should refuse to open rather than drop committed logs.
+	for _, at := range []struct {
+		path   string
+		offset int64
+	}{
+		{first.path, first.offsets[2] + recordHeaderSize + 3},
+		{last.path, last.offsets[0] + recordHeaderSize + 3},
+	} {
+		orig, err := ioutil.ReadFile(at.path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		corrupt := append([]byte{}, orig...)
+		corrupt[at.offset] ^= 0x1
+		if err := ioutil.WriteFile(at.path, corrupt, 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		if _, err := NewFileLogStore(dir, fileLogTestConf()); err == nil {
+			t.Fatalf("expected error for corrupt %v", at.path)
+		}
+
+		// The segment should be left alone
+		after, err := ioutil.ReadFile(at.path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(after, corrupt) {
+			t.Fatalf("corrupt segment was modified")
+		}
+		if err := ioutil.WriteFile(at.path, orig, 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// All the logs are there once repaired
+	store, err := NewFileLogStore(dir, fileLogTestConf())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer store.Close()
+	checkFileLogs(t, store, 1, 32)
+}
+
+// resetForTest restores a segment file and removes any segment that
+// was created after it.
+func (f *FileLogStore) resetForTest(path string, contents []byte) error {
+	matches, err := filepath.Glob(filepath.Join(f.path, "*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if match > path {
+			os.Remove(match)
+		}
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
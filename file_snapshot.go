@@ -13,7 +13,9 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,9 +30,47 @@ const (
 // FileSnapshotStore implements the SnapshotStore interface and allows
 // snapshots to be made on the local disk.
 type FileSnapshotStore struct {
-	path   string
-	retain int
-	logger *log.Logger
+	path      string
+	retention SnapshotRetentionPolicy
+	onReap    func(reaped []*SnapshotMeta)
+	noSync    bool
+	logger    *log.Logger
+
+	// crashPoint is invoked after each step of finishing a snapshot. It
+	// is only set by tests, which fail a step to simulate a crash.
+	crashPoint func(step string) error
+
+	// syncHook is invoked with the path of every file and directory that
+	// was synced. It is only set by tests, which use it to work out what
+	// a power loss would leave behind.
+	syncHook func(path string)
+
+	// metaLock serializes updates to the meta data of finished snapshots
+	metaLock sync.Mutex
+}
+
+// FileSnapshotStoreConfig is used to configure a FileSnapshotStore.
+type FileSnapshotStoreConfig struct {
+	// Retain is how many snapshots are retained when no Retention
+	// policy is given.
+	Retain int
+
+	// Retention decides which snapshots are kept. The newest snapshot
+	// and pinned snapshots are always kept.
+	Retention SnapshotRetentionPolicy
+
+	// OnReap is invoked with the snapshots removed by each reap, if
+	// there were any.
+	OnReap func(reaped []*SnapshotMeta)
+
+	// NoSync skips fsyncing finished snapshots and their directories.
+	// A snapshot may then be lost or corrupt after a power failure,
+	// although the logs it replaced are already compacted, so this is
+	// only meant for tests. Config.NoSnapshotSync sets it too.
+	NoSync bool
+
+	// LogOutput is used as the sink for logs. Defaults to os.Stderr.
+	LogOutput io.Writer
 }
 
 type snapMetaSlice []*fileSnapshotMeta
@@ -50,10 +90,19 @@ type FileSnapshotSink struct {
 }
 
 // fileSnapshotMeta is stored on disk. We also put a CRC
-// on disk so that we can verify the snapshot
+// on disk so that we can verify the snapshot. KeyID names
+// the key the state was encrypted with, if any, and pinned
+// snapshots are never reaped. A delta snapshot names the
+// snapshot it is based on, and how many deltas lead up to
+// it from the last full snapshot.
 type fileSnapshotMeta struct {
 	SnapshotMeta
-	CRC []byte
+	CRC     []byte
+	KeyID   string `json:",omitempty"`
+	Created time.Time
+	Pinned  bool   `json:",omitempty"`
+	Base    string `json:",omitempty"`
+	Deltas  int    `json:",omitempty"`
 }
 
 // bufferedFile is returned when we open a snapshot. This way
@@ -71,13 +120,45 @@ func (b *bufferedFile) Close() error {
 	return b.fh.Close()
 }
 
+// chainFile is returned when we open a delta snapshot. It reads
+// the chain stream and closes the files of every part.
+type chainFile struct {
+	io.Reader
+	files []*os.File
+}
+
+func (c *chainFile) Close() error {
+	var err error
+	for _, fh := range c.files {
+		if closeErr := fh.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // NewFileSnapshotStore creates a new FileSnapshotStore based
 // on a base directory. The `retain` parameter controls how many
 // snapshots are retained. Must be at least 1.
 func NewFileSnapshotStore(base string, retain int, logOutput io.Writer) (*FileSnapshotStore, error) {
-	if retain < 1 {
-		return nil, fmt.Errorf("must retain at least one snapshot")
+	conf := &FileSnapshotStoreConfig{
+		Retain:    retain,
+		LogOutput: logOutput,
+	}
+	return NewFileSnapshotStoreWithConfig(base, conf)
+}
+
+// NewFileSnapshotStoreWithConfig creates a new FileSnapshotStore based
+// on a base directory, with a configurable retention policy.
+func NewFileSnapshotStoreWithConfig(base string, conf *FileSnapshotStoreConfig) (*FileSnapshotStore, error) {
+	retention := conf.Retention
+	if retention == nil {
+		if conf.Retain < 1 {
+			return nil, fmt.Errorf("must retain at least one snapshot")
+		}
+		retention = RetainCount(conf.Retain)
 	}
+	logOutput := conf.LogOutput
 	if logOutput == nil {
 		logOutput = os.Stderr
 	}
@@ -90,9 +171,11 @@ func NewFileSnapshotStore(base string, retain int, logOutput io.Writer) (*FileSn
 
 	// Setup the store
 	store := &FileSnapshotStore{
-		path:   path,
-		retain: retain,
-		logger: log.New(logOutput, "", log.LstdFlags),
+		path:      path,
+		retention: retention,
+		onReap:    conf.OnReap,
+		noSync:    conf.NoSync,
+		logger:    log.New(logOutput, "", log.LstdFlags),
 	}
 
 	// Do a permissions test
@@ -123,6 +206,31 @@ func snapshotName(term, index uint64) string {
 
 // Create is used to start a new snapshot
 func (f *FileSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSink, error) {
+	return f.create(index, term, peers, nil)
+}
+
+// CreateDelta is used to start a new delta snapshot, holding the
+// changes since the base snapshot.
+func (f *FileSnapshotStore) CreateDelta(base string, index, term uint64, peers []byte) (SnapshotSink, error) {
+	baseMeta, err := f.readMeta(base)
+	if err != nil {
+		f.logger.Printf("[ERR] snapshot: Failed to read base snapshot %v: %v", base, err)
+		return nil, err
+	}
+	return f.create(index, term, peers, baseMeta)
+}
+
+// ChainLength returns how many deltas lead up to a snapshot.
+func (f *FileSnapshotStore) ChainLength(id string) (int, error) {
+	meta, err := f.readMeta(id)
+	if err != nil {
+		return 0, err
+	}
+	return meta.Deltas, nil
+}
+
+// create starts a new snapshot, which is a delta if a base is given
+func (f *FileSnapshotStore) create(index, term uint64, peers []byte, base *fileSnapshotMeta) (SnapshotSink, error) {
 	// Create a new path
 	name := snapshotName(term, index)
 	path := filepath.Join(f.path, name+tmpSuffix)
@@ -146,12 +254,17 @@ func (f *FileSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSi
 				Term:  term,
 				Peers: peers,
 			},
-			CRC: nil,
+			CRC:     nil,
+			Created: time.Now(),
 		},
 	}
+	if base != nil {
+		sink.meta.Base = base.ID
+		sink.meta.Deltas = base.Deltas + 1
+	}
 
 	// Write out the meta data
-	if err := sink.writeMeta(); err != nil {
+	if err := sink.writeMeta(false); err != nil {
 		f.logger.Printf("[ERR] snapshot: Failed to write metadata: %v", err)
 		return nil, err
 	}
@@ -185,16 +298,61 @@ func (f *FileSnapshotStore) List() ([]*SnapshotMeta, error) {
 		return nil, err
 	}
 
+	// Only return the snapshots which are retained
+	keep := f.retained(snapshots)
 	var snapMeta []*SnapshotMeta
-	for _, meta := range snapshots {
-		snapMeta = append(snapMeta, &meta.SnapshotMeta)
-		if len(snapMeta) == f.retain {
-			break
+	for i, meta := range snapshots {
+		if keep[i] {
+			snapMeta = append(snapMeta, &meta.SnapshotMeta)
 		}
 	}
 	return snapMeta, nil
 }
 
+// retained applies the retention policy to the snapshots, which must be
+// sorted new -> old, and returns which ones to keep.
+func (f *FileSnapshotStore) retained(snapshots []*fileSnapshotMeta) []bool {
+	infos := make([]*SnapshotRetentionInfo, len(snapshots))
+	for i, meta := range snapshots {
+		infos[i] = &SnapshotRetentionInfo{
+			SnapshotMeta: meta.SnapshotMeta,
+			Created:      meta.created(),
+		}
+	}
+	keep := f.retention.Retain(time.Now(), infos)
+	if len(keep) != len(snapshots) {
+		f.logger.Printf("[ERR] snapshot: Retention policy returned %d results for %d snapshots, keeping all",
+			len(keep), len(snapshots))
+		keep = make([]bool, len(snapshots))
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+
+	// Always keep the newest and the pinned snapshots
+	for i, meta := range snapshots {
+		if i == 0 || meta.Pinned {
+			keep[i] = true
+		}
+	}
+
+	// Keep the snapshots that kept deltas are based on. Bases are always
+	// older, so they come later in the list.
+	byID := make(map[string]int, len(snapshots))
+	for i, meta := range snapshots {
+		byID[meta.ID] = i
+	}
+	for i, meta := range snapshots {
+		if !keep[i] || meta.Base == "" {
+			continue
+		}
+		if base, ok := byID[meta.Base]; ok {
+			keep[base] = true
+		}
+	}
+	return keep
+}
+
 // getSnapshots returns all the known snapshots
 func (f *FileSnapshotStore) getSnapshots() ([]*fileSnapshotMeta, error) {
 	// Get the eligible snapshots
@@ -255,10 +413,18 @@ func (f *FileSnapshotStore) readMeta(name string) (*fileSnapshotMeta, error) {
 	if err := dec.Decode(meta); err != nil {
 		return nil, err
 	}
+
+	// A key ID means the state is encrypted, even if the sink
+	// never had a header set
+	if meta.KeyID != "" {
+		meta.Header.Flags |= SnapshotEncrypted
+	}
 	return meta, nil
 }
 
 // Open takes a snapshot ID and returns a ReadCloser for that snapshot.
+// A delta snapshot returns its whole chain, starting with the full
+// snapshot it is based on.
 func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
 	// Get the metadata
 	meta, err := f.readMeta(id)
@@ -266,13 +432,32 @@ func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error
 		f.logger.Printf("[ERR] snapshot: Failed to get meta data to open snapshot: %v", err)
 		return nil, nil, err
 	}
+	if meta.Base != "" {
+		return f.openChain(meta)
+	}
+
+	fh, err := f.openState(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Return a buffered file
+	buffered := &bufferedFile{
+		bh: bufio.NewReader(fh),
+		fh: fh,
+	}
+
+	return &meta.SnapshotMeta, buffered, nil
+}
 
+// openState opens the state file of a snapshot, after verifying its CRC
+func (f *FileSnapshotStore) openState(meta *fileSnapshotMeta) (*os.File, error) {
 	// Open the state file
-	statePath := filepath.Join(f.path, id, stateFilePath)
+	statePath := filepath.Join(f.path, meta.ID, stateFilePath)
 	fh, err := os.Open(statePath)
 	if err != nil {
 		f.logger.Printf("[ERR] snapshot: Failed to open state file: %v", err)
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Create a CRC64 hash
@@ -283,7 +468,7 @@ func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error
 	if err != nil {
 		f.logger.Printf("[ERR] snapshot: Failed to read state file: %v", err)
 		fh.Close()
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Verify the hash
@@ -292,40 +477,168 @@ func (f *FileSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error
 		f.logger.Printf("[ERR] snapshot: CRC checksum failed (stored: %v computed: %v)",
 			meta.CRC, computed)
 		fh.Close()
-		return nil, nil, fmt.Errorf("CRC mismatch")
+		return nil, fmt.Errorf("CRC mismatch")
 	}
 
 	// Seek to the start
 	if _, err := fh.Seek(0, 0); err != nil {
 		f.logger.Printf("[ERR] snapshot: State file seek failed: %v", err)
 		fh.Close()
-		return nil, nil, err
+		return nil, err
 	}
+	return fh, nil
+}
 
-	// Return a buffered file
-	buffered := &bufferedFile{
-		bh: bufio.NewReader(fh),
-		fh: fh,
+// openChain opens every snapshot from the full base up to a delta, and
+// returns them as a single chain stream
+func (f *FileSnapshotStore) openChain(meta *fileSnapshotMeta) (*SnapshotMeta, io.ReadCloser, error) {
+	// Walk back to the full snapshot
+	chain := []*fileSnapshotMeta{meta}
+	for chain[0].Base != "" {
+		if len(chain) > meta.Deltas {
+			return nil, nil, fmt.Errorf("snapshot chain of %v is longer than expected", meta.ID)
+		}
+		base, err := f.readMeta(chain[0].Base)
+		if err != nil {
+			f.logger.Printf("[ERR] snapshot: Failed to get meta data of base snapshot %v: %v", chain[0].Base, err)
+			return nil, nil, err
+		}
+		chain = append([]*fileSnapshotMeta{base}, chain...)
 	}
 
-	return &meta.SnapshotMeta, buffered, nil
+	// Open every part
+	chainFile := &chainFile{}
+	var parts []io.Reader
+	var sizes []int64
+	for _, part := range chain {
+		fh, err := f.openState(part)
+		if err != nil {
+			chainFile.Close()
+			return nil, nil, err
+		}
+		chainFile.files = append(chainFile.files, fh)
+		parts = append(parts, bufio.NewReader(fh))
+		sizes = append(sizes, part.Size)
+	}
+	chainFile.Reader = newSnapshotChainReader(parts, sizes)
+
+	chainMeta := meta.SnapshotMeta
+	chainMeta.Size = snapshotChainSize(sizes)
+	return &chainMeta, chainFile, nil
 }
 
-// ReapSnapshots reaps any snapshots beyond the retain count.
+// setNoSync stops fsyncing finished snapshots. It must be called before
+// any snapshot is created.
+func (f *FileSnapshotStore) setNoSync() {
+	f.noSync = true
+}
+
+// ReapSnapshots reaps any snapshots not kept by the retention policy.
 func (f *FileSnapshotStore) ReapSnapshots() error {
+	_, err := f.Reap()
+	return err
+}
+
+// Reap reaps any snapshots not kept by the retention policy, and
+// returns the snapshots which were removed.
+func (f *FileSnapshotStore) Reap() ([]*SnapshotMeta, error) {
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+
 	snapshots, err := f.getSnapshots()
 	if err != nil {
 		f.logger.Printf("[ERR] snapshot: Failed to get snapshots: %v", err)
-		return err
+		return nil, err
 	}
 
-	for i := f.retain; i < len(snapshots); i++ {
+	var reaped []*SnapshotMeta
+	for i, keep := range f.retained(snapshots) {
+		if keep {
+			continue
+		}
 		path := filepath.Join(f.path, snapshots[i].ID)
 		f.logger.Printf("[INFO] snapshot: reaping snapshot %v", path)
-		if err := os.RemoveAll(path); err != nil {
+		if err = os.RemoveAll(path); err != nil {
 			f.logger.Printf("[ERR] snapshot: Failed to reap snapshot %v: %v", path, err)
-			return err
+			break
 		}
+		reaped = append(reaped, &snapshots[i].SnapshotMeta)
+	}
+	if len(reaped) > 0 && f.onReap != nil {
+		f.onReap(reaped)
+	}
+	return reaped, err
+}
+
+// Pin protects a snapshot from being reaped, whatever the retention
+// policy. The pin is stored with the snapshot.
+func (f *FileSnapshotStore) Pin(id string) error {
+	return f.setPinned(id, true)
+}
+
+// Unpin allows a snapshot to be reaped again. It is reaped by the next
+// snapshot if the retention policy does not keep it.
+func (f *FileSnapshotStore) Unpin(id string) error {
+	return f.setPinned(id, false)
+}
+
+// setPinned rewrites the meta data of a finished snapshot
+func (f *FileSnapshotStore) setPinned(id string, pinned bool) error {
+	f.metaLock.Lock()
+	defer f.metaLock.Unlock()
+
+	meta, err := f.readMeta(id)
+	if err != nil {
+		return err
+	}
+	meta.Pinned = pinned
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.path, id, metaFilePath), buf)
+}
+
+// created returns when the snapshot was started. Snapshots written
+// before this was recorded fall back to the time in their name.
+func (m *fileSnapshotMeta) created() time.Time {
+	if !m.Created.IsZero() {
+		return m.Created
+	}
+	parts := strings.Split(m.ID, "-")
+	msec, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, msec*int64(time.Millisecond))
+}
+
+// crash invokes the crash point of tests, if any
+func (f *FileSnapshotStore) crash(step string) error {
+	if f.crashPoint == nil {
+		return nil
+	}
+	return f.crashPoint(step)
+}
+
+// syncFile syncs a file to disk
+func (f *FileSnapshotStore) syncFile(fh *os.File) error {
+	if err := fh.Sync(); err != nil {
+		return err
+	}
+	if f.syncHook != nil {
+		f.syncHook(fh.Name())
+	}
+	return nil
+}
+
+// syncDir syncs the entries of a directory to disk
+func (f *FileSnapshotStore) syncDir(path string) error {
+	if err := fsyncDir(path); err != nil {
+		return err
+	}
+	if f.syncHook != nil {
+		f.syncHook(path)
 	}
 	return nil
 }
@@ -336,6 +649,22 @@ func (s *FileSnapshotSink) ID() string {
 	return s.meta.ID
 }
 
+// setKeyID records the ID of the key used to encrypt the state. It is
+// persisted in the metadata when the sink is closed.
+func (s *FileSnapshotSink) setKeyID(id string) {
+	s.meta.KeyID = id
+}
+
+// SetHeader records the header in the meta data.
+func (s *FileSnapshotSink) SetHeader(header SnapshotHeader) {
+	s.meta.Header = header
+}
+
+// SetLabel records a label in the meta data.
+func (s *FileSnapshotSink) SetLabel(key, value string) {
+	setSnapshotLabel(&s.meta.SnapshotMeta, key, value)
+}
+
 // Write is used to append to the state file. We write to the
 // buffered IO object to reduce the amount of context switches
 func (s *FileSnapshotSink) Write(b []byte) (int, error) {
@@ -351,16 +680,35 @@ func (s *FileSnapshotSink) Close() error {
 	s.closed = true
 
 	// Close the open handles
-	if err := s.finalize(); err != nil {
+	sync := !s.store.noSync
+	if err := s.finalize(sync); err != nil {
 		s.logger.Printf("[ERR] snapshot: Failed to finalize snapshot: %v", err)
 		return err
 	}
+	if err := s.store.crash("state"); err != nil {
+		return err
+	}
 
 	// Write out the meta data
-	if err := s.writeMeta(); err != nil {
+	if err := s.writeMeta(sync); err != nil {
 		s.logger.Printf("[ERR] snapshot: Failed to write metadata: %v", err)
 		return err
 	}
+	if err := s.store.crash("meta"); err != nil {
+		return err
+	}
+
+	// The snapshot must be complete on disk before it is moved into
+	// place, as the logs it replaces are compacted right after
+	if sync {
+		if err := s.store.syncDir(s.dir); err != nil {
+			s.logger.Printf("[ERR] snapshot: Failed to sync snapshot directory: %v", err)
+			return err
+		}
+	}
+	if err := s.store.crash("dir"); err != nil {
+		return err
+	}
 
 	// Move the directory into place
 	newPath := strings.TrimSuffix(s.dir, tmpSuffix)
@@ -368,6 +716,18 @@ func (s *FileSnapshotSink) Close() error {
 		s.logger.Printf("[ERR] snapshot: Failed to move snapshot into place: %v", err)
 		return err
 	}
+	if err := s.store.crash("rename"); err != nil {
+		return err
+	}
+	if sync {
+		if err := s.store.syncDir(s.store.path); err != nil {
+			s.logger.Printf("[ERR] snapshot: Failed to sync snapshot path: %v", err)
+			return err
+		}
+	}
+	if err := s.store.crash("parent"); err != nil {
+		return err
+	}
 
 	// Reap any old snapshots
 	s.store.ReapSnapshots()
@@ -383,7 +743,7 @@ func (s *FileSnapshotSink) Cancel() error {
 	s.closed = true
 
 	// Close the open handles
-	if err := s.finalize(); err != nil {
+	if err := s.finalize(false); err != nil {
 		s.logger.Printf("[ERR] snapshot: Failed to finalize snapshot: %v", err)
 		return err
 	}
@@ -392,12 +752,20 @@ func (s *FileSnapshotSink) Cancel() error {
 	return os.RemoveAll(s.dir)
 }
 
-// finalize is used to close all of our resources
-func (s *FileSnapshotSink) finalize() error {
+// finalize is used to close all of our resources, syncing the state
+// file to disk first if asked to
+func (s *FileSnapshotSink) finalize(sync bool) error {
 	// Flush any remaining data
 	if err := s.buffered.Flush(); err != nil {
+		s.stateFile.Close()
 		return err
 	}
+	if sync {
+		if err := s.store.syncFile(s.stateFile); err != nil {
+			s.stateFile.Close()
+			return err
+		}
+	}
 
 	// Get the file size
 	stat, statErr := s.stateFile.Stat()
@@ -418,26 +786,36 @@ func (s *FileSnapshotSink) finalize() error {
 	return nil
 }
 
-// writeMeta is used to write out the metadata we have
-func (s *FileSnapshotSink) writeMeta() error {
+// writeMeta is used to write out the metadata we have, syncing it to
+// disk if asked to
+func (s *FileSnapshotSink) writeMeta(sync bool) error {
 	// Open the meta file
 	metaPath := filepath.Join(s.dir, metaFilePath)
 	fh, err := os.Create(metaPath)
 	if err != nil {
 		return err
 	}
-	defer fh.Close()
 
 	// Buffer the file IO
 	buffered := bufio.NewWriter(fh)
-	defer buffered.Flush()
 
 	// Write out as JSON
 	enc := json.NewEncoder(buffered)
 	if err := enc.Encode(&s.meta); err != nil {
+		fh.Close()
 		return err
 	}
-	return nil
+	if err := buffered.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if sync {
+		if err := s.store.syncFile(fh); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	return fh.Close()
 }
 
 // Implement the sort interface for []*fileSnapshotMeta
@@ -2,10 +2,14 @@ package raft
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func FileSnapTest(t *testing.T) (string, *FileSnapshotStore) {
@@ -36,6 +40,12 @@ func TestFileSnapshotSinkImpl(t *testing.T) {
 	}
 }
 
+func TestFileSS_Conformance(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+	testSnapshotStore(t, snap, 3)
+}
+
 func TestFileSS_CreateSnapshotMissingParentDir(t *testing.T) {
 	parent, err := ioutil.TempDir("", "raft")
 	if err != nil {
@@ -320,3 +330,328 @@ func TestFileSS_Ordering(t *testing.T) {
 		t.Fatalf("bad snap: %#v", *snaps[1])
 	}
 }
+
+func TestFileSS_RetentionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Requires a retain count or a policy
+	if _, err := NewFileSnapshotStoreWithConfig(dir, &FileSnapshotStoreConfig{}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Keep up to 20 bytes, which is two snapshots
+	var reports [][]*SnapshotMeta
+	snap, err := NewFileSnapshotStoreWithConfig(dir, &FileSnapshotStoreConfig{
+		Retention: RetainBytes(20),
+		OnReap: func(reaped []*SnapshotMeta) {
+			reports = append(reports, reaped)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	create := func(index uint64, data string) string {
+		sink, err := snap.Create(index, 3, nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink.Write([]byte(data))
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return sink.ID()
+	}
+	first := create(10, "0123456789")
+	create(11, "0123456789")
+	if len(reports) != 0 {
+		t.Fatalf("bad: %v", reports)
+	}
+
+	// Pin the oldest, which should survive the budget
+	if err := snap.Pin(first); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	create(12, "0123456789")
+	if snaps, _ := snap.List(); len(snaps) != 3 || len(reports) != 0 {
+		t.Fatalf("bad: %v %v", snaps, reports)
+	}
+
+	// The newest is always kept, even over budget
+	create(13, "this is far too much data")
+	if len(reports) != 1 || len(reports[0]) != 2 ||
+		reports[0][0].Index != 12 || reports[0][1].Index != 11 {
+		t.Fatalf("bad: %v", reports)
+	}
+	snaps, _ := snap.List()
+	if len(snaps) != 2 || snaps[0].Index != 13 || snaps[1].Index != 10 {
+		t.Fatalf("bad: %v", snaps)
+	}
+
+	// Once unpinned it can be reaped
+	if err := snap.Unpin(first); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reaped, err := snap.Reap()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].ID != first {
+		t.Fatalf("bad: %v", reaped)
+	}
+	if err := snap.Pin(first); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestFileSS_CreatedFromName(t *testing.T) {
+	meta := &fileSnapshotMeta{SnapshotMeta: SnapshotMeta{ID: "3-10-1462883400000"}}
+	if created := meta.created(); !created.Equal(time.Unix(1462883400, 0)) {
+		t.Fatalf("bad: %v", created)
+	}
+}
+
+func TestFileSS_DeltaChain(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	var impl interface{} = snap
+	if _, ok := impl.(DeltaSnapshotStore); !ok {
+		t.Fatalf("FileSnapshotStore not a DeltaSnapshotStore")
+	}
+
+	// Base a chain of deltas on a full snapshot
+	create := func(base string, index uint64, data string) string {
+		var sink SnapshotSink
+		var err error
+		if base == "" {
+			sink, err = snap.Create(index, 3, nil)
+		} else {
+			sink, err = snap.CreateDelta(base, index, 3, nil)
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink.Write([]byte(data))
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return sink.ID()
+	}
+	full := create("", 10, "full")
+	delta1 := create(full, 20, "delta 1")
+	delta2 := create(delta1, 30, "delta 2")
+	if _, err := snap.CreateDelta("nope", 40, 3, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if n, _ := snap.ChainLength(delta2); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Opening the newest returns the whole chain
+	meta, r, err := snap.Open(delta2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stream, _ := ioutil.ReadAll(r)
+	r.Close()
+	if meta.Index != 30 || meta.Size != int64(len(stream)) {
+		t.Fatalf("bad: %v", meta)
+	}
+	if !bytes.Equal(stream, chainTestStream("full", "delta 1", "delta 2")) {
+		t.Fatalf("bad: %q", stream)
+	}
+
+	// Another full snapshot, the retain count of 3 would reap the base
+	// of the chain, but it's kept while the chain is
+	create("", 40, "full 2")
+	if snaps, _ := snap.List(); len(snaps) != 4 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	create("", 50, "full 3")
+	create("", 60, "full 4")
+	snaps, _ := snap.List()
+	if len(snaps) != 3 || snaps[2].Index != 40 {
+		t.Fatalf("bad: %v", snaps)
+	}
+
+	// A corrupt part fails the whole chain
+	full = create("", 70, "full 5")
+	delta1 = create(full, 80, "delta")
+	statePath := filepath.Join(dir, snapPath, full, stateFilePath)
+	if err := ioutil.WriteFile(statePath, []byte("corrupt"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := snap.Open(delta1); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// errSimulatedCrash is returned by the crash point of a FileSnapshotStore
+// to stop finishing a snapshot part way.
+var errSimulatedCrash = errors.New("simulated crash")
+
+// crashFileSnapshot writes a snapshot, and crashes after the given step
+// of finishing it. It then simulates a power loss, which is adversarial:
+// anything that was not synced is lost. Files lose their data unless
+// they were synced, and their entries unless their directory was, and
+// the move into place is undone unless the parent was synced after it.
+func crashFileSnapshot(t *testing.T, dir string, conf *FileSnapshotStoreConfig, step string, data string) string {
+	snap, err := NewFileSnapshotStoreWithConfig(dir, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	synced := make(map[string]bool)
+	snap.syncHook = func(path string) {
+		synced[path] = true
+	}
+	snap.crashPoint = func(s string) error {
+		if s == step {
+			return errSimulatedCrash
+		}
+		return nil
+	}
+
+	sink, err := snap.Create(100, 3, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.Write([]byte(data))
+	if err := sink.Close(); err != errSimulatedCrash {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The parent is only synced after the move into place
+	parent := filepath.Join(dir, snapPath)
+	tmpDir := filepath.Join(parent, sink.ID()+tmpSuffix)
+	snapDir := filepath.Join(parent, sink.ID())
+	if _, err := os.Stat(snapDir); err == nil && !synced[parent] {
+		if err := os.Rename(snapDir, tmpDir); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	current := snapDir
+	if _, err := os.Stat(snapDir); err != nil {
+		current = tmpDir
+	}
+
+	// The files were synced before the move, under the temporary name
+	for _, name := range []string{stateFilePath, metaFilePath} {
+		path := filepath.Join(current, name)
+		if !synced[tmpDir] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				t.Fatalf("err: %v", err)
+			}
+		} else if !synced[filepath.Join(tmpDir, name)] {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+	return sink.ID()
+}
+
+// checkFileSnapshots reopens a store after a crash, and checks every
+// listed snapshot holds the expected data
+func checkFileSnapshots(t *testing.T, dir string, conf *FileSnapshotStoreConfig, expect map[string]string) ([]*SnapshotMeta, error) {
+	snap, err := NewFileSnapshotStoreWithConfig(dir, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snaps, err := snap.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, meta := range snaps {
+		_, r, err := snap.Open(meta.ID)
+		if err != nil {
+			return snaps, err
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return snaps, err
+		}
+		if string(data) != expect[meta.ID] {
+			return snaps, fmt.Errorf("bad data in %v: %q", meta.ID, data)
+		}
+	}
+	return snaps, nil
+}
+
+func TestFileSS_CrashDurability(t *testing.T) {
+	conf := &FileSnapshotStoreConfig{Retain: 3, LogOutput: ioutil.Discard}
+	for _, step := range []string{"state", "meta", "dir", "rename", "parent"} {
+		dir, err := ioutil.TempDir("", "raft")
+		if err != nil {
+			t.Fatalf("err: %v ", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Take a snapshot, then crash while finishing the next
+		snap, err := NewFileSnapshotStoreWithConfig(dir, conf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		sink, _ := snap.Create(10, 3, nil)
+		sink.Write([]byte("first"))
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expect := map[string]string{sink.ID(): "first"}
+		id := crashFileSnapshot(t, dir, conf, step, "second")
+		expect[id] = "second"
+
+		// The new snapshot is only there once it was moved into place,
+		// and every snapshot that is there is intact
+		snaps, err := checkFileSnapshots(t, dir, conf, expect)
+		if err != nil {
+			t.Fatalf("step %s: err: %v", step, err)
+		}
+		visible := step == "parent"
+		if visible && (len(snaps) != 2 || snaps[0].ID != id) || !visible && len(snaps) != 1 {
+			t.Fatalf("step %s: bad: %v", step, snaps)
+		}
+	}
+
+	// Without syncing, a power loss loses a snapshot even once it was
+	// moved into place
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+	conf.NoSync = true
+	id := crashFileSnapshot(t, dir, conf, "parent", "lost")
+	snaps, err := checkFileSnapshots(t, dir, conf, map[string]string{id: "lost"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snaps) != 0 {
+		t.Fatalf("bad: %v", snaps)
+	}
+}
+
+func TestRaft_NoSnapshotSync(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+	keys, _ := NewKeyRing("k1", testKey(1))
+	e, _ := NewEncryptingSnapshotStore(snap, keys)
+
+	// The config reaches the file store, through the encrypting store
+	conf := inmemConfig()
+	conf.NoSnapshotSync = true
+	store := NewInmemStore()
+	_, trans := NewInmemTransport()
+	raft, err := NewRaft(conf, &MockFSM{}, store, store, e, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	if !snap.noSync {
+		t.Fatalf("should not sync")
+	}
+}
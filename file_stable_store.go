@@ -0,0 +1,128 @@
+package raft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	stableFilePath = "stable.bin"
+)
+
+// FileStableStore implements the StableStore and BatchStableStore
+// interfaces using a single file on the local disk. Every change
+// rewrites the file to a temporary path, fsyncs it, renames it into
+// place and fsyncs the directory, so updates are atomic and durable.
+// It is meant for the small amount of state Raft keeps in the store.
+type FileStableStore struct {
+	path string
+
+	l  sync.RWMutex
+	kv map[string][]byte
+}
+
+// NewFileStableStore creates a FileStableStore in the base directory,
+// loading any existing state.
+func NewFileStableStore(base string) (*FileStableStore, error) {
+	// Ensure our path exists
+	if err := os.MkdirAll(base, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("stable path not accessible: %v", err)
+	}
+	path := filepath.Join(base, stableFilePath)
+
+	// Clean up after an interrupted write
+	if err := os.Remove(path + tmpSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	store := &FileStableStore{
+		path: path,
+		kv:   make(map[string][]byte),
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Verify and decode the contents
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("stable store file is truncated")
+	}
+	payload := buf[:len(buf)-4]
+	if crc32.Checksum(payload, castagnoliTable) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, fmt.Errorf("stable store file CRC mismatch")
+	}
+	if err := decodeMsgPack(payload, &store.kv); err != nil {
+		return nil, fmt.Errorf("failed to decode stable store file: %v", err)
+	}
+	return store, nil
+}
+
+// Set implements the StableStore interface.
+func (f *FileStableStore) Set(key []byte, val []byte) error {
+	return f.BatchSet(map[string][]byte{string(key): val})
+}
+
+// Get implements the StableStore interface.
+func (f *FileStableStore) Get(key []byte) ([]byte, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.kv[string(key)], nil
+}
+
+// SetUint64 implements the StableStore interface.
+func (f *FileStableStore) SetUint64(key []byte, val uint64) error {
+	return f.Set(key, uint64ToBytes(val))
+}
+
+// GetUint64 implements the StableStore interface.
+func (f *FileStableStore) GetUint64(key []byte) (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	val, ok := f.kv[string(key)]
+	if !ok {
+		return 0, nil
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("value for %q is not a uint64", key)
+	}
+	return bytesToUint64(val), nil
+}
+
+// BatchSet implements the BatchStableStore interface.
+func (f *FileStableStore) BatchSet(kvs map[string][]byte) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	// Build the new state without touching the current one
+	kv := make(map[string][]byte, len(f.kv)+len(kvs))
+	for k, v := range f.kv {
+		kv[k] = v
+	}
+	for k, v := range kvs {
+		kv[k] = append([]byte{}, v...)
+	}
+
+	// Encode with a trailing CRC
+	buf, err := encodeMsgPack(kv)
+	if err != nil {
+		return err
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(buf.Bytes(), castagnoliTable))
+	buf.Write(crc[:])
+
+	// Only switch over once the state is durable
+	if err := writeFileAtomic(f.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f.kv = kv
+	return nil
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStableStoreImpl(t *testing.T) {
+	var impl interface{} = &FileStableStore{}
+	if _, ok := impl.(BatchStableStore); !ok {
+		t.Fatalf("FileStableStore not a BatchStableStore")
+	}
+}
+
+func TestFileStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStableStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Missing keys should be empty
+	if val, err := store.Get([]byte("foo")); err != nil || len(val) != 0 {
+		t.Fatalf("bad: %v %v", val, err)
+	}
+	if val, err := store.GetUint64([]byte("bar")); err != nil || val != 0 {
+		t.Fatalf("bad: %v %v", val, err)
+	}
+
+	// Set some values
+	if err := store.Set([]byte("foo"), []byte("baz")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SetUint64([]byte("bar"), 42); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.BatchSet(map[string][]byte{
+		"term": uint64ToBytes(7),
+		"cand": []byte("node"),
+	}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should survive a reopen, ignoring an interrupted write
+	path := filepath.Join(dir, stableFilePath)
+	if err := ioutil.WriteFile(path+tmpSuffix, []byte("partial"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store, err = NewFileStableStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if val, _ := store.Get([]byte("foo")); !bytes.Equal(val, []byte("baz")) {
+		t.Fatalf("bad: %v", val)
+	}
+	if val, _ := store.GetUint64([]byte("bar")); val != 42 {
+		t.Fatalf("bad: %v", val)
+	}
+	if val, _ := store.GetUint64([]byte("term")); val != 7 {
+		t.Fatalf("bad: %v", val)
+	}
+	if val, _ := store.Get([]byte("cand")); !bytes.Equal(val, []byte("node")) {
+		t.Fatalf("bad: %v", val)
+	}
+	if _, err := os.Stat(path + tmpSuffix); !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A non-uint64 value should not decode
+	if _, err := store.GetUint64([]byte("foo")); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Corruption should be detected
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf[0] ^= 0x1
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileStableStore(dir); err == nil {
+		t.Fatalf("expected error")
+	}
+}
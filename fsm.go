@@ -35,3 +35,64 @@ type FSMSnapshot interface {
 	// Release is invoked when we are finished with the snapshot
 	Release()
 }
+
+// IncrementalFSM is an optional interface for FSMs whose snapshots can
+// implement IncrementalFSMSnapshot. A delta snapshot is restored by
+// passing its full base snapshot to Restore, and then each delta in the
+// chain, oldest first, to RestoreDelta.
+type IncrementalFSM interface {
+	FSM
+
+	// RestoreDelta is used to apply the changes of a delta snapshot on
+	// top of the state restored so far. It is not called concurrently
+	// with any other command.
+	RestoreDelta(io.Reader) error
+}
+
+// IncrementalFSMSnapshot is an optional interface for FSMSnapshots that
+// can persist only the changes made since an earlier snapshot. It is
+// only used if the FSM implements IncrementalFSM and the SnapshotStore
+// implements DeltaSnapshotStore.
+type IncrementalFSMSnapshot interface {
+	FSMSnapshot
+
+	// PersistDelta should dump the changes made since the state of the
+	// base snapshot to the sink, and call sink.Close() when finished or
+	// call sink.Cancel() on error. The base is the newest snapshot, which
+	// the FSM last persisted or was restored from. If the FSM can not
+	// tell what changed since then, for example because it did not track
+	// changes since a restart, it should cancel the sink and return
+	// ErrSnapshotDeltaUnavailable, and a full snapshot is taken instead.
+	PersistDelta(base *SnapshotMeta, sink SnapshotSink) error
+}
+
+// SnapshotRequestingFSM is an optional interface for FSMs which know
+// best when a snapshot is due, for example right after a bulk import.
+type SnapshotRequestingFSM interface {
+	FSM
+
+	// SetSnapshotRequestFunc is called by NewRaft, before the FSM is
+	// used, with a function that asks for a snapshot to be taken soon. The
+	// reason is logged. The function never blocks, so it may be called
+	// from Apply, and requests made while one is pending are merged.
+	SetSnapshotRequestFunc(request func(reason string))
+}
+
+// VersionedFSM is an optional interface for FSMs which version the
+// schema of their snapshots. The version is recorded in the header of
+// every snapshot, and checked before a snapshot is restored, so that an
+// incompatible snapshot is refused with a clear error instead of failing
+// inside Restore.
+type VersionedFSM interface {
+	FSM
+
+	// SnapshotSchemaVersion returns the schema version of the snapshots
+	// the FSM takes. It may be called concurrently with Apply.
+	SnapshotSchemaVersion() int
+
+	// CheckSnapshotSchema returns an error if the FSM can't restore a
+	// snapshot with the given schema version. Snapshots taken before the
+	// version was recorded, or by an FSM that does not declare one, have
+	// version zero.
+	CheckSnapshotSchema(version int) error
+}
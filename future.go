@@ -1,6 +1,8 @@
 package raft
 
 import (
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -17,6 +19,18 @@ type ApplyFuture interface {
 	Response() interface{}
 }
 
+// SnapshotFuture is used for waiting on a user-triggered snapshot to
+// complete.
+type SnapshotFuture interface {
+	Future
+
+	// Open is a function you can call to access the underlying snapshot
+	// and its metadata. This must not be called until after the Error
+	// method has returned. The snapshot may be reaped by the store after
+	// later snapshots, so it should be opened promptly.
+	Open() (*SnapshotMeta, io.ReadCloser, error)
+}
+
 // errorFuture is used to return a static error
 type errorFuture struct {
 	err error
@@ -84,6 +98,13 @@ type peerFuture struct {
 	peers []net.Addr
 }
 
+// reloadConfigFuture is used to deliver a configuration change
+// to the main thread.
+type reloadConfigFuture struct {
+	deferError
+	config ReloadableConfig
+}
+
 type shutdownFuture struct {
 	raft *Raft
 }
@@ -95,9 +116,24 @@ func (s *shutdownFuture) Error() error {
 	return nil
 }
 
-// snapshotFuture is used for waiting on a snapshot to complete
+// snapshotFuture is used for waiting on a user-triggered snapshot to
+// complete.
 type snapshotFuture struct {
 	deferError
+
+	// opener is a function used to open the snapshot. This is filled in
+	// once the future returns with no error.
+	opener func() (*SnapshotMeta, io.ReadCloser, error)
+}
+
+// Open is a function you can call to access the underlying snapshot and
+// its metadata. This must not be called until after the Error method has
+// returned.
+func (s *snapshotFuture) Open() (*SnapshotMeta, io.ReadCloser, error) {
+	if s.opener == nil {
+		return nil, nil, fmt.Errorf("no snapshot available")
+	}
+	return s.opener()
 }
 
 // reqSnapshotFuture is used for requesting a snapshot start.
@@ -119,6 +155,18 @@ type restoreFuture struct {
 	ID string
 }
 
+// userRestoreFuture is used for waiting on a user-triggered restore of
+// an external snapshot to complete.
+type userRestoreFuture struct {
+	deferError
+
+	// meta is the metadata that belongs with the snapshot
+	meta *SnapshotMeta
+
+	// reader is the interface to read the snapshot contents from
+	reader io.Reader
+}
+
 // verifyFuture is used to verify the current node is still
 // the leader. This is to prevent a stale read.
 type verifyFuture struct {
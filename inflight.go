@@ -131,6 +131,29 @@ func (i *inflight) Cancel(err error) {
 	i.maxCommit = 0
 }
 
+// Reset is used to cancel all in-flight operations while staying in
+// use. This is done when a restored snapshot replaces the log, and all
+// futures are sent the given error.
+func (i *inflight) Reset(err error) {
+	i.Lock()
+	defer i.Unlock()
+
+	// Respond to all inflight operations
+	for _, op := range i.operations {
+		op.respond(err)
+	}
+
+	// Clear all the committed but not processed
+	for e := i.committed.Front(); e != nil; e = e.Next() {
+		e.Value.(*logFuture).respond(err)
+	}
+
+	i.operations = make(map[uint64]*logFuture)
+	i.committed = list.New()
+	i.minCommit = 0
+	i.maxCommit = 0
+}
+
 // Committed returns all the committed operations in order
 func (i *inflight) Committed() (l *list.List) {
 	i.Lock()
@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// InmemSnapshotStore implements the SnapshotStore interface and
+// retains the latest snapshots in memory. It is used for unit tests
+// and for ephemeral nodes which do not need their snapshots to survive
+// a restart.
+type InmemSnapshotStore struct {
+	retain int
+
+	l         sync.RWMutex
+	seq       uint64
+	snapshots []*InmemSnapshotSink
+}
+
+// InmemSnapshotSink implements SnapshotSink in memory.
+type InmemSnapshotSink struct {
+	store    *InmemSnapshotStore
+	meta     SnapshotMeta
+	seq      uint64
+	contents *bytes.Buffer
+	closed   bool
+}
+
+// NewInmemSnapshotStore creates a new InmemSnapshotStore. The `retain`
+// parameter controls how many snapshots are retained. Must be at least 1.
+func NewInmemSnapshotStore(retain int) (*InmemSnapshotStore, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("must retain at least one snapshot")
+	}
+	return &InmemSnapshotStore{retain: retain}, nil
+}
+
+// Create is used to start a new snapshot
+func (m *InmemSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSink, error) {
+	m.l.Lock()
+	m.seq++
+	seq := m.seq
+	m.l.Unlock()
+
+	sink := &InmemSnapshotSink{
+		store: m,
+		meta: SnapshotMeta{
+			ID:    fmt.Sprintf("%s-%d", snapshotName(term, index), seq),
+			Index: index,
+			Term:  term,
+			Peers: peers,
+		},
+		seq:      seq,
+		contents: &bytes.Buffer{},
+	}
+	return sink, nil
+}
+
+// List returns available snapshots in the store, newest first.
+func (m *InmemSnapshotStore) List() ([]*SnapshotMeta, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	var snapMeta []*SnapshotMeta
+	for _, snap := range m.snapshots {
+		meta := snap.meta
+		snapMeta = append(snapMeta, &meta)
+	}
+	return snapMeta, nil
+}
+
+// Open takes a snapshot ID and returns a ReadCloser for that snapshot.
+func (m *InmemSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	for _, snap := range m.snapshots {
+		if snap.meta.ID == id {
+			meta := snap.meta
+			contents := bytes.NewReader(snap.contents.Bytes())
+			return &meta, ioutil.NopCloser(contents), nil
+		}
+	}
+	return nil, nil, fmt.Errorf("snapshot %v not found", id)
+}
+
+// add makes a finished snapshot visible, and drops the snapshots beyond
+// the retain count.
+func (m *InmemSnapshotStore) add(sink *InmemSnapshotSink) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.snapshots = append(m.snapshots, sink)
+	sort.Sort(sort.Reverse(inmemSnapshotSlice(m.snapshots)))
+	if len(m.snapshots) > m.retain {
+		for i := m.retain; i < len(m.snapshots); i++ {
+			m.snapshots[i] = nil
+		}
+		m.snapshots = m.snapshots[:m.retain]
+	}
+}
+
+// ID returns the ID of the snapshot, can be used with Open()
+// after the snapshot is finalized.
+func (s *InmemSnapshotSink) ID() string {
+	return s.meta.ID
+}
+
+// SetHeader records the header in the meta data.
+func (s *InmemSnapshotSink) SetHeader(header SnapshotHeader) {
+	s.meta.Header = header
+}
+
+// SetLabel records a label in the meta data.
+func (s *InmemSnapshotSink) SetLabel(key, value string) {
+	setSnapshotLabel(&s.meta, key, value)
+}
+
+// Write is used to append to the snapshot.
+func (s *InmemSnapshotSink) Write(b []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("snapshot sink is closed")
+	}
+	return s.contents.Write(b)
+}
+
+// Close is used to indicate a successful end
+func (s *InmemSnapshotSink) Close() error {
+	// Make sure close is idempotent
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.meta.Size = int64(s.contents.Len())
+	s.store.add(s)
+	return nil
+}
+
+// Cancel is used to indicate an unsuccessful end
+func (s *InmemSnapshotSink) Cancel() error {
+	s.closed = true
+	return nil
+}
+
+// inmemSnapshotSlice sorts snapshots by term, index and creation order
+type inmemSnapshotSlice []*InmemSnapshotSink
+
+func (s inmemSnapshotSlice) Len() int {
+	return len(s)
+}
+
+func (s inmemSnapshotSlice) Less(i, j int) bool {
+	if s[i].meta.Term != s[j].meta.Term {
+		return s[i].meta.Term < s[j].meta.Term
+	}
+	if s[i].meta.Index != s[j].meta.Index {
+		return s[i].meta.Index < s[j].meta.Index
+	}
+	return s[i].seq < s[j].seq
+}
+
+func (s inmemSnapshotSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
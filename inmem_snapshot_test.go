@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"testing"
+)
+
+func TestInmemSnapshotStoreImpl(t *testing.T) {
+	var impl interface{} = &InmemSnapshotStore{}
+	if _, ok := impl.(SnapshotStore); !ok {
+		t.Fatalf("InmemSnapshotStore not a SnapshotStore")
+	}
+}
+
+func TestInmemSnapshotSinkImpl(t *testing.T) {
+	var impl interface{} = &InmemSnapshotSink{}
+	if _, ok := impl.(SnapshotSink); !ok {
+		t.Fatalf("InmemSnapshotSink not a SnapshotSink")
+	}
+}
+
+func TestInmemSS_Conformance(t *testing.T) {
+	store, err := NewInmemSnapshotStore(3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testSnapshotStore(t, store, 3)
+}
+
+func TestInmemSS_Retain(t *testing.T) {
+	if _, err := NewInmemSnapshotStore(0); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestInmemSS_SameIndex(t *testing.T) {
+	store, _ := NewInmemSnapshotStore(2)
+
+	// Snapshots at the same index must get unique IDs, newest first
+	var ids []string
+	for i := 0; i < 3; i++ {
+		sink, _ := store.Create(10, 3, nil)
+		sink.Write([]byte{byte(i)})
+		sink.Close()
+		ids = append(ids, sink.ID())
+	}
+	snaps, _ := store.List()
+	if len(snaps) != 2 || snaps[0].ID != ids[2] || snaps[1].ID != ids[1] {
+		t.Fatalf("bad: %v %v", snaps, ids)
+	}
+}
+
+func TestDiscardSnapshotStore(t *testing.T) {
+	var impl interface{} = &DiscardSnapshotStore{}
+	if _, ok := impl.(SnapshotStore); !ok {
+		t.Fatalf("DiscardSnapshotStore not a SnapshotStore")
+	}
+
+	store := NewDiscardSnapshotStore()
+	sink, err := store.Create(10, 3, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n, err := sink.Write([]byte("data")); n != 4 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snaps, _ := store.List(); len(snaps) != 0 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	if _, _, err := store.Open(sink.ID()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -74,7 +74,8 @@ func (i *InmemStore) StoreLogs(logs []*Log) error {
 	return nil
 }
 
-// DeleteRange implements the LogStore interface.
+// DeleteRange implements the LogStore interface. Once every log is
+// deleted the store reports no indexes, as a new store does.
 func (i *InmemStore) DeleteRange(min, max uint64) error {
 	i.l.Lock()
 	defer i.l.Unlock()
@@ -82,6 +83,9 @@ func (i *InmemStore) DeleteRange(min, max uint64) error {
 		delete(i.logs, j)
 	}
 	i.lowIndex = max + 1
+	if len(i.logs) == 0 {
+		i.lowIndex, i.highIndex = 0, 0
+	}
 	return nil
 }
 
@@ -0,0 +1,47 @@
+package raft
+
+import (
+	"testing"
+)
+
+func TestInmemStore_DeleteRange(t *testing.T) {
+	store := NewInmemStore()
+	var logs []*Log
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &Log{Index: uint64(i), Term: 1})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Deleting a prefix moves the first index
+	if err := store.DeleteRange(1, 5); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if first != 6 || last != 10 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+
+	// Deleting the rest leaves no indexes, so a last index is never
+	// reported for a log that is gone
+	if err := store.DeleteRange(6, 10); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, _ = store.FirstIndex()
+	last, _ = store.LastIndex()
+	if first != 0 || last != 0 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+
+	// Logs can be stored again after a gap
+	if err := store.StoreLog(&Log{Index: 20, Term: 2}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	first, _ = store.FirstIndex()
+	last, _ = store.LastIndex()
+	if first != 20 || last != 20 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+}
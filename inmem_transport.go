@@ -142,6 +142,32 @@ func (i *InmemTransport) InstallSnapshot(target net.Addr, args *InstallSnapshotR
 	return nil
 }
 
+// FetchSnapshot implements the Transport interface.
+func (i *InmemTransport) FetchSnapshot(target net.Addr, args *FetchSnapshotRequest, resp *FetchSnapshotResponse) (io.ReadCloser, error) {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*FetchSnapshotResponse)
+	*resp = *out
+	return rpcResp.Reader, nil
+}
+
+// TimeoutNow implements the Transport interface.
+func (i *InmemTransport) TimeoutNow(target net.Addr, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	rpcResp, err := i.makeRPC(target, args, nil, i.timeout)
+	if err != nil {
+		return err
+	}
+
+	// Copy the result back
+	out := rpcResp.Response.(*TimeoutNowResponse)
+	*resp = *out
+	return nil
+}
+
 func (i *InmemTransport) makeRPC(target net.Addr, args interface{}, r io.Reader, timeout time.Duration) (rpcResp RPCResponse, err error) {
 	i.RLock()
 	peer, ok := i.peers[target.String()]
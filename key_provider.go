@@ -0,0 +1,140 @@
+package raft
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys used to encrypt data at rest. Each
+// key has an ID which is recorded next to the data it encrypted, so data
+// stays readable after the current key is rotated.
+type KeyProvider interface {
+	// CurrentKey returns the ID and key to encrypt new data with.
+	CurrentKey() (string, []byte, error)
+
+	// Key returns the key with the given ID, to decrypt existing data.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider that holds its keys in memory. Rotate adds
+// a new current key, and the previous keys remain available to decrypt
+// older data.
+type KeyRing struct {
+	l       sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns a KeyRing with a single, current key. Keys must
+// be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	k := &KeyRing{keys: make(map[string][]byte)}
+	if err := k.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate adds a key and makes it the current key.
+func (k *KeyRing) Rotate(id string, key []byte) error {
+	if id == "" {
+		return fmt.Errorf("key ID must not be empty")
+	}
+	if len(id) > 255 {
+		return fmt.Errorf("key ID is too long")
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	k.l.Lock()
+	defer k.l.Unlock()
+	if old, ok := k.keys[id]; ok && string(old) != string(key) {
+		return fmt.Errorf("key ID %q is already in use", id)
+	}
+	k.keys[id] = append([]byte{}, key...)
+	k.current = id
+	return nil
+}
+
+// CurrentKey implements the KeyProvider interface.
+func (k *KeyRing) CurrentKey() (string, []byte, error) {
+	k.l.RLock()
+	defer k.l.RUnlock()
+	return k.current, k.keys[k.current], nil
+}
+
+// Key implements the KeyProvider interface.
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.l.RLock()
+	defer k.l.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+	return key, nil
+}
+
+// aeadCache caches the AES-GCM instance for each key ID, to avoid
+// expanding the key on every operation.
+type aeadCache struct {
+	keys KeyProvider
+
+	l     sync.Mutex
+	cache map[string]cipher.AEAD
+}
+
+func newAEADCache(keys KeyProvider) *aeadCache {
+	return &aeadCache{
+		keys:  keys,
+		cache: make(map[string]cipher.AEAD),
+	}
+}
+
+// current returns the ID and AES-GCM instance for the current key
+func (a *aeadCache) current() (string, cipher.AEAD, error) {
+	id, key, err := a.keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(id) == 0 || len(id) > 255 {
+		return "", nil, fmt.Errorf("invalid key ID %q", id)
+	}
+	aead, err := a.get(id, key)
+	return id, aead, err
+}
+
+// byID returns the AES-GCM instance for a key ID
+func (a *aeadCache) byID(id string) (cipher.AEAD, error) {
+	a.l.Lock()
+	aead, ok := a.cache[id]
+	a.l.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := a.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.get(id, key)
+}
+
+func (a *aeadCache) get(id string, key []byte) (cipher.AEAD, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if aead, ok := a.cache[id]; ok {
+		return aead, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	a.cache[id] = aead
+	return aead, nil
+}
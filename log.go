@@ -1,6 +1,18 @@
 package raft
 
-import "net"
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+var (
+	// ErrLogCorrupt is returned when a log entry fails its CRC check.
+	ErrLogCorrupt = errors.New("log entry failed CRC check")
+
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+)
 
 // LogType describes various types of log entries.
 type LogType uint8
@@ -26,6 +38,21 @@ const (
 	LogBarrier
 )
 
+// LogCodec describes how the Data of a log is encoded.
+type LogCodec uint8
+
+const (
+	// LogCodecNone means Data is stored as given.
+	LogCodecNone LogCodec = iota
+
+	// LogCodecFlate means Data is compressed with DEFLATE.
+	LogCodecFlate
+
+	// LogCodecAESGCM means Data is encrypted with AES-GCM, behind a
+	// header naming the key and the codec of the encrypted data.
+	LogCodecAESGCM
+)
+
 // Log entries are replicated to all members of the Raft cluster
 // and form the heart of the replicated state machine.
 type Log struct {
@@ -34,11 +61,45 @@ type Log struct {
 	Type  LogType
 	Data  []byte
 
+	// Codec marks how Data is encoded, so compressed and plain logs can
+	// be mixed in a store or on the wire. The FSM always sees plain data.
+	Codec LogCodec
+
+	// CRC is a checksum of the fields above, set by the leader when
+	// the log is dispatched. Zero means the log carries no checksum,
+	// such as logs written by older versions.
+	CRC uint32
+
 	// Peer is not exported since it is not transmitted, only used
 	// internally to construct the Data field.
 	peer net.Addr
 }
 
+// checksum computes the CRC of a log, covering everything but the CRC.
+func (l *Log) checksum() uint32 {
+	var hdr [17]byte
+	binary.BigEndian.PutUint64(hdr[0:8], l.Index)
+	binary.BigEndian.PutUint64(hdr[8:16], l.Term)
+	hdr[16] = uint8(l.Type)
+	crc := crc32.Update(0, castagnoliTable, hdr[:])
+	return crc32.Update(crc, castagnoliTable, l.Data)
+}
+
+// setCRC sets the CRC of a log once all other fields are final.
+func (l *Log) setCRC() {
+	l.CRC = l.checksum()
+}
+
+// verifyCRC returns ErrLogCorrupt if the log has a CRC which does
+// not match its contents. The CRC covers the plain data, so encoded
+// logs are only checked once decoded.
+func (l *Log) verifyCRC() error {
+	if l.CRC != 0 && l.Codec == LogCodecNone && l.CRC != l.checksum() {
+		return ErrLogCorrupt
+	}
+	return nil
+}
+
 // LogStore is used to provide an interface for storing
 // and retrieving logs in a durable fashion
 type LogStore interface {
@@ -60,3 +121,12 @@ type LogStore interface {
 	// Deletes a range of log entries. The range is inclusive.
 	DeleteRange(min, max uint64) error
 }
+
+// logDataBytes returns the total size of the data of the logs
+func logDataBytes(logs []*Log) uint64 {
+	var n uint64
+	for _, l := range logs {
+		n += uint64(len(l.Data))
+	}
+	return n
+}
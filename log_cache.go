@@ -3,6 +3,9 @@ package raft
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-metrics"
 )
 
 // LogCache wraps any LogStore implementation to provide an
@@ -11,21 +14,57 @@ import (
 // cache themselves, this can provide a substantial boost by
 // avoiding disk I/O on recent entries.
 type LogCache struct {
+	// hits and misses are updated atomically, and come first to
+	// keep them aligned
+	hits   uint64
+	misses uint64
+
 	store LogStore
 
-	cache []*Log
-	l     sync.RWMutex
+	cache    []*Log
+	bytes    int64
+	maxBytes int64
+	l        sync.RWMutex
+}
+
+// LogCacheStats is a point in time view of a LogCache.
+type LogCacheStats struct {
+	// Hits and Misses count GetLog calls served from the cache
+	// and forwarded to the store.
+	Hits   uint64
+	Misses uint64
+
+	// Entries and Bytes describe what is currently cached. Bytes
+	// only counts log data.
+	Entries int
+	Bytes   int64
+
+	// Capacity and MaxBytes are the configured limits.
+	Capacity int
+	MaxBytes int64
 }
 
 // NewLogCache is used to create a new LogCache with the
 // given capacity and backend store.
 func NewLogCache(capacity int, store LogStore) (*LogCache, error) {
+	return NewLogCacheWithMaxBytes(capacity, 0, store)
+}
+
+// NewLogCacheWithMaxBytes is used to create a new LogCache that holds up
+// to capacity entries and at most maxBytes of log data, evicting the
+// oldest entries first. Logs larger than maxBytes are never cached. A
+// maxBytes of zero disables the byte limit.
+func NewLogCacheWithMaxBytes(capacity int, maxBytes int64, store LogStore) (*LogCache, error) {
 	if capacity <= 0 {
 		return nil, fmt.Errorf("capacity must be positive")
 	}
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("max bytes must not be negative")
+	}
 	c := &LogCache{
-		store: store,
-		cache: make([]*Log, capacity),
+		store:    store,
+		cache:    make([]*Log, capacity),
+		maxBytes: maxBytes,
 	}
 	return c, nil
 }
@@ -38,12 +77,19 @@ func (c *LogCache) GetLog(idx uint64, log *Log) error {
 
 	// Check if entry is valid
 	if cached != nil && cached.Index == idx {
+		atomic.AddUint64(&c.hits, 1)
+		metrics.IncrCounter([]string{"raft", "logcache", "hit"}, 1)
 		*log = *cached
 		return nil
 	}
+	atomic.AddUint64(&c.misses, 1)
+	metrics.IncrCounter([]string{"raft", "logcache", "miss"}, 1)
 
-	// Forward request on cache miss
-	return c.store.GetLog(idx, log)
+	// Forward request on cache miss, and check what came off the store
+	if err := c.store.GetLog(idx, log); err != nil {
+		return err
+	}
+	return log.verifyCRC()
 }
 
 func (c *LogCache) StoreLog(log *Log) error {
@@ -54,13 +100,49 @@ func (c *LogCache) StoreLogs(logs []*Log) error {
 	// Insert the logs into the ring buffer
 	c.l.Lock()
 	for _, l := range logs {
-		c.cache[l.Index%uint64(len(c.cache))] = l
+		size := int64(len(l.Data))
+		slot := l.Index % uint64(len(c.cache))
+
+		// An entry over the byte limit isn't cached, but it still
+		// replaces whatever was in its slot, which may be stale
+		c.evict(slot)
+		if c.maxBytes > 0 && size > c.maxBytes {
+			continue
+		}
+		c.cache[slot] = l
+		c.bytes += size
+	}
+	if n := len(logs); n > 0 && c.maxBytes > 0 && c.bytes > c.maxBytes {
+		c.evictOldest(logs[n-1].Index)
 	}
 	c.l.Unlock()
 
 	return c.store.StoreLogs(logs)
 }
 
+// evict clears a slot. The lock must be held.
+func (c *LogCache) evict(slot uint64) {
+	if old := c.cache[slot]; old != nil {
+		c.bytes -= int64(len(old.Data))
+		c.cache[slot] = nil
+	}
+}
+
+// evictOldest evicts entries from the oldest up until the cache is back
+// under its byte limit. The lock must be held.
+func (c *LogCache) evictOldest(last uint64) {
+	var idx uint64
+	if n := uint64(len(c.cache)); last >= n {
+		idx = last - n + 1
+	}
+	for ; idx <= last && c.bytes > c.maxBytes; idx++ {
+		slot := idx % uint64(len(c.cache))
+		if cached := c.cache[slot]; cached != nil && cached.Index == idx {
+			c.evict(slot)
+		}
+	}
+}
+
 func (c *LogCache) FirstIndex() (uint64, error) {
 	return c.store.FirstIndex()
 }
@@ -70,10 +152,45 @@ func (c *LogCache) LastIndex() (uint64, error) {
 }
 
 func (c *LogCache) DeleteRange(min, max uint64) error {
-	// Invalidate the cache on deletes
+	// Invalidate only the cached entries in the range
 	c.l.Lock()
-	c.cache = make([]*Log, len(c.cache))
+	if min <= max && max-min < uint64(len(c.cache)) {
+		for idx := min; ; idx++ {
+			slot := idx % uint64(len(c.cache))
+			if cached := c.cache[slot]; cached != nil && cached.Index == idx {
+				c.evict(slot)
+			}
+			if idx == max {
+				break
+			}
+		}
+	} else {
+		for slot, cached := range c.cache {
+			if cached != nil && cached.Index >= min && cached.Index <= max {
+				c.evict(uint64(slot))
+			}
+		}
+	}
 	c.l.Unlock()
 
 	return c.store.DeleteRange(min, max)
 }
+
+// Stats returns the hit and miss counts along with the cache usage.
+func (c *LogCache) Stats() LogCacheStats {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	stats := LogCacheStats{
+		Hits:     atomic.LoadUint64(&c.hits),
+		Misses:   atomic.LoadUint64(&c.misses),
+		Bytes:    c.bytes,
+		Capacity: len(c.cache),
+		MaxBytes: c.maxBytes,
+	}
+	for _, cached := range c.cache {
+		if cached != nil {
+			stats.Entries++
+		}
+	}
+	return stats
+}
@@ -86,3 +86,122 @@ func TestLogCache(t *testing.T) {
 		t.Fatalf("err: %v", err)
 	}
 }
+
+func TestLogCache_CRC(t *testing.T) {
+	store := NewInmemStore()
+	c, _ := NewLogCache(16, store)
+
+	// Store a log with a CRC, then corrupt the stored copy
+	log := &Log{Index: 1, Term: 1, Data: []byte("data")}
+	log.setCRC()
+	if err := store.StoreLog(log); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var out Log
+	if err := c.GetLog(1, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	log.Data = []byte("dat4")
+	if err := c.GetLog(1, &out); err != ErrLogCorrupt {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Logs without a CRC are not checked
+	if err := store.StoreLog(&Log{Index: 2, Term: 1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.GetLog(2, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestLogCache_MaxBytes(t *testing.T) {
+	store := NewInmemStore()
+	c, err := NewLogCacheWithMaxBytes(16, 100, store)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Fill the cache with 10 logs of 20 bytes, only the newest fit
+	var logs []*Log
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, &Log{Index: uint64(i), Data: make([]byte, 20)})
+	}
+	if err := c.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stats := c.Stats()
+	if stats.Entries != 5 || stats.Bytes != 100 || stats.MaxBytes != 100 || stats.Capacity != 16 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// A huge log is not cached at all
+	if err := c.StoreLog(&Log{Index: 11, Data: make([]byte, 200)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := c.Stats(); stats.Entries != 5 || stats.Bytes != 100 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Hits and misses should be counted
+	var out Log
+	for _, idx := range []uint64{1, 10, 11} {
+		if err := c.GetLog(idx, &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Overwriting a cached log with a huge one must not leave the old
+	// entry behind
+	if err := c.StoreLog(&Log{Index: 10, Term: 2, Data: make([]byte, 200)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.GetLog(10, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Term != 2 || len(out.Data) != 200 {
+		t.Fatalf("bad: %#v", out)
+	}
+	if stats := c.Stats(); stats.Entries != 4 || stats.Bytes != 80 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestLogCache_DeleteRange(t *testing.T) {
+	store := NewInmemStore()
+	c, _ := NewLogCache(16, store)
+
+	var logs []*Log
+	for i := 1; i <= 16; i++ {
+		logs = append(logs, &Log{Index: uint64(i), Data: []byte("data")})
+	}
+	if err := c.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the deleted range should be invalidated
+	if err := c.DeleteRange(1, 4); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := c.Stats(); stats.Entries != 12 || stats.Bytes != 48 {
+		t.Fatalf("bad: %#v", stats)
+	}
+	var out Log
+	if err := c.GetLog(5, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// A range larger than the cache should clear everything in it
+	if err := c.DeleteRange(10, 100); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats := c.Stats(); stats.Entries != 5 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
@@ -0,0 +1,158 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxVerifyProblems limits how many problems are listed in a
+	// LogStoreVerifyError, so a badly damaged log gives a usable error.
+	maxVerifyProblems = 16
+)
+
+// LogStoreVerifyError is returned by VerifyLogStore when the log store
+// is inconsistent. It lists the problems that were found.
+type LogStoreVerifyError struct {
+	// Problems describes each problem, in index order
+	Problems []string
+
+	// Omitted is the number of problems beyond those listed
+	Omitted int
+}
+
+func (e *LogStoreVerifyError) Error() string {
+	msg := "log store verification failed: " + strings.Join(e.Problems, "; ")
+	if e.Omitted > 0 {
+		msg += fmt.Sprintf("; and %d more", e.Omitted)
+	}
+	return msg
+}
+
+func (e *LogStoreVerifyError) add(format string, args ...interface{}) {
+	if len(e.Problems) < maxVerifyProblems {
+		e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+	} else {
+		e.Omitted++
+	}
+}
+
+// VerifyLogStore checks that the logs are contiguous from the first to
+// the last index, that terms never go backwards, that each log passes its
+// CRC check, and that the logs agree with the newest snapshot. If sampleSize
+// is positive and the log holds more entries, only sampleSize evenly spaced
+// logs are read, which can miss gaps between them. It returns a
+// *LogStoreVerifyError listing any problems found, or another error if the
+// stores could not be read.
+func VerifyLogStore(logs LogStore, snaps SnapshotStore, sampleSize int) error {
+	first, err := logs.FirstIndex()
+	if err != nil {
+		return fmt.Errorf("failed to get first log index: %v", err)
+	}
+	last, err := logs.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to get last log index: %v", err)
+	}
+	verr := &LogStoreVerifyError{}
+	if last < first {
+		verr.add("last index %d is before first index %d", last, first)
+		return verr
+	}
+
+	// Find the newest snapshot, if any
+	var snapshot *SnapshotMeta
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	if len(snapshots) > 0 {
+		snapshot = snapshots[0]
+	}
+
+	// Nothing to scan in an empty log
+	if last == 0 {
+		return nil
+	}
+
+	// Check the log lines up with the snapshot
+	switch {
+	case snapshot == nil && first > 1:
+		verr.add("logs start at index %d but there is no snapshot", first)
+	case snapshot != nil && first > snapshot.Index+1:
+		verr.add("logs start at index %d, leaving a gap after the snapshot at index %d",
+			first, snapshot.Index)
+	}
+
+	// Pick the indexes to check
+	indexes := verifyIndexes(first, last, sampleSize)
+	if snapshot != nil && snapshot.Index >= first && snapshot.Index <= last {
+		indexes = append(indexes, snapshot.Index)
+		sort.Sort(uint64Slice(indexes))
+	}
+
+	// Scan the logs
+	var prevIndex, prevTerm uint64
+	for _, idx := range indexes {
+		if idx == prevIndex && prevIndex != 0 {
+			continue
+		}
+		var l Log
+		if err := logs.GetLog(idx, &l); err == ErrLogNotFound {
+			verr.add("missing log at index %d", idx)
+			continue
+		} else if err == ErrLogCorrupt {
+			verr.add("log at index %d fails its CRC check", idx)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get log at index %d: %v", idx, err)
+		}
+
+		if l.Index != idx {
+			verr.add("log at index %d claims index %d", idx, l.Index)
+		}
+		if err := l.verifyCRC(); err != nil {
+			verr.add("log at index %d fails its CRC check", idx)
+		}
+		if prevIndex != 0 && l.Term < prevTerm {
+			verr.add("term regression at index %d: term %d after term %d at index %d",
+				idx, l.Term, prevTerm, prevIndex)
+		}
+		if snapshot != nil {
+			if idx == snapshot.Index && l.Term != snapshot.Term {
+				verr.add("log at index %d has term %d but the snapshot has term %d",
+					idx, l.Term, snapshot.Term)
+			}
+			if idx > snapshot.Index && l.Term < snapshot.Term {
+				verr.add("log at index %d has term %d, older than the snapshot term %d",
+					idx, l.Term, snapshot.Term)
+			}
+		}
+		prevIndex, prevTerm = idx, l.Term
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// verifyIndexes returns every index from first to last, or sampleSize
+// evenly spaced indexes including both ends if the range is larger.
+func verifyIndexes(first, last uint64, sampleSize int) []uint64 {
+	n := last - first + 1
+	if sampleSize <= 0 || n <= uint64(sampleSize) {
+		indexes := make([]uint64, 0, n)
+		for idx := first; idx <= last; idx++ {
+			indexes = append(indexes, idx)
+		}
+		return indexes
+	}
+
+	indexes := make([]uint64, 0, sampleSize+1)
+	step := float64(n-1) / float64(sampleSize-1)
+	for i := 0; i < sampleSize-1; i++ {
+		indexes = append(indexes, first+uint64(float64(i)*step))
+	}
+	return append(indexes, last)
+}
@@ -0,0 +1,142 @@
+package raft
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// verifyTestStore returns a store holding logs first through last, with
+// the term going up every 10 logs
+func verifyTestStore(first, last uint64) *InmemStore {
+	store := NewInmemStore()
+	for i := first; i <= last; i++ {
+		l := &Log{Index: i, Term: i/10 + 1, Data: []byte("data")}
+		l.setCRC()
+		store.StoreLog(l)
+	}
+	return store
+}
+
+func expectVerifyProblem(t *testing.T, err error, problem string) {
+	verr, ok := err.(*LogStoreVerifyError)
+	if !ok {
+		t.Fatalf("err: %v", err)
+	}
+	for _, p := range verr.Problems {
+		if strings.Contains(p, problem) {
+			return
+		}
+	}
+	t.Fatalf("missing %q in: %v", problem, err)
+}
+
+func TestVerifyLogStore(t *testing.T) {
+	dir, snaps := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	// Empty and clean logs are fine
+	if err := VerifyLogStore(NewInmemStore(), snaps, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store := verifyTestStore(1, 100)
+	if err := VerifyLogStore(store, snaps, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Detect a gap
+	delete(store.logs, 50)
+	expectVerifyProblem(t, VerifyLogStore(store, snaps, 0), "missing log at index 50")
+
+	// Detect a term regression and a bad CRC
+	store = verifyTestStore(1, 100)
+	store.logs[60].Term = 1
+	store.logs[60].setCRC()
+	store.logs[70].Data = []byte("bad")
+	err := VerifyLogStore(store, snaps, 0)
+	expectVerifyProblem(t, err, "term regression at index 60")
+	expectVerifyProblem(t, err, "log at index 70 fails its CRC check")
+
+	// Compacted logs need a snapshot
+	store = verifyTestStore(20, 100)
+	expectVerifyProblem(t, VerifyLogStore(store, snaps, 0), "no snapshot")
+}
+
+func TestVerifyLogStore_Snapshot(t *testing.T) {
+	dir, snaps := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	sink, err := snaps.Create(50, 6, []byte("peers"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Logs overlapping the snapshot are fine
+	if err := VerifyLogStore(verifyTestStore(20, 100), snaps, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Logs starting right after it are fine
+	if err := VerifyLogStore(verifyTestStore(51, 100), snaps, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A gap after the snapshot is not
+	expectVerifyProblem(t, VerifyLogStore(verifyTestStore(60, 100), snaps, 0),
+		"leaving a gap after the snapshot")
+
+	// Nor is a term mismatch at the snapshot index
+	store := verifyTestStore(20, 100)
+	store.logs[50].Term = 5
+	store.logs[50].setCRC()
+	expectVerifyProblem(t, VerifyLogStore(store, snaps, 0),
+		"log at index 50 has term 5 but the snapshot has term 6")
+}
+
+func TestVerifyLogStore_Sample(t *testing.T) {
+	dir, snaps := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	// Sampling includes both ends
+	indexes := verifyIndexes(1, 1000, 10)
+	if len(indexes) != 10 || indexes[0] != 1 || indexes[9] != 1000 {
+		t.Fatalf("bad: %v", indexes)
+	}
+	for i := 1; i < len(indexes); i++ {
+		if indexes[i] <= indexes[i-1] {
+			t.Fatalf("bad: %v", indexes)
+		}
+	}
+
+	// A sampled scan still finds a bad last log
+	store := verifyTestStore(1, 1000)
+	store.logs[1000].Term = 1
+	store.logs[1000].setCRC()
+	expectVerifyProblem(t, VerifyLogStore(store, snaps, 10), "term regression at index 1000")
+}
+
+func TestRaft_VerifyLogStore(t *testing.T) {
+	dir, snaps := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	conf := inmemConfig()
+	conf.VerifyLogStore = true
+	store := verifyTestStore(1, 100)
+	delete(store.logs, 50)
+
+	// The node should refuse to start
+	_, trans := NewInmemTransport()
+	_, err := NewRaft(conf, &MockFSM{}, store, store, snaps, &StaticPeers{}, trans)
+	expectVerifyProblem(t, err, "missing log at index 50")
+
+	// Should be fine once the logs are repaired
+	store.logs[50] = &Log{Index: 50, Term: 6}
+	raft, err := NewRaft(conf, &MockFSM{}, store, store, snaps, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	raft.Shutdown()
+}
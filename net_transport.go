@@ -19,6 +19,8 @@ const (
 	rpcAppendEntries uint8 = iota
 	rpcRequestVote
 	rpcInstallSnapshot
+	rpcTimeoutNow
+	rpcFetchSnapshot
 
 	// DefaultTimeoutScale is the default TimeoutScale in a NetworkTransport.
 	DefaultTimeoutScale = 256 * 1024 // 256KB
@@ -39,6 +41,8 @@ var (
 	appendEntrySend []byte
 	reqVoteSend []byte
 	snapshotSend []byte
+	timeoutNowSend []byte
+	fetchSnapshotSend []byte
 )
 
 /*
@@ -55,9 +59,16 @@ by the MsgPack encoded request.
 The response is an error string followed by the response object,
 both are encoded using MsgPack.
 
+Every request and response embeds an RPCHeader carrying the protocol
+version of the sender. The framing itself is unversioned, so new fields
+must only ever be added to the MsgPack encoded objects, where older peers
+ignore them. See ProtocolVersion for the compatibility rules.
+
 InstallSnapshot is special, in that after the RPC request we stream
 the entire state. That socket is not re-used as the connection state
-is not known if there is an error.
+is not known if there is an error. FetchSnapshot is its mirror image,
+where the state is streamed after the response, and the socket is not
+re-used either.
 
 */
 type NetworkTransport struct {
@@ -320,9 +331,14 @@ func (n *NetworkTransport) InstallSnapshot(target net.Addr, args *InstallSnapsho
 	}
 	defer conn.Release()
 
-	// Set a deadline, scaled by request size
+	// Set a deadline, scaled by request size, or by the size of the
+	// snapshot the target fetches elsewhere
 	if n.timeout > 0 {
-		timeout := n.timeout * time.Duration(args.Size/int64(n.TimeoutScale))
+		size := args.Size
+		if args.Source != nil {
+			size = args.SourceSize
+		}
+		timeout := n.timeout * time.Duration(size/int64(n.TimeoutScale))
 		if timeout < n.timeout {
 			timeout = n.timeout
 		}
@@ -352,6 +368,62 @@ func (n *NetworkTransport) InstallSnapshot(target net.Addr, args *InstallSnapsho
 	return err
 }
 
+// TimeoutNow implements the Transport interface.
+func (n *NetworkTransport) TimeoutNow(target net.Addr, args *TimeoutNowRequest, resp *TimeoutNowResponse) error {
+	messagepayload := []byte("rpcTimeoutNow")
+	timeoutNowSend = n.logger.PrepareSend("Sending timeout now", messagepayload)
+	return n.genericRPC(target, rpcTimeoutNow, args, resp)
+}
+
+// FetchSnapshot implements the Transport interface.
+func (n *NetworkTransport) FetchSnapshot(target net.Addr, args *FetchSnapshotRequest, resp *FetchSnapshotResponse) (io.ReadCloser, error) {
+	// Get a conn, which is closed along with the returned reader
+	conn, err := n.getConn(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set a deadline for the response
+	if n.timeout > 0 {
+		conn.conn.SetDeadline(time.Now().Add(n.timeout))
+	}
+
+	messagepayload := []byte("rpcFetchSnapshot")
+	fetchSnapshotSend = n.logger.PrepareSend("Fetching snapshot", messagepayload)
+
+	// Send the RPC
+	if err := sendRPC(conn, rpcFetchSnapshot, args); err != nil {
+		return nil, err
+	}
+
+	// Decode the response
+	if _, err := decodeResponse(conn, resp); err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	// Set a deadline for the state, scaled by its size
+	if n.timeout > 0 {
+		timeout := n.timeout * time.Duration(resp.Size/int64(n.TimeoutScale))
+		if timeout < n.timeout {
+			timeout = n.timeout
+		}
+		conn.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return &netSnapshotReader{Reader: io.LimitReader(conn.r, resp.Size), conn: conn}, nil
+}
+
+// netSnapshotReader streams a fetched snapshot off a connection, and
+// closes the connection when done
+type netSnapshotReader struct {
+	io.Reader
+	conn *netConn
+}
+
+func (r *netSnapshotReader) Close() error {
+	return r.conn.Release()
+}
+
 // EncodePeer implements the Transport interface.
 func (n *NetworkTransport) EncodePeer(p net.Addr) []byte {
 	return []byte(p.String())
@@ -394,7 +466,7 @@ func (n *NetworkTransport) handleConn(conn net.Conn) {
 	enc := codec.NewEncoder(w, &codec.MsgpackHandle{})
 
 	for {
-		if err := n.handleCommand(r, dec, enc); err != nil {
+		if err := n.handleCommand(r, w, dec, enc); err != nil {
 			if err != io.EOF {
 				n.logger.print("[ERR] raft-net: Failed to decode incoming command: " + err.Error())
 			}
@@ -408,7 +480,7 @@ func (n *NetworkTransport) handleConn(conn net.Conn) {
 }
 
 // handleCommand is used to decode and dispatch a single command
-func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, enc *codec.Encoder) error {
+func (n *NetworkTransport) handleCommand(r *bufio.Reader, w *bufio.Writer, dec *codec.Decoder, enc *codec.Encoder) error {
 	// Get the rpc type
 	rpcType, err := r.ReadByte()
 	if err != nil {
@@ -463,6 +535,26 @@ func (n *NetworkTransport) handleCommand(r *bufio.Reader, dec *codec.Decoder, en
 		n.logger.UnpackReceive("Received snapshot", snapshotSend)
 		n.logger.DisableLogging()
 
+	case rpcTimeoutNow:
+		var req TimeoutNowRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+
+		n.logger.UnpackReceive("Received timeout now", timeoutNowSend)
+		n.logger.DisableLogging()
+
+	case rpcFetchSnapshot:
+		var req FetchSnapshotRequest
+		if err := dec.Decode(&req); err != nil {
+			return err
+		}
+		rpc.Command = &req
+
+		n.logger.UnpackReceive("Received snapshot fetch", fetchSnapshotSend)
+		n.logger.DisableLogging()
+
 	default:
 		return fmt.Errorf("unknown rpc type %d", rpcType)
 	}
@@ -491,6 +583,10 @@ RESP:
 	// Send a value into a channel using the channel <- syntax. 
 	// The <-channel syntax receives a value from the channel. 
 	case resp := <-respCh:
+		if resp.Reader != nil {
+			defer resp.Reader.Close()
+		}
+
 		// Send the error first
 		respErr := ""
 		if resp.Error != nil {
@@ -504,6 +600,13 @@ RESP:
 		if err := enc.Encode(resp.Response); err != nil {
 			return err
 		}
+
+		// Stream the state of a fetched snapshot
+		if resp.Reader != nil {
+			if _, err := io.Copy(w, resp.Reader); err != nil {
+				return err
+			}
+		}
 	case <-n.shutdownCh:
 		return ErrTransportShutdown
 	}
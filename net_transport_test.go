@@ -2,6 +2,7 @@ package raft
 
 import (
 	"bytes"
+	"io/ioutil"
 	"reflect"
 	"sync"
 	"testing"
@@ -82,6 +83,7 @@ func TestNetworkTransport_AppendEntries(t *testing.T) {
 
 	// Make the RPC request
 	args := AppendEntriesRequest{
+		RPCHeader:    RPCHeader{ProtocolVersion: ProtocolVersionMax},
 		Term:         10,
 		Leader:       []byte("cartman"),
 		PrevLogEntry: 100,
@@ -96,9 +98,10 @@ func TestNetworkTransport_AppendEntries(t *testing.T) {
 		LeaderCommitIndex: 90,
 	}
 	resp := AppendEntriesResponse{
-		Term:    4,
-		LastLog: 90,
-		Success: true,
+		RPCHeader: RPCHeader{ProtocolVersion: ProtocolVersionMax},
+		Term:      4,
+		LastLog:   90,
+		Success:   true,
 	}
 
 	// Listen for a request
@@ -291,6 +294,12 @@ func TestNetworkTransport_InstallSnapshot(t *testing.T) {
 		LastLogTerm:  9,
 		Peers:        []byte("blah blah"),
 		Size:         10,
+		Header: SnapshotHeader{
+			FormatVersion: SnapshotFormatVersion,
+			SchemaVersion: 2,
+			Created:       time.Unix(1500000000, 0).UTC(),
+			NodeID:        "kyle",
+		},
 	}
 	resp := InstallSnapshotResponse{
 		Term:    10,
@@ -344,6 +353,74 @@ func TestNetworkTransport_InstallSnapshot(t *testing.T) {
 	}
 }
 
+func TestNetworkTransport_FetchSnapshot(t *testing.T) {
+	// Transport 1 is consumer
+	trans1, err := NewTCPTransport("127.0.0.1:0", nil, 2, time.Second, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer trans1.Close()
+	rpcCh := trans1.Consumer()
+
+	// Make the RPC request
+	args := FetchSnapshotRequest{
+		RPCHeader:    RPCHeader{ProtocolVersion: ProtocolVersionMax},
+		ID:           "9-100-1234",
+		LastLogIndex: 100,
+		LastLogTerm:  9,
+	}
+	resp := FetchSnapshotResponse{
+		RPCHeader:    RPCHeader{ProtocolVersion: ProtocolVersionMax},
+		LastLogIndex: 100,
+		LastLogTerm:  9,
+		Peers:        []byte("blah blah"),
+		Size:         10,
+		Labels:       map[string]string{"a": "b"},
+	}
+
+	// Listen for a request, and answer with the snapshot
+	go func() {
+		select {
+		case rpc := <-rpcCh:
+			// Verify the command
+			req := rpc.Command.(*FetchSnapshotRequest)
+			if !reflect.DeepEqual(req, &args) {
+				t.Fatalf("command mismatch: %#v %#v", *req, args)
+			}
+			rpc.RespondWithReader(&resp, ioutil.NopCloser(bytes.NewBufferString("0123456789")))
+
+		case <-time.After(200 * time.Millisecond):
+			t.Fatalf("timeout")
+		}
+	}()
+
+	// Transport 2 makes outbound request
+	trans2, err := NewTCPTransport("127.0.0.1:0", nil, 2, time.Second, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer trans2.Close()
+
+	var out FetchSnapshotResponse
+	reader, err := trans2.FetchSnapshot(trans1.LocalAddr(), &args, &out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer reader.Close()
+
+	// Verify the response and the state
+	if !reflect.DeepEqual(resp, out) {
+		t.Fatalf("command mismatch: %#v %#v", resp, out)
+	}
+	buf, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "0123456789" {
+		t.Fatalf("bad buf %q", buf)
+	}
+}
+
 func TestNetworkTransport_EncodeDecode(t *testing.T) {
 	// Transport 1 is consumer
 	trans1, err := NewTCPTransport("127.0.0.1:0", nil, 2, time.Second, nil)
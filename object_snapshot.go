@@ -0,0 +1,523 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultObjectSnapshotPartSize is the size of the parts a snapshot
+	// is uploaded in, unless configured otherwise.
+	DefaultObjectSnapshotPartSize = 8 * 1024 * 1024
+
+	objectPartKey = "part-%08d"
+)
+
+// ObjectSnapshotStore implements the SnapshotStore interface on top of
+// a BlobStore. Snapshots are streamed to the store in parts, and their
+// meta data is written last, so a snapshot only becomes visible once it
+// is complete. Several nodes can share the same store and prefix, which
+// lets a new node restore the latest snapshot when it starts instead of
+// having it streamed from the leader. Reaping deletes snapshots that other
+// nodes may still be reading, so only one node sharing a prefix should
+// reap, and the others set NoReap.
+type ObjectSnapshotStore struct {
+	blobs     BlobStore
+	prefix    string
+	partSize  int
+	retention SnapshotRetentionPolicy
+	noReap    bool
+	logger    *log.Logger
+}
+
+// ObjectSnapshotStoreConfig is used to configure an ObjectSnapshotStore.
+type ObjectSnapshotStoreConfig struct {
+	// Prefix is put in front of every key, so several clusters can
+	// share a bucket.
+	Prefix string
+
+	// PartSize is the size of the parts snapshots are uploaded in, and
+	// how much of a snapshot is buffered in memory. Defaults to
+	// DefaultObjectSnapshotPartSize.
+	PartSize int
+
+	// Retain is how many snapshots are retained when no Retention
+	// policy is given.
+	Retain int
+
+	// Retention decides which snapshots are kept. The newest snapshot
+	// is always kept.
+	Retention SnapshotRetentionPolicy
+
+	// NoReap stops the store from reaping snapshots when they are
+	// created. Set it on all but one of the nodes sharing a prefix, so
+	// a snapshot is never deleted by one node while another reads it.
+	NoReap bool
+
+	// LogOutput is used as the sink for logs. Defaults to os.Stderr.
+	LogOutput io.Writer
+}
+
+// ObjectSnapshotSink implements SnapshotSink by uploading parts to a
+// BlobStore.
+type ObjectSnapshotSink struct {
+	store  *ObjectSnapshotStore
+	logger *log.Logger
+	meta   objectSnapshotMeta
+
+	part      bytes.Buffer
+	stateHash hash.Hash64
+
+	closed bool
+}
+
+// objectSnapshotMeta is stored next to the parts of a snapshot. Each
+// part has a CRC too, so a part can be verified before it is read.
+type objectSnapshotMeta struct {
+	SnapshotMeta
+	CRC      []byte
+	Parts    int
+	PartCRCs [][]byte `json:",omitempty"`
+	Created  time.Time
+}
+
+type objectSnapshotSlice []*objectSnapshotMeta
+
+// NewObjectSnapshotStore creates a new ObjectSnapshotStore on top of
+// the given BlobStore.
+func NewObjectSnapshotStore(blobs BlobStore, conf *ObjectSnapshotStoreConfig) (*ObjectSnapshotStore, error) {
+	retention := conf.Retention
+	if retention == nil {
+		if conf.Retain < 1 {
+			return nil, fmt.Errorf("must retain at least one snapshot")
+		}
+		retention = RetainCount(conf.Retain)
+	}
+	partSize := conf.PartSize
+	if partSize == 0 {
+		partSize = DefaultObjectSnapshotPartSize
+	}
+	if partSize < 0 {
+		return nil, fmt.Errorf("part size must not be negative")
+	}
+	logOutput := conf.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+
+	store := &ObjectSnapshotStore{
+		blobs:     blobs,
+		prefix:    conf.Prefix,
+		partSize:  partSize,
+		retention: retention,
+		noReap:    conf.NoReap,
+		logger:    log.New(logOutput, "", log.LstdFlags),
+	}
+	return store, nil
+}
+
+// metaKey returns the key of the meta data of a snapshot
+func (o *ObjectSnapshotStore) metaKey(id string) string {
+	return o.prefix + id + "/" + metaFilePath
+}
+
+// partKey returns the key of a part of a snapshot
+func (o *ObjectSnapshotStore) partKey(id string, part int) string {
+	return o.prefix + id + "/" + fmt.Sprintf(objectPartKey, part)
+}
+
+// Create is used to start a new snapshot. Nodes sharing the store may
+// snapshot the same index at once, so the ID gets a random suffix.
+func (o *ObjectSnapshotStore) Create(index, term uint64, peers []byte) (SnapshotSink, error) {
+	name := snapshotName(term, index) + "-" + generateUUID()[:8]
+	o.logger.Printf("[INFO] snapshot: Creating new snapshot %s%s", o.prefix, name)
+
+	sink := &ObjectSnapshotSink{
+		store:  o,
+		logger: o.logger,
+		meta: objectSnapshotMeta{
+			SnapshotMeta: SnapshotMeta{
+				ID:    name,
+				Index: index,
+				Term:  term,
+				Peers: peers,
+			},
+			Created: time.Now(),
+		},
+		stateHash: crc64.New(crc64.MakeTable(crc64.ECMA)),
+	}
+	return sink, nil
+}
+
+// List returns available snapshots in the store.
+func (o *ObjectSnapshotStore) List() ([]*SnapshotMeta, error) {
+	snapshots, err := o.getSnapshots()
+	if err != nil {
+		o.logger.Printf("[ERR] snapshot: Failed to get snapshots: %v", err)
+		return nil, err
+	}
+
+	var snapMeta []*SnapshotMeta
+	for i, keep := range o.retained(snapshots) {
+		if keep {
+			snapMeta = append(snapMeta, &snapshots[i].SnapshotMeta)
+		}
+	}
+	return snapMeta, nil
+}
+
+// retained applies the retention policy to the snapshots, which must be
+// sorted new -> old, and returns which ones to keep.
+func (o *ObjectSnapshotStore) retained(snapshots []*objectSnapshotMeta) []bool {
+	infos := make([]*SnapshotRetentionInfo, len(snapshots))
+	for i, meta := range snapshots {
+		infos[i] = &SnapshotRetentionInfo{
+			SnapshotMeta: meta.SnapshotMeta,
+			Created:      meta.Created,
+		}
+	}
+	keep := o.retention.Retain(time.Now(), infos)
+	if len(keep) != len(snapshots) {
+		o.logger.Printf("[ERR] snapshot: Retention policy returned %d results for %d snapshots, keeping all",
+			len(keep), len(snapshots))
+		keep = make([]bool, len(snapshots))
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+	if len(keep) > 0 {
+		keep[0] = true
+	}
+	return keep
+}
+
+// getSnapshots returns all the finished snapshots, new -> old
+func (o *ObjectSnapshotStore) getSnapshots() ([]*objectSnapshotMeta, error) {
+	keys, err := o.blobs.List(o.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapMeta []*objectSnapshotMeta
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, o.prefix)
+		if !strings.HasSuffix(id, "/"+metaFilePath) {
+			continue
+		}
+		id = strings.TrimSuffix(id, "/"+metaFilePath)
+		if strings.Contains(id, "/") {
+			continue
+		}
+
+		meta, err := o.readMeta(id)
+		if err == ErrBlobNotFound {
+			// Reaped by another node in the meantime
+			continue
+		} else if err != nil {
+			o.logger.Printf("[WARN] snapshot: Failed to read metadata for %v: %v", id, err)
+			continue
+		}
+		snapMeta = append(snapMeta, meta)
+	}
+
+	sort.Sort(sort.Reverse(objectSnapshotSlice(snapMeta)))
+	return snapMeta, nil
+}
+
+// readMeta is used to read the meta data of a snapshot
+func (o *ObjectSnapshotStore) readMeta(id string) (*objectSnapshotMeta, error) {
+	r, err := o.blobs.Get(o.metaKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	meta := &objectSnapshotMeta{}
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return nil, err
+	}
+	if meta.ID != id {
+		return nil, fmt.Errorf("meta data of %v names snapshot %v", id, meta.ID)
+	}
+	return meta, nil
+}
+
+// Open takes a snapshot ID and returns a ReadCloser for that snapshot.
+// The parts are fetched one at a time as they are read, and each is
+// checked against its CRC before any of it is returned. The CRC of the
+// whole snapshot is verified once the end of the snapshot is reached.
+func (o *ObjectSnapshotStore) Open(id string) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, err := o.readMeta(id)
+	if err != nil {
+		o.logger.Printf("[ERR] snapshot: Failed to get meta data to open snapshot: %v", err)
+		return nil, nil, err
+	}
+	reader := &objectSnapshotReader{
+		store:     o,
+		meta:      meta,
+		stateHash: crc64.New(crc64.MakeTable(crc64.ECMA)),
+	}
+	return &meta.SnapshotMeta, reader, nil
+}
+
+// ReapSnapshots reaps any snapshots not kept by the retention policy.
+// The meta data goes first, so a snapshot disappears from List before
+// its parts are removed. Nodes sharing the prefix that are reading a
+// reaped snapshot fail to get its remaining parts.
+func (o *ObjectSnapshotStore) ReapSnapshots() error {
+	snapshots, err := o.getSnapshots()
+	if err != nil {
+		o.logger.Printf("[ERR] snapshot: Failed to get snapshots: %v", err)
+		return err
+	}
+
+	for i, keep := range o.retained(snapshots) {
+		if keep {
+			continue
+		}
+		id := snapshots[i].ID
+		o.logger.Printf("[INFO] snapshot: reaping snapshot %s%s", o.prefix, id)
+		if err := o.delete(id, snapshots[i].Parts); err != nil {
+			o.logger.Printf("[ERR] snapshot: Failed to reap snapshot %v: %v", id, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes the meta data and the given number of parts of a
+// snapshot
+func (o *ObjectSnapshotStore) delete(id string, parts int) error {
+	if err := o.blobs.Delete(o.metaKey(id)); err != nil {
+		return err
+	}
+	for part := 0; part < parts; part++ {
+		if err := o.blobs.Delete(o.partKey(id, part)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ID returns the ID of the snapshot, can be used with Open()
+// after the snapshot is finalized.
+func (s *ObjectSnapshotSink) ID() string {
+	return s.meta.ID
+}
+
+// SetHeader records the header in the meta data.
+func (s *ObjectSnapshotSink) SetHeader(header SnapshotHeader) {
+	s.meta.Header = header
+}
+
+// SetLabel records a label in the meta data.
+func (s *ObjectSnapshotSink) SetLabel(key, value string) {
+	setSnapshotLabel(&s.meta.SnapshotMeta, key, value)
+}
+
+// Write is used to append to the snapshot. A part is uploaded whenever
+// enough data is buffered.
+func (s *ObjectSnapshotSink) Write(b []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("snapshot sink is closed")
+	}
+
+	var written int
+	for len(b) > 0 {
+		n := s.store.partSize - s.part.Len()
+		if n > len(b) {
+			n = len(b)
+		}
+		s.part.Write(b[:n])
+		s.stateHash.Write(b[:n])
+		s.meta.Size += int64(n)
+		written += n
+		b = b[n:]
+
+		if s.part.Len() == s.store.partSize {
+			if err := s.uploadPart(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// uploadPart uploads the buffered data as the next part
+func (s *ObjectSnapshotSink) uploadPart() error {
+	key := s.store.partKey(s.meta.ID, s.meta.Parts)
+	if err := s.store.blobs.Put(key, bytes.NewReader(s.part.Bytes())); err != nil {
+		s.logger.Printf("[ERR] snapshot: Failed to upload part %d: %v", s.meta.Parts, err)
+		return err
+	}
+	s.meta.PartCRCs = append(s.meta.PartCRCs, partCRC(s.part.Bytes()))
+	s.meta.Parts++
+	s.part.Reset()
+	return nil
+}
+
+// Close is used to indicate a successful end
+func (s *ObjectSnapshotSink) Close() error {
+	// Make sure close is idempotent
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	// Upload the last part
+	if s.part.Len() > 0 {
+		if err := s.uploadPart(); err != nil {
+			s.store.delete(s.meta.ID, s.meta.Parts)
+			return err
+		}
+	}
+
+	// Write out the meta data, which makes the snapshot visible
+	s.meta.CRC = s.stateHash.Sum(nil)
+	buf, err := json.Marshal(&s.meta)
+	if err != nil {
+		return err
+	}
+	if err := s.store.blobs.Put(s.store.metaKey(s.meta.ID), bytes.NewReader(buf)); err != nil {
+		s.logger.Printf("[ERR] snapshot: Failed to write metadata: %v", err)
+		s.store.delete(s.meta.ID, s.meta.Parts)
+		return err
+	}
+
+	// Reap any old snapshots
+	if !s.store.noReap {
+		s.store.ReapSnapshots()
+	}
+	return nil
+}
+
+// Cancel is used to indicate an unsuccessful end
+func (s *ObjectSnapshotSink) Cancel() error {
+	// Make sure close is idempotent
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	// Attempt to remove the uploaded parts
+	s.part.Reset()
+	return s.store.delete(s.meta.ID, s.meta.Parts)
+}
+
+// objectSnapshotReader reads the parts of a snapshot in order
+type objectSnapshotReader struct {
+	store     *ObjectSnapshotStore
+	meta      *objectSnapshotMeta
+	stateHash hash.Hash64
+
+	part    int
+	current *bytes.Reader
+	read    int64
+	err     error
+}
+
+func (r *objectSnapshotReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		// Fetch the next part
+		if r.current == nil {
+			if r.part == r.meta.Parts {
+				r.err = r.verify()
+				break
+			}
+			r.current, r.err = r.fetchPart()
+			if r.err != nil {
+				break
+			}
+			r.part++
+		}
+
+		n, _ := r.current.Read(p)
+		r.stateHash.Write(p[:n])
+		r.read += int64(n)
+		if r.current.Len() == 0 {
+			r.current = nil
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, r.err
+}
+
+// fetchPart gets the next part and checks its CRC. Snapshots written
+// before parts had a CRC are only verified as a whole.
+func (r *objectSnapshotReader) fetchPart() (*bytes.Reader, error) {
+	rc, err := r.store.blobs.Get(r.store.partKey(r.meta.ID, r.part))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get part %d of snapshot %v: %v", r.part, r.meta.ID, err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read part %d of snapshot %v: %v", r.part, r.meta.ID, err)
+	}
+	if len(r.meta.PartCRCs) == r.meta.Parts {
+		stored, computed := r.meta.PartCRCs[r.part], partCRC(data)
+		if bytes.Compare(stored, computed) != 0 {
+			r.store.logger.Printf("[ERR] snapshot: CRC checksum failed for part %d (stored: %v computed: %v)",
+				r.part, stored, computed)
+			return nil, fmt.Errorf("CRC mismatch in part %d", r.part)
+		}
+	}
+	return bytes.NewReader(data), nil
+}
+
+// partCRC returns the CRC of a part
+func partCRC(data []byte) []byte {
+	h := crc64.New(crc64.MakeTable(crc64.ECMA))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// verify checks the size and CRC of what was read
+func (r *objectSnapshotReader) verify() error {
+	if r.read != r.meta.Size {
+		return fmt.Errorf("snapshot %v is %d bytes, expected %d", r.meta.ID, r.read, r.meta.Size)
+	}
+	computed := r.stateHash.Sum(nil)
+	if bytes.Compare(r.meta.CRC, computed) != 0 {
+		r.store.logger.Printf("[ERR] snapshot: CRC checksum failed (stored: %v computed: %v)",
+			r.meta.CRC, computed)
+		return fmt.Errorf("CRC mismatch")
+	}
+	return io.EOF
+}
+
+func (r *objectSnapshotReader) Close() error {
+	r.current = nil
+	return nil
+}
+
+// Implement the sort interface for []*objectSnapshotMeta
+func (s objectSnapshotSlice) Len() int {
+	return len(s)
+}
+
+func (s objectSnapshotSlice) Less(i, j int) bool {
+	if s[i].Term != s[j].Term {
+		return s[i].Term < s[j].Term
+	}
+	if s[i].Index != s[j].Index {
+		return s[i].Index < s[j].Index
+	}
+	return s[i].ID < s[j].ID
+}
+
+func (s objectSnapshotSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,249 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ObjectSnapTest(t *testing.T, conf *ObjectSnapshotStoreConfig) (string, *DirBlobStore, *ObjectSnapshotStore) {
+	// Create a test dir
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+
+	blobs, err := NewDirBlobStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snap, err := NewObjectSnapshotStore(blobs, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return dir, blobs, snap
+}
+
+func TestObjectSS_Conformance(t *testing.T) {
+	dir, _, snap := ObjectSnapTest(t, &ObjectSnapshotStoreConfig{
+		Prefix:    "cluster/",
+		PartSize:  4,
+		Retain:    3,
+		LogOutput: ioutil.Discard,
+	})
+	defer os.RemoveAll(dir)
+	testSnapshotStore(t, snap, 3)
+}
+
+func TestObjectSS_Parts(t *testing.T) {
+	dir, blobs, snap := ObjectSnapTest(t, &ObjectSnapshotStoreConfig{
+		PartSize:  1024,
+		Retain:    1,
+		LogOutput: ioutil.Discard,
+	})
+	defer os.RemoveAll(dir)
+
+	// Write a snapshot spanning several parts
+	state := bytes.Repeat([]byte("0123456789"), 500)
+	sink, err := snap.Create(10, 3, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < len(state); i += 700 {
+		end := i + 700
+		if end > len(state) {
+			end = len(state)
+		}
+		if _, err := sink.Write(state[i:end]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Full parts are uploaded as they fill up, but not listed yet
+	keys, _ := blobs.List("")
+	if len(keys) != 4 {
+		t.Fatalf("bad: %v", keys)
+	}
+	if snaps, _ := snap.List(); len(snaps) != 0 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if keys, _ = blobs.List(""); len(keys) != 6 {
+		t.Fatalf("bad: %v", keys)
+	}
+
+	// Read it back
+	meta, r, err := snap.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, state) || meta.Size != int64(len(state)) {
+		t.Fatalf("bad: %v %v", meta, err)
+	}
+
+	// A corrupt part fails the read before any of it is returned
+	partKey := snap.partKey(sink.ID(), 2)
+	if err := blobs.Put(partKey, bytes.NewReader(bytes.Repeat([]byte("x"), 1024))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, r, _ = snap.Open(sink.ID())
+	data, err = ioutil.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), "CRC") {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(data, state[:2048]) {
+		t.Fatalf("bad: %d", len(data))
+	}
+	r.Close()
+
+	// As does a missing part
+	blobs.Delete(partKey)
+	_, r, _ = snap.Open(sink.ID())
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatalf("expected error")
+	}
+	r.Close()
+
+	// A cancelled snapshot leaves nothing behind, and a new snapshot
+	// reaps the old one
+	sink, _ = snap.Create(11, 3, nil)
+	sink.Write(state)
+	if err := sink.Cancel(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink, _ = snap.Create(12, 3, nil)
+	sink.Write(state[:10])
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keys, _ = blobs.List("")
+	if len(keys) != 2 || !strings.HasPrefix(keys[0], sink.ID()+"/") {
+		t.Fatalf("bad: %v", keys)
+	}
+}
+
+func TestObjectSS_Shared(t *testing.T) {
+	conf := &ObjectSnapshotStoreConfig{
+		Prefix:    "cluster/",
+		Retain:    2,
+		LogOutput: ioutil.Discard,
+	}
+	dir, blobs, snap1 := ObjectSnapTest(t, conf)
+	defer os.RemoveAll(dir)
+	snap2, err := NewObjectSnapshotStore(blobs, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conf.Prefix = "other/"
+	other, err := NewObjectSnapshotStore(blobs, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both stores snapshot the same index
+	var ids []string
+	for _, snap := range []*ObjectSnapshotStore{snap1, snap2} {
+		sink, _ := snap.Create(10, 3, nil)
+		sink.Write([]byte("state"))
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ids = append(ids, sink.ID())
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("bad: %v", ids)
+	}
+	for _, snap := range []*ObjectSnapshotStore{snap1, snap2} {
+		if snaps, _ := snap.List(); len(snaps) != 2 {
+			t.Fatalf("bad: %v", snaps)
+		}
+	}
+
+	// Other prefixes are separate
+	if snaps, _ := other.List(); len(snaps) != 0 {
+		t.Fatalf("bad: %v", snaps)
+	}
+
+	// A store that does not reap leaves old snapshots to the reaper
+	conf.Prefix = "cluster/"
+	conf.NoReap = true
+	snap3, err := NewObjectSnapshotStore(blobs, conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink, _ := snap3.Create(11, 3, nil)
+	sink.Write([]byte("state"))
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keys, _ := blobs.List("cluster/")
+	if len(keys) != 6 {
+		t.Fatalf("bad: %v", keys)
+	}
+	if err := snap1.ReapSnapshots(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if keys, _ = blobs.List("cluster/"); len(keys) != 4 {
+		t.Fatalf("bad: %v", keys)
+	}
+}
+
+func TestRaft_ObjectSnapshotStore_NewNode(t *testing.T) {
+	dir, blobs, snap := ObjectSnapTest(t, &ObjectSnapshotStoreConfig{
+		Prefix:    "cluster/",
+		Retain:    2,
+		LogOutput: ioutil.Discard,
+	})
+	defer os.RemoveAll(dir)
+
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	store := NewInmemStore()
+	_, trans := NewInmemTransport()
+	raft, err := NewRaft(conf, &MockFSM{}, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	select {
+	case <-raft.LeaderCh():
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+	for i := 0; i < 10; i++ {
+		if err := raft.Apply([]byte("test"), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A new node sharing the store restores the snapshot when it starts
+	snap2, err := NewObjectSnapshotStore(blobs, &ObjectSnapshotStoreConfig{
+		Prefix:    "cluster/",
+		Retain:    2,
+		LogOutput: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm := &MockFSM{}
+	store2 := NewInmemStore()
+	_, trans2 := NewInmemTransport()
+	raft2, err := NewRaft(inmemConfig(), fsm, store2, store2, snap2, &StaticPeers{}, trans2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft2.Shutdown()
+	if len(fsm.logs) != 10 || raft2.getLastIndex() != raft.getLastSnapshotIndex() {
+		t.Fatalf("bad: %d %d", len(fsm.logs), raft2.getLastIndex())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -18,6 +19,13 @@ import (
 
 const (
 	minCheckInterval = 10 * time.Millisecond
+
+	// The reasons a snapshot is taken, as used in logs and metrics
+	snapshotReasonThreshold = "threshold"
+	snapshotReasonLogBytes  = "log-bytes"
+	snapshotReasonAge       = "max-age"
+	snapshotReasonFSM       = "fsm"
+	snapshotReasonUser      = "user"
 )
 
 var (
@@ -25,6 +33,10 @@ var (
 	keyLastVoteTerm = []byte("LastVoteTerm")
 	keyLastVoteCand = []byte("LastVoteCand")
 
+	// keyLogRestoreIndex is set while a follower refetches logs it
+	// dropped as corrupt
+	keyLogRestoreIndex = []byte("LogRestoreIndex")
+
 	// ErrLeader is returned when an operation can't be completed on a
 	// leader node.
 	ErrLeader = errors.New("node is the leader")
@@ -52,7 +64,17 @@ var (
 	// configuration that doesn't exist.
 	ErrUnknownPeer = errors.New("peer is unknown")
 
-	
+	// ErrCantBootstrap is returned when attempting to bootstrap a cluster
+	// that already has state present.
+	ErrCantBootstrap = errors.New("bootstrap only works on new clusters")
+
+	// ErrUnsupportedProtocol is returned when an operation is attempted
+	// that's not supported by the current protocol version.
+	ErrUnsupportedProtocol = errors.New("operation not supported with current protocol version")
+
+	// ErrAbortedByRestore is returned when a leader fails to commit a log
+	// entry because it's been superseded by a user snapshot restore.
+	ErrAbortedByRestore = errors.New("snapshot restored while committing log")
 )
 
 // commitTupel is used to send an index that was committed,
@@ -69,6 +91,11 @@ type leaderState struct {
 	replState map[string]*followerReplication
 	notify    map[*verifyFuture]struct{}
 	stepDown  chan struct{}
+
+	// transferCh is used by the replication routines to signal a caught
+	// up follower that is preferred as leader
+	transferCh   chan *followerReplication
+	lastTransfer time.Time
 }
 
 // Raft implements a Raft node.
@@ -79,8 +106,15 @@ type Raft struct {
 	// be committed and applied to the FSM.
 	applyCh chan *logFuture
 
-	// Configuration provided at Raft initialization
-	conf *Config
+	// conf is a copy of the configuration provided at Raft initialization.
+	// It is never modified in place, ReloadConfig swaps in a new copy under
+	// confLock, so use config() to access it.
+	conf     *Config
+	confLock sync.RWMutex
+
+	// reloadConfigCh is used to deliver configuration changes to the
+	// main thread
+	reloadConfigCh chan *reloadConfigFuture
 
 	// FSM is the client state machine to apply commands to
 	fsm FSM
@@ -137,6 +171,38 @@ type Raft struct {
 	// snapshotCh is used for user triggered snapshots
 	snapshotCh chan *snapshotFuture
 
+	// userRestoreCh is used to deliver user snapshot restores to the
+	// main thread
+	userRestoreCh chan *userRestoreFuture
+
+	// snapshotIntervalCh is used to restart the snapshot timer when
+	// the SnapshotInterval is reloaded
+	snapshotIntervalCh chan struct{}
+
+	// fsmSnapshotReqCh carries the reason of a snapshot requested by a
+	// SnapshotRequestingFSM
+	fsmSnapshotReqCh chan string
+
+	// snapshotWriteLimiter, snapshotSendLimiter and snapshotReceiveLimiter
+	// pace snapshot writes, sends and receives to the configured rates
+	snapshotWriteLimiter   *rateLimiter
+	snapshotSendLimiter    *rateLimiter
+	snapshotReceiveLimiter *rateLimiter
+
+	// snapshotSendQueue limits how many snapshots we send at once as
+	// the leader
+	snapshotSendQueue *snapshotSendQueue
+
+	// latestSnapshot describes our newest snapshot, which followers
+	// advertise to the leader
+	latestSnapshot     snapshotInfo
+	latestSnapshotLock sync.Mutex
+
+	// snapshotSources are the followers we replicate to as the leader,
+	// which we may point other followers at to fetch snapshots from
+	snapshotSources     map[string]*followerReplication
+	snapshotSourcesLock sync.Mutex
+
 	// stable is a StableStore implementation for durable state
 	// It provides stable storage for many fields in raftState
 	stable StableStore
@@ -147,6 +213,29 @@ type Raft struct {
 	// verifyCh is used to async send verify futures to the main thread
 	// to verify we are still the leader
 	verifyCh chan *verifyFuture
+
+	// candidateFromLeadershipTransfer is set when the leader asked us to
+	// start an election with TimeoutNow. Only used by the main thread.
+	candidateFromLeadershipTransfer bool
+
+	// soleVoterKey and soleVoterResult cache what soleVoter found for the
+	// log and snapshot it last scanned. Only used by the main thread.
+	soleVoterKey    *soleVoterKey
+	soleVoterResult bool
+
+	// logRestoreIndex is the last index a follower had when it dropped
+	// corrupt logs, and is zero otherwise. The dropped logs may have
+	// counted towards commits, so it stays out of elections until its
+	// log is back to this index. Only used by the main thread.
+	logRestoreIndex uint64
+}
+
+// soleVoterKey identifies the log and snapshot soleVoter scanned
+type soleVoterKey struct {
+	lastLogIndex      uint64
+	lastLogTerm       uint64
+	lastSnapshotIndex uint64
+	lastSnapshotTerm  uint64
 }
 
 // NewRaft is used to construct a new Raft node. It takes a configuration, as well
@@ -171,12 +260,37 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 		logger = log.New(conf.LogOutput, "", log.LstdFlags)
 	}
 
+	// Take a private copy of the configuration, so that callers can not
+	// change it underneath us
+	confCopy := *conf
+
+	// Turn off snapshot durability if asked to
+	if setter, ok := snaps.(snapshotNoSyncSetter); ok && conf.NoSnapshotSync {
+		setter.setNoSync()
+	}
+
 	// Try to restore the current term
 	currentTerm, err := stable.GetUint64(keyCurrentTerm)
 	if err != nil && err.Error() != "not found" {
 		return nil, fmt.Errorf("failed to load current term: %v", err)
 	}
 
+	// Check if we were refetching corrupt logs
+	logRestoreIndex, err := stable.GetUint64(keyLogRestoreIndex)
+	if err != nil && err.Error() != "not found" {
+		return nil, fmt.Errorf("failed to load log restore index: %v", err)
+	}
+
+	// Check the logs before joining the cluster, if asked to
+	if conf.VerifyLogStore {
+		start := time.Now()
+		if err := VerifyLogStore(logs, snaps, conf.VerifyLogStoreSampleSize); err != nil {
+			logger.Printf("[ERR] raft: Log store verification failed: %v", err)
+			return nil, err
+		}
+		logger.Printf("[INFO] raft: Verified log store in %v", time.Now().Sub(start))
+	}
+
 	// Read the last log value
 	lastIdx, err := logs.LastIndex()
 	if err != nil {
@@ -211,7 +325,7 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 	// Create Raft struct
 	r := &Raft{
 		applyCh:         make(chan *logFuture),
-		conf:            conf,
+		conf:            &confCopy,
 		fsm:             fsm,
 		fsmCommitCh:     make(chan commitTuple, 128),
 		fsmRestoreCh:    make(chan *restoreFuture),
@@ -223,20 +337,32 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 		peerCh:          make(chan *peerFuture),
 		peers:           peers,
 		peerStore:       peerStore,
+		reloadConfigCh:  make(chan *reloadConfigFuture),
 		rpcCh:           trans.Consumer(),
 		snapshots:       snaps,
 		snapshotCh:      make(chan *snapshotFuture),
+		snapshotIntervalCh: make(chan struct{}, 1),
+		fsmSnapshotReqCh: make(chan string, 1),
+		userRestoreCh:   make(chan *userRestoreFuture),
 		shutdownCh:      make(chan struct{}),
 		stable:          stable,
 		trans:           trans,
 		verifyCh:        make(chan *verifyFuture, 64),
+		logRestoreIndex: logRestoreIndex,
 	}
 
+	r.snapshotWriteLimiter = newRateLimiter(func() int64 { return r.config().SnapshotWriteRate })
+	r.snapshotSendLimiter = newRateLimiter(func() int64 { return r.config().SnapshotSendRate })
+	r.snapshotReceiveLimiter = newRateLimiter(func() int64 { return r.config().SnapshotReceiveRate })
+	r.snapshotSendQueue = newSnapshotSendQueue(func() int { return r.config().MaxConcurrentSnapshotSends })
+	r.snapshotSources = make(map[string]*followerReplication)
+
 	// Initialize as a follower
 	r.setState(Follower)
 
-	// Restore the current term and the last log
-	r.setCurrentTerm(currentTerm)
+	// Restore the current term, which is already persisted, and the last
+	// log
+	r.raftState.setCurrentTerm(currentTerm)
 	r.setLastLogIndex(lastLog.Index)
 	r.setLastLogTerm(lastLog.Term)
 
@@ -244,6 +370,13 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 	if err := r.restoreSnapshot(); err != nil {
 		return nil, err
 	}
+	r.setLastSnapshotTime(time.Now())
+	r.updateLatestSnapshot()
+
+	// Let the FSM ask for snapshots
+	if requesting, ok := fsm.(SnapshotRequestingFSM); ok {
+		requesting.SetSnapshotRequestFunc(r.requestSnapshot)
+	}
 
 	// Setup a heartbeat fast-path to avoid head-of-line
 	// blocking where possible. It MUST be safe for this
@@ -257,6 +390,253 @@ func NewRaft(conf *Config, fsm FSM, logs LogStore, stable StableStore, snaps Sna
 	return r, nil
 }
 
+// BootstrapCluster initializes a server's storage with the given peer set.
+// This should only be called at the beginning of time for the cluster, with
+// the same peer set on every server, before NewRaft is invoked. It writes a
+// LogAddPeer entry at index 1 along with the initial term, so that a lone
+// server can elect itself without relying on EnableSingleNode. It returns
+// ErrCantBootstrap if there is any existing state in the stores.
+func BootstrapCluster(conf *Config, logs LogStore, stable StableStore, snaps SnapshotStore,
+	peerStore PeerStore, trans Transport, peers []net.Addr) error {
+	// Validate the configuration
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
+
+	// Make sure the local node is part of the peer set
+	localAddr := trans.LocalAddr()
+	if !PeerContained(peers, localAddr) {
+		return fmt.Errorf("local node %v is not in the peer set", localAddr)
+	}
+
+	// Make sure the cluster is in a clean state
+	hasState, err := HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return fmt.Errorf("failed to check for existing state: %v", err)
+	}
+	if hasState {
+		return ErrCantBootstrap
+	}
+
+	// Set the current term to 1
+	if err := stable.SetUint64(keyCurrentTerm, 1); err != nil {
+		return fmt.Errorf("failed to save current term: %v", err)
+	}
+
+	// Append the initial peer set entry
+	entry := &Log{
+		Index: 1,
+		Term:  1,
+		Type:  LogAddPeer,
+		Data:  encodePeers(peers, trans),
+	}
+	entry.setCRC()
+	if err := logs.StoreLog(entry); err != nil {
+		return fmt.Errorf("failed to append peer set entry: %v", err)
+	}
+
+	// Persist the peer set so NewRaft picks it up
+	if err := peerStore.SetPeers(peers); err != nil {
+		return fmt.Errorf("failed to save peers: %v", err)
+	}
+	return nil
+}
+
+// HasExistingState returns true if the server has any existing state (logs,
+// knowledge of a current term, or any snapshots).
+func HasExistingState(logs LogStore, stable StableStore, snaps SnapshotStore) (bool, error) {
+	// Make sure we don't have a current term
+	currentTerm, err := stable.GetUint64(keyCurrentTerm)
+	if err == nil {
+		if currentTerm > 0 {
+			return true, nil
+		}
+	} else if err.Error() != "not found" {
+		return false, fmt.Errorf("failed to read current term: %v", err)
+	}
+
+	// Make sure we have an empty log
+	lastIndex, err := logs.LastIndex()
+	if err != nil {
+		return false, fmt.Errorf("failed to get last log index: %v", err)
+	}
+	if lastIndex > 0 {
+		return true, nil
+	}
+
+	// Make sure we have no snapshots
+	snapshots, err := snaps.List()
+	if err != nil {
+		return false, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	if len(snapshots) > 0 {
+		return true, nil
+	}
+	return false, nil
+}
+
+// RecoverCluster is used to manually force a new peer set in order to
+// recover from a loss of quorum where the current peer set cannot be
+// restored, such as when several servers die at the same time. This works
+// by reading all the current state for this server, creating a snapshot
+// with the supplied peer set, and then truncating the Raft log. This is the
+// only safe way to force a given peer set without actually altering the log
+// to insert any new entries, which could cause conflicts with other servers
+// with different state.
+//
+// WARNING! This operation implicitly commits all entries in the Raft log, so
+// in general this is an extremely unsafe operation. If you've lost your other
+// servers and are performing a manual recovery, then you've also lost the
+// commit information, so this is likely the best you can do, but you should be
+// aware that calling this can cause Raft log entries that were in the process
+// of being replicated but not yet be committed to be committed.
+//
+// Raft must not be running for these stores when this is called. The FSM
+// should be a fresh instance, it will be restored from the snapshot and logs
+// on disk before the new snapshot is taken. After this returns, NewRaft can be
+// called with the same stores and the server will start up with the new peer
+// set. The same recovery should be run on every surviving server in newPeers.
+func RecoverCluster(conf *Config, fsm FSM, logs LogStore, stable StableStore,
+	snaps SnapshotStore, peerStore PeerStore, trans Transport, newPeers []net.Addr) error {
+	// Validate the configuration
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
+	if len(newPeers) == 0 {
+		return fmt.Errorf("refused to recover cluster with an empty peer set")
+	}
+
+	// Ensure we have a logger
+	var logger *log.Logger
+	if conf.Logger != nil {
+		logger = conf.Logger
+	} else {
+		if conf.LogOutput == nil {
+			conf.LogOutput = os.Stderr
+		}
+		logger = log.New(conf.LogOutput, "", log.LstdFlags)
+	}
+	logger.Printf("[INFO] raft: Starting recovery with peer set %v", newPeers)
+
+	// Refuse to recover if there's no existing state. This would be safe to
+	// do, but it is likely an indication of an operator error where they
+	// expect data to be there and it's not. By refusing, we force them
+	// to show intent to start a cluster fresh by explicitly doing a
+	// bootstrap, rather than quietly fire up a fresh cluster here.
+	hasState, err := HasExistingState(logs, stable, snaps)
+	if err != nil {
+		return fmt.Errorf("failed to check for existing state: %v", err)
+	}
+	if !hasState {
+		return fmt.Errorf("refused to recover cluster with no initial state, this is probably an operator error")
+	}
+
+	// Attempt to restore any snapshots we find, newest to oldest
+	var snapshotIndex, snapshotTerm uint64
+	snapshots, err := snaps.List()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	for _, snapshot := range snapshots {
+		_, source, err := snaps.Open(snapshot.ID)
+		if err != nil {
+			// Skip this one and try the next. We will detect if we
+			// couldn't open any snapshots.
+			logger.Printf("[ERR] raft: Failed to open snapshot %v: %v", snapshot.ID, err)
+			continue
+		}
+
+		err = fsm.Restore(source)
+		source.Close()
+		if err != nil {
+			// Same here, skip and try the next one.
+			logger.Printf("[ERR] raft: Failed to restore snapshot %v: %v", snapshot.ID, err)
+			continue
+		}
+
+		snapshotIndex = snapshot.Index
+		snapshotTerm = snapshot.Term
+		logger.Printf("[INFO] raft: Restored from snapshot %v (index %d, term %d)",
+			snapshot.ID, snapshotIndex, snapshotTerm)
+		break
+	}
+	if len(snapshots) > 0 && (snapshotIndex == 0 || snapshotTerm == 0) {
+		return fmt.Errorf("failed to restore any of the available snapshots")
+	}
+
+	// The snapshot information is the best known end point for the data
+	// until we play back the Raft log entries.
+	lastIndex := snapshotIndex
+	lastTerm := snapshotTerm
+
+	// Apply any Raft log entries past the snapshot.
+	lastLogIndex, err := logs.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to find last log: %v", err)
+	}
+	for index := snapshotIndex + 1; index <= lastLogIndex; index++ {
+		var entry Log
+		if err := logs.GetLog(index, &entry); err != nil {
+			return fmt.Errorf("failed to get log at index %d: %v", index, err)
+		}
+		if entry.Index != index {
+			return fmt.Errorf("log at index %d has mismatched index %d", index, entry.Index)
+		}
+		if entry.Term < lastTerm {
+			return fmt.Errorf("log at index %d has term %d older than previous term %d",
+				index, entry.Term, lastTerm)
+		}
+		if entry.Type == LogCommand {
+			fsm.Apply(&entry)
+		}
+		lastIndex = entry.Index
+		lastTerm = entry.Term
+	}
+	logger.Printf("[INFO] raft: Replayed logs %d to %d", snapshotIndex+1, lastLogIndex)
+
+	// Create a new snapshot, placing the new peer set in as if it was
+	// committed along with the last log entry.
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot FSM: %v", err)
+	}
+	defer snapshot.Release()
+	sink, err := snaps.Create(lastIndex, lastTerm, encodePeers(newPeers, trans))
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	if err := snapshot.Persist(sink); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to persist snapshot: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("failed to finalize snapshot: %v", err)
+	}
+	logger.Printf("[INFO] raft: Created recovery snapshot %v at index %d, term %d",
+		sink.ID(), lastIndex, lastTerm)
+
+	// Compact away the log entries that are now covered by the snapshot
+	if lastLogIndex > 0 {
+		firstLogIndex, err := logs.FirstIndex()
+		if err != nil {
+			return fmt.Errorf("failed to get first log index: %v", err)
+		}
+		if err := logs.DeleteRange(firstLogIndex, lastLogIndex); err != nil {
+			return fmt.Errorf("log compaction failed: %v", err)
+		}
+		logger.Printf("[INFO] raft: Compacted logs from %d to %d", firstLogIndex, lastLogIndex)
+	}
+
+	// Persist the peer set so NewRaft picks it up. It is only recorded
+	// in the snapshot and here, and a new leader replicates it with its
+	// first entry.
+	if err := peerStore.SetPeers(newPeers); err != nil {
+		return fmt.Errorf("failed to save peers: %v", err)
+	}
+	logger.Printf("[INFO] raft: Recovery complete, new peer set in snapshot at index %d", lastIndex)
+	return nil
+}
+
 // Leader is used to return the current leader of the cluster,
 // it may return nil if there is no current leader or the leader
 // is unknown
@@ -403,6 +783,34 @@ func (r *Raft) SetPeers(p []net.Addr) Future {
 	}
 }
 
+// ReloadConfig updates the configuration of a running Raft node. The new
+// values are delivered to the main loop and validated with ValidateConfig
+// before being swapped in. If the resulting configuration is invalid an error
+// is returned and no changes are made. All fields of rc are copied, even if
+// they are zero valued, so use ReloadableConfig to fetch the current values
+// first when only changing some of them.
+func (r *Raft) ReloadConfig(rc ReloadableConfig) Future {
+	reloadFuture := &reloadConfigFuture{
+		config: rc,
+	}
+	reloadFuture.init()
+
+	select {
+	case r.reloadConfigCh <- reloadFuture:
+		return reloadFuture
+	case <-r.shutdownCh:
+		return errorFuture{ErrRaftShutdown}
+	}
+}
+
+// ReloadableConfig returns the current values of the configuration that
+// can be changed at runtime with ReloadConfig.
+func (r *Raft) ReloadableConfig() ReloadableConfig {
+	var rc ReloadableConfig
+	rc.fromConfig(r.config())
+	return rc
+}
+
 // Shutdown is used to stop the Raft background routines.
 // This is not a graceful operation. Provides a future that
 // can be used to block until all background routines have exited.
@@ -420,19 +828,81 @@ func (r *Raft) Shutdown() Future {
 }
 
 // Snapshot is used to manually force Raft to take a snapshot
-// Returns a future that can be used to block until complete.
-func (r *Raft) Snapshot() Future {
+// Returns a future that can be used to block until complete, and
+// that can open the snapshot which was taken, for example to stream
+// it to a backup while the node keeps running.
+func (r *Raft) Snapshot() SnapshotFuture {
 	snapFuture := &snapshotFuture{}
 	snapFuture.init()
 	select {
 	case r.snapshotCh <- snapFuture:
 		return snapFuture
 	case <-r.shutdownCh:
-		return errorFuture{ErrRaftShutdown}
+		snapFuture.respond(ErrRaftShutdown)
+		return snapFuture
 	}
 
 }
 
+// Restore is used to manually force Raft to consume an external snapshot,
+// such as a backup, replacing the state of the whole cluster. This must be
+// run on the leader or it will fail. The snapshot is written to the local
+// SnapshotStore and restored into the FSM, then the log index is moved past
+// all existing entries so every follower has to install the new snapshot.
+// The meta data must have the size of the data in the reader, the rest of
+// it is replaced. An optional timeout can be provided to limit the amount
+// of time we wait for the restore to be started. Once this returns without
+// an error, a quorum of the cluster has installed the snapshot.
+//
+// This will block the leader while the snapshot is written and restored,
+// and will abort any operations that are inflight.
+func (r *Raft) Restore(meta *SnapshotMeta, reader io.Reader, timeout time.Duration) error {
+	metrics.IncrCounter([]string{"raft", "restore"}, 1)
+	if err := checkSnapshotHeader(r.fsm, meta.Header); err != nil {
+		return err
+	}
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	// Perform the restore
+	restore := &userRestoreFuture{
+		meta:   meta,
+		reader: reader,
+	}
+	restore.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case r.userRestoreCh <- restore:
+		// If the restore is ingested then wait for it to complete
+		if err := restore.Error(); err != nil {
+			return err
+		}
+	}
+
+	// Apply a no-op log entry. Waiting for this allows us to wait until
+	// the followers have installed the snapshot and replicated at least
+	// this new entry.
+	noop := &logFuture{
+		log: Log{
+			Type: LogNoop,
+		},
+	}
+	noop.init()
+	select {
+	case <-timer:
+		return ErrEnqueueTimeout
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	case r.applyCh <- noop:
+		return noop.Error()
+	}
+}
+
 // State is used to return the state raft is currently in
 func (r *Raft) State() RaftState {
 	return r.getState()
@@ -466,17 +936,23 @@ func (r *Raft) Stats() map[string]string {
 		return strconv.FormatUint(v, 10)
 	}
 	s := map[string]string{
-		"state":               r.getState().String(),
-		"term":                toString(r.getCurrentTerm()),
-		"last_log_index":      toString(r.getLastLogIndex()),
-		"last_log_term":       toString(r.getLastLogTerm()),
-		"commit_index":        toString(r.getCommitIndex()),
-		"applied_index":       toString(r.getLastApplied()),
-		"fsm_pending":         toString(uint64(len(r.fsmCommitCh))),
-		"last_snapshot_index": toString(r.getLastSnapshotIndex()),
-		"last_snapshot_term":  toString(r.getLastSnapshotTerm()),
-		"num_peers":           toString(uint64(len(r.peers))),
-	}
+		"state":                r.getState().String(),
+		"term":                 toString(r.getCurrentTerm()),
+		"last_log_index":       toString(r.getLastLogIndex()),
+		"last_log_term":        toString(r.getLastLogTerm()),
+		"commit_index":         toString(r.getCommitIndex()),
+		"applied_index":        toString(r.getLastApplied()),
+		"fsm_pending":          toString(uint64(len(r.fsmCommitCh))),
+		"last_snapshot_index":  toString(r.getLastSnapshotIndex()),
+		"last_snapshot_term":   toString(r.getLastSnapshotTerm()),
+		"num_peers":            toString(uint64(len(r.peers))),
+		"protocol_version":     toString(uint64(r.config().ProtocolVersion)),
+		"protocol_version_min": toString(uint64(ProtocolVersionMin)),
+		"protocol_version_max": toString(uint64(ProtocolVersionMax)),
+	}
+	active, queued := r.snapshotSendQueue.stats()
+	s["snapshot_sends_active"] = toString(uint64(active))
+	s["snapshot_sends_queued"] = toString(uint64(queued))
 	last := r.LastContact()
 	if last.IsZero() {
 		s["last_contact"] = "never"
@@ -499,19 +975,50 @@ func (r *Raft) LastIndex() uint64 {
 // the FSM to block our internal operations.
 func (r *Raft) runFSM() {
 	var lastIndex, lastTerm uint64
+	applyCommit := func(commitTuple commitTuple) {
+		// Apply the log if a command
+		var resp interface{}
+		if commitTuple.log.Type == LogCommand {
+			start := time.Now()
+			resp = r.fsm.Apply(commitTuple.log)
+			metrics.MeasureSince([]string{"raft", "fsm", "apply"}, start)
+		}
+
+		// Update the indexes
+		lastIndex = commitTuple.log.Index
+		lastTerm = commitTuple.log.Term
+
+		// Invoke the future if given
+		if commitTuple.future != nil {
+			commitTuple.future.response = resp
+			commitTuple.future.respond(nil)
+		}
+	}
+
 	for {
 		select {
 		case req := <-r.fsmRestoreCh:
+			// Apply any logs committed before the restore was requested,
+			// so they can not be applied on top of the snapshot
+			for pending := len(r.fsmCommitCh); pending > 0; pending-- {
+				applyCommit(<-r.fsmCommitCh)
+			}
+
 			// Open the snapshot
 			meta, source, err := r.snapshots.Open(req.ID)
 			if err != nil {
 				req.respond(fmt.Errorf("failed to open snapshot %v: %v", req.ID, err))
 				continue
 			}
+			if err := checkSnapshotHeader(r.fsm, meta.Header); err != nil {
+				req.respond(fmt.Errorf("failed to restore snapshot %v: %v", req.ID, err))
+				source.Close()
+				continue
+			}
 
 			// Attempt to restore
 			start := time.Now()
-			if err := r.fsm.Restore(source); err != nil {
+			if err := restoreFSM(r.fsm, source); err != nil {
 				req.respond(fmt.Errorf("failed to restore snapshot %v: %v", req.ID, err))
 				source.Close()
 				continue
@@ -544,23 +1051,8 @@ func (r *Raft) runFSM() {
 			req.respond(err)
 
 		case commitTuple := <-r.fsmCommitCh:
-			// Apply the log if a command
-			var resp interface{}
-			if commitTuple.log.Type == LogCommand {
-				start := time.Now()
-				resp = r.fsm.Apply(commitTuple.log)
-				metrics.MeasureSince([]string{"raft", "fsm", "apply"}, start)
-			}
-
-			// Update the indexes
-			lastIndex = commitTuple.log.Index
-			lastTerm = commitTuple.log.Term
+			applyCommit(commitTuple)
 
-			// Invoke the future if given
-			if commitTuple.future != nil {
-				commitTuple.future.response = resp
-				commitTuple.future.respond(nil)
-			}
 		case <-r.shutdownCh:
 			return
 		}
@@ -596,16 +1088,25 @@ func (r *Raft) run() {
 func (r *Raft) runFollower() {
 	didWarn := false
 	r.wrapper_logger.print("[INFO] raft: " + r.String() + " entering Follower state")
-	heartbeatTimer := randomTimeout(r.conf.HeartbeatTimeout)
+	heartbeatTimer := randomTimeout(r.followerTimeout())
 	for {
 		select {
 		case rpc := <-r.rpcCh:
 			r.processRPC(rpc)
 
+			// The leader may have asked us to start an election
+			if r.getState() == Candidate {
+				return
+			}
+
 		case a := <-r.applyCh:
 			// Reject any operations since we are not the leader
 			a.respond(ErrNotLeader)
 
+		case u := <-r.userRestoreCh:
+			// Reject any restores since we are not the leader
+			u.respond(ErrNotLeader)
+
 		case v := <-r.verifyCh:
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
@@ -615,19 +1116,27 @@ func (r *Raft) runFollower() {
 			r.peers = ExcludePeer(p.peers, r.localAddr)
 			p.respond(r.peerStore.SetPeers(p.peers))
 
+		case c := <-r.reloadConfigCh:
+			// Restart the heartbeat timer with the new timeout
+			if r.processReloadConfig(c) {
+				heartbeatTimer = randomTimeout(r.followerTimeout())
+			}
+
 		case <-heartbeatTimer:
 			// Restart the heartbeat timer
-			heartbeatTimer = randomTimeout(r.conf.HeartbeatTimeout)
+			heartbeatTimer = randomTimeout(r.followerTimeout())
 
 			// Check if we have had a successful contact
 			lastContact := r.LastContact()
-			if time.Now().Sub(lastContact) < r.conf.HeartbeatTimeout {
+			if time.Now().Sub(lastContact) < r.config().HeartbeatTimeout {
 				continue
 			}
 
 			// Heartbeat failed! Transition to the candidate state
 			r.setLeader(nil)
-			if len(r.peers) == 0 && !r.conf.EnableSingleNode {
+			if r.logRestoreIndex > 0 {
+				r.wrapper_logger.print("[WARN] raft: Log is being restored up to index " + strconv.FormatUint(r.logRestoreIndex, 10) + ", not starting an election")
+			} else if len(r.peers) == 0 && !r.config().EnableSingleNode && !r.soleVoter() {
 				if !didWarn {
 					r.wrapper_logger.print("[WARN] raft: EnableSingleNode disabled, and no known peers. Aborting election.")
 					didWarn = true
@@ -644,13 +1153,22 @@ func (r *Raft) runFollower() {
 	}
 }
 
+// followerTimeout returns the minimum time a follower waits without contact
+// from a leader before starting an election. Servers with a lower election
+// priority wait longer, so preferred servers tend to win elections.
+func (r *Raft) followerTimeout() time.Duration {
+	conf := r.config()
+	extra := conf.HeartbeatTimeout * time.Duration(MaxElectionPriority-conf.ElectionPriority) / MaxElectionPriority
+	return conf.HeartbeatTimeout + extra
+}
+
 // runCandidate runs the FSM for a candidate
 func (r *Raft) runCandidate() {
 	r.wrapper_logger.print("[INFO] raft: " + r.String() + " entering Candidate state")
 
 	// Start vote for us, and set a timeout
 	voteCh := r.electSelf()
-	electionTimer := randomTimeout(r.conf.ElectionTimeout)
+	electionTimer := randomTimeout(r.config().ElectionTimeout)
 
 	// Tally the votes, need a simple majority
 	grantedVotes := 0
@@ -667,7 +1185,9 @@ func (r *Raft) runCandidate() {
 			if vote.Term > r.getCurrentTerm() {
 				r.wrapper_logger.print("[DEBUG] raft: Newer term discovered, fallback to follower")
 				r.setState(Follower)
-				r.setCurrentTerm(vote.Term)
+				if err := r.setCurrentTerm(vote.Term); err != nil {
+					r.wrapper_logger.print("[ERR] raft: " + err.Error())
+				}
 				return
 			}
 
@@ -689,6 +1209,10 @@ func (r *Raft) runCandidate() {
 			// Reject any operations since we are not the leader
 			a.respond(ErrNotLeader)
 
+		case u := <-r.userRestoreCh:
+			// Reject any restores since we are not the leader
+			u.respond(ErrNotLeader)
+
 		case v := <-r.verifyCh:
 			// Reject any operations since we are not the leader
 			v.respond(ErrNotLeader)
@@ -701,6 +1225,9 @@ func (r *Raft) runCandidate() {
 			r.setState(Follower)
 			return
 
+		case c := <-r.reloadConfigCh:
+			r.processReloadConfig(c)
+
 		case <-electionTimer:
 			// Election failed! Restart the elction. We simply return,
 			// which will kick us back into runCandidate
@@ -727,12 +1254,15 @@ func (r *Raft) runLeader() {
 	r.leaderState.replState = make(map[string]*followerReplication)
 	r.leaderState.notify = make(map[*verifyFuture]struct{})
 	r.leaderState.stepDown = make(chan struct{}, 1)
+	r.leaderState.transferCh = make(chan *followerReplication, 1)
+	r.leaderState.lastTransfer = time.Now()
 
 	// Cleanup state on step down
 	defer func() {
 		// Stop replication
 		for _, p := range r.leaderState.replState {
-			close(p.stopCh)
+			p.stop(0)
+			r.untrackSnapshotSource(p)
 		}
 
 		// Cancel inflight requests
@@ -749,6 +1279,7 @@ func (r *Raft) runLeader() {
 		r.leaderState.replState = nil
 		r.leaderState.notify = nil
 		r.leaderState.stepDown = nil
+		r.leaderState.transferCh = nil
 
 		// If we are stepping down for some reason, no known leader.
 		// We may have stepped down due to an RPC call, which would
@@ -784,9 +1315,11 @@ func (r *Raft) runLeader() {
 	// Disable EnableSingleNode after we've been elected leader.
 	// This is to prevent a split brain in the future, if we are removed
 	// from the cluster and then elect ourself as leader.
-	if r.conf.DisableBootstrapAfterElect && r.conf.EnableSingleNode {
+	if conf := r.config(); conf.DisableBootstrapAfterElect && conf.EnableSingleNode {
 		r.wrapper_logger.print("[INFO] raft: Disabling EnableSingleNode (bootstrap)")
-		r.conf.EnableSingleNode = false
+		newConf := *conf
+		newConf.EnableSingleNode = false
+		r.setConfig(&newConf)
 	}
 
 	// Sit in the leader loop until we step down
@@ -797,18 +1330,23 @@ func (r *Raft) runLeader() {
 func (r *Raft) startReplication(peer net.Addr) {
 	lastIdx := r.getLastIndex()
 	s := &followerReplication{
-		peer:        peer,
-		inflight:    r.leaderState.inflight,
-		stopCh:      make(chan uint64, 1),
-		triggerCh:   make(chan struct{}, 1),
-		currentTerm: r.getCurrentTerm(),
-		matchIndex:  0,
-		nextIndex:   lastIdx + 1,
-		lastContact: time.Now(),
-		notifyCh:    make(chan struct{}, 1),
-		stepDown:    r.leaderState.stepDown,
+		peer:            peer,
+		inflight:        r.leaderState.inflight,
+		stopCh:          make(chan uint64, 1),
+		stoppedCh:       make(chan struct{}),
+		voter:           true,
+		triggerCh:       make(chan struct{}, 1),
+		currentTerm:     r.getCurrentTerm(),
+		matchIndex:      0,
+		nextIndex:       lastIdx + 1,
+		lastContact:     time.Now(),
+		notifyCh:        make(chan struct{}, 1),
+		stepDown:        r.leaderState.stepDown,
+		transferCh:      r.leaderState.transferCh,
+		protocolVersion: ProtocolVersionMin,
 	}
 	r.leaderState.replState[peer.String()] = s
+	r.trackSnapshotSource(s)
 	r.goFunc(func() { r.replicate(s) })
 	asyncNotifyCh(s.triggerCh)
 }
@@ -816,7 +1354,7 @@ func (r *Raft) startReplication(peer net.Addr) {
 // leaderLoop is the hot loop for a leader, it is invoked
 // after all the various leader setup is done
 func (r *Raft) leaderLoop() {
-	lease := time.After(r.conf.LeaderLeaseTimeout)
+	lease := time.After(r.config().LeaderLeaseTimeout)
 	for r.getState() == Leader {
 		select {
 		case rpc := <-r.rpcCh:
@@ -825,6 +1363,9 @@ func (r *Raft) leaderLoop() {
 		case <-r.leaderState.stepDown:
 			r.setState(Follower)
 
+		case s := <-r.leaderState.transferCh:
+			r.transferLeadership(s)
+
 		case <-r.leaderState.commitCh:
 			// Get the committed messages
 			committed := r.leaderState.inflight.Committed()
@@ -860,10 +1401,17 @@ func (r *Raft) leaderLoop() {
 		case p := <-r.peerCh:
 			p.respond(ErrLeader)
 
+		case c := <-r.reloadConfigCh:
+			r.processReloadConfig(c)
+
+		case future := <-r.userRestoreCh:
+			err := r.restoreUserSnapshot(future.meta, future.reader)
+			future.respond(err)
+
 		case newLog := <-r.applyCh:
 			// Group commit, gather all the ready commits
 			ready := []*logFuture{newLog}
-			for i := 0; i < r.conf.MaxAppendEntries; i++ {
+			for i := 0; i < r.config().MaxAppendEntries; i++ {
 				select {
 				case newLog := <-r.applyCh:
 					ready = append(ready, newLog)
@@ -908,7 +1456,7 @@ func (r *Raft) leaderLoop() {
 
 			// Next check interval should adjust for the last node we've
 			// contacted, without going negative
-			checkInterval := r.conf.LeaderLeaseTimeout - maxDiff
+			checkInterval := r.config().LeaderLeaseTimeout - maxDiff
 			if checkInterval < minCheckInterval {
 				checkInterval = minCheckInterval
 			}
@@ -922,6 +1470,67 @@ func (r *Raft) leaderLoop() {
 	}
 }
 
+// processReloadConfig must be called from the main thread for safety. It
+// validates the requested changes and swaps in the new configuration,
+// returning true if the configuration was changed.
+func (r *Raft) processReloadConfig(c *reloadConfigFuture) bool {
+	oldConf := r.config()
+	newConf := c.config.apply(oldConf)
+	if err := ValidateConfig(newConf); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Rejecting invalid configuration reload: " + err.Error())
+		c.respond(err)
+		return false
+	}
+	r.setConfig(newConf)
+
+	// Start any snapshot sends a raised limit allows
+	r.snapshotSendQueue.update()
+
+	// Kick the snapshot routine so it picks up a new interval
+	if newConf.SnapshotInterval != oldConf.SnapshotInterval {
+		asyncNotifyCh(r.snapshotIntervalCh)
+	}
+	r.wrapper_logger.print("[INFO] raft: Reloaded configuration")
+	c.respond(nil)
+	return true
+}
+
+// transferLeadership must be called from the main thread for safety. It is
+// invoked when a caught up follower has a higher election priority than
+// us, and asks it to start an election right away. The follower still has
+// to win a regular election, so the log up-to-date check is never skipped.
+func (r *Raft) transferLeadership(s *followerReplication) {
+	conf := r.config()
+
+	// Every server must understand the TimeoutNow RPC
+	if r.minProtocolVersion() < 2 {
+		return
+	}
+
+	// Re-check the priority, and avoid flapping between servers
+	if s.Priority() <= conf.ElectionPriority {
+		return
+	}
+	if time.Now().Sub(r.leaderState.lastTransfer) < conf.ElectionTimeout {
+		return
+	}
+	r.leaderState.lastTransfer = time.Now()
+
+	r.wrapper_logger.print("[INFO] raft: Transferring leadership to preferred peer " + s.peer.String() +
+		" (priority " + strconv.Itoa(s.Priority()) + ")")
+	req := &TimeoutNowRequest{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+		Leader:    r.trans.EncodePeer(r.localAddr),
+	}
+	r.goFunc(func() {
+		var resp TimeoutNowResponse
+		if err := r.trans.TimeoutNow(s.peer, req, &resp); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Failed to make TimeoutNow RPC to " + s.peer.String() + ": " + err.Error())
+		}
+	})
+}
+
 // verifyLeader must be called from the main thread for safety.
 // Causes the followers to attempt an immediate heartbeat.
 func (r *Raft) verifyLeader(v *verifyFuture) {
@@ -948,6 +1557,95 @@ func (r *Raft) verifyLeader(v *verifyFuture) {
 	}
 }
 
+// restoreUserSnapshot is used to manually consume an external snapshot,
+// such as if restoring from a backup. This must only be called from the
+// main thread while we are the leader. Inflight operations are aborted,
+// and the snapshot is given an index past all our logs, which are then
+// removed so every follower has to install the snapshot.
+func (r *Raft) restoreUserSnapshot(meta *SnapshotMeta, reader io.Reader) error {
+	defer metrics.MeasureSince([]string{"raft", "restoreUserSnapshot"}, time.Now())
+
+	// Cancel any inflight requests
+	r.leaderState.inflight.Reset(ErrAbortedByRestore)
+
+	// Take the current term and an index past both our log and the
+	// snapshot. Our own peer set is kept.
+	term := r.getCurrentTerm()
+	lastIndex := r.getLastIndex()
+	if meta.Index > lastIndex {
+		lastIndex = meta.Index
+	}
+	lastIndex++
+	peerSet := encodePeers(append([]net.Addr{r.localAddr}, r.peers...), r.trans)
+
+	// Dump the snapshot
+	sink, err := r.snapshots.Create(lastIndex, term, peerSet)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	r.setSnapshotHeader(sink, meta.Header.SchemaVersion)
+	copySnapshotLabels(sink, meta.Labels)
+	n, err := io.Copy(sink, reader)
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if n != meta.Size {
+		sink.Cancel()
+		return fmt.Errorf("failed to write snapshot, size didn't match (%d != %d)", n, meta.Size)
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %v", err)
+	}
+	r.wrapper_logger.print("[INFO] raft: Copied " + strconv.FormatInt(n, 10) + " bytes to local snapshot")
+
+	// Restore the snapshot into the FSM. If this fails we are in a bad
+	// state so we panic to take ourselves out.
+	fsm := &restoreFuture{ID: sink.ID()}
+	fsm.init()
+	select {
+	case r.fsmRestoreCh <- fsm:
+	case <-r.shutdownCh:
+		return ErrRaftShutdown
+	}
+	if err := fsm.Error(); err != nil {
+		panic(fmt.Errorf("failed to restore snapshot: %v", err))
+	}
+
+	// Remove the logs the snapshot replaces. Followers will fail to find
+	// them, and fall back to installing the snapshot.
+	firstLog, err := r.logs.FirstIndex()
+	if err != nil {
+		panic(fmt.Errorf("failed to get first log index: %v", err))
+	}
+	if lastLog := r.getLastLogIndex(); firstLog > 0 && lastLog >= firstLog {
+		if err := r.logs.DeleteRange(firstLog, lastLog); err != nil {
+			panic(fmt.Errorf("failed to remove logs replaced by snapshot: %v", err))
+		}
+	}
+
+	// We set the last log so it looks like we've stored the index we
+	// burned. The last applied is set because we made the FSM take the
+	// snapshot state, and we store the last snapshot since we created a
+	// snapshot as part of this process.
+	r.setLastLogIndex(lastIndex)
+	r.setLastLogTerm(term)
+	r.setLastApplied(lastIndex)
+	r.setLastSnapshotIndex(lastIndex)
+	r.setLastSnapshotTerm(term)
+	r.subSnapshotLogBytes(r.getSnapshotLogBytes())
+	r.setLastSnapshotTime(time.Now())
+	r.updateLatestSnapshot()
+
+	// Get every follower to install the snapshot
+	for _, s := range r.leaderState.replState {
+		asyncNotifyCh(s.triggerCh)
+	}
+
+	r.wrapper_logger.print("[INFO] raft: Restored user snapshot (index " + strconv.FormatUint(lastIndex, 10) + ")")
+	return nil
+}
+
 // checkLeaderLease is used to check if we can contact a quorum of nodes
 // within the last leader lease interval. If not, we need to step down,
 // as we may have lost connectivity. Returns the maximum duration without
@@ -961,14 +1659,14 @@ func (r *Raft) checkLeaderLease() time.Duration {
 	now := time.Now()
 	for peer, f := range r.leaderState.replState {
 		diff := now.Sub(f.LastContact())
-		if diff <= r.conf.LeaderLeaseTimeout {
+		if diff <= r.config().LeaderLeaseTimeout {
 			contacted++
 			if diff > maxDiff {
 				maxDiff = diff
 			}
 		} else {
 			// Log at least once at high value, then debug. Otherwise it gets very verbose.
-			if diff <= 3*r.conf.LeaderLeaseTimeout {
+			if diff <= 3*r.config().LeaderLeaseTimeout {
 				r.wrapper_logger.print("[WARN] raft: Failed to contact " + peer + " in " + diff.String())
 			} else {
 				r.wrapper_logger.print("[DEBUG] raft: Failed to contact" + peer + " in " + diff.String())
@@ -986,6 +1684,66 @@ func (r *Raft) checkLeaderLease() time.Duration {
 	return maxDiff
 }
 
+// soleVoter checks if we are the only member of the most recent peer set
+// found in our log or snapshots. This is the case for a single node cluster
+// created with BootstrapCluster, which may elect itself without needing
+// EnableSingleNode. A node that has removed itself will find a peer set
+// that does not include it, and will not self-elect.
+func (r *Raft) soleVoter() bool {
+	// The scan reads the whole log if it has no peer changes, so only
+	// redo it once the log or snapshot has moved
+	key := soleVoterKey{
+		lastLogIndex:      r.getLastLogIndex(),
+		lastLogTerm:       r.getLastLogTerm(),
+		lastSnapshotIndex: r.getLastSnapshotIndex(),
+		lastSnapshotTerm:  r.getLastSnapshotTerm(),
+	}
+	if r.soleVoterKey != nil && *r.soleVoterKey == key {
+		return r.soleVoterResult
+	}
+	sole, ok := r.scanSoleVoter()
+	if ok {
+		r.soleVoterKey = &key
+		r.soleVoterResult = sole
+	}
+	return sole
+}
+
+// scanSoleVoter looks for the most recent peer set in the log and the
+// latest snapshot, and checks if we are its only member. It returns
+// false for ok if the stores could not be read.
+func (r *Raft) scanSoleVoter() (sole bool, ok bool) {
+	// Scan back through the log for the latest peer change
+	first, err := r.logs.FirstIndex()
+	if err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to get first log index: " + err.Error())
+		return false, false
+	}
+	for idx := r.getLastLogIndex(); idx >= first && idx > 0; idx-- {
+		var l Log
+		if err := r.logs.GetLog(idx, &l); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Failed to get log at " + strconv.FormatUint(idx, 10) + ": " + err.Error())
+			return false, false
+		}
+		if l.Type == LogAddPeer || l.Type == LogRemovePeer {
+			peers := decodePeers(l.Data, r.trans)
+			return len(ExcludePeer(peers, r.localAddr)) == 0 && PeerContained(peers, r.localAddr), true
+		}
+	}
+
+	// Fall back to the peer set of the latest snapshot
+	snapshots, err := r.snapshots.List()
+	if err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to list snapshots: " + err.Error())
+		return false, false
+	}
+	if len(snapshots) == 0 {
+		return false, true
+	}
+	peers := decodePeers(snapshots[0].Peers, r.trans)
+	return len(ExcludePeer(peers, r.localAddr)) == 0 && PeerContained(peers, r.localAddr), true
+}
+
 // quorumSize is used to return the quorum size
 func (r *Raft) quorumSize() int {
 	return ((len(r.peers) + 1) / 2) + 1
@@ -1037,6 +1795,7 @@ func (r *Raft) dispatchLogs(applyLogs []*logFuture) {
 		applyLog.dispatch = now
 		applyLog.log.Index = lastIndex + uint64(idx) + 1
 		applyLog.log.Term = term
+		applyLog.log.setCRC()
 		applyLog.policy = newMajorityQuorum(len(r.peers) + 1)
 		logs[idx] = &applyLog.log
 	}
@@ -1050,6 +1809,7 @@ func (r *Raft) dispatchLogs(applyLogs []*logFuture) {
 		r.setState(Follower)
 		return
 	}
+	r.addSnapshotLogBytes(logDataBytes(logs))
 
 	// Add this to the inflight logs, commit
 	r.leaderState.inflight.StartAll(applyLogs)
@@ -1082,7 +1842,14 @@ func (r *Raft) processLogs(index uint64, future *logFuture) {
 
 		} else {
 			l := new(Log)
-			if err := r.logs.GetLog(idx, l); err != nil {
+			err := r.logs.GetLog(idx, l)
+			if err == nil {
+				err = l.verifyCRC()
+			}
+			if err == ErrLogCorrupt {
+				r.handleCorruptLog(idx)
+				return
+			} else if err != nil {
 				r.wrapper_logger.print("[ERR] raft: Failed to get log at " + strconv.FormatUint(idx,10) + ": " + err.Error())
 				panic(err)
 			}
@@ -1094,6 +1861,67 @@ func (r *Raft) processLogs(index uint64, future *logFuture) {
 	}
 }
 
+// handleCorruptLog is invoked when a committed log fails its CRC check
+// before being applied. A follower drops the log and everything after it,
+// so the leader sends them again, and stays out of elections until it
+// has them back. A leader has no good copy to fall back to, so this is
+// fatal.
+func (r *Raft) handleCorruptLog(idx uint64) {
+	metrics.IncrCounter([]string{"raft", "log", "corrupt"}, 1)
+	if r.getState() == Leader {
+		r.wrapper_logger.print("[ERR] raft: Log at index " + strconv.FormatUint(idx, 10) + " is corrupt, cannot continue as leader")
+		panic(fmt.Errorf("log at index %d is corrupt", idx))
+	}
+	r.wrapper_logger.print("[ERR] raft: Log at index " + strconv.FormatUint(idx, 10) + " is corrupt, clearing it to fetch it from the leader")
+
+	// The logs we drop may have counted towards commits, so stay out of
+	// elections until we have them back, even across restarts
+	lastIdx := r.getLastLogIndex()
+	if lastIdx < r.logRestoreIndex {
+		lastIdx = r.logRestoreIndex
+	}
+	if err := r.stable.SetUint64(keyLogRestoreIndex, lastIdx); err != nil {
+		panic(fmt.Errorf("failed to save log restore index: %v", err))
+	}
+	r.logRestoreIndex = lastIdx
+
+	// Find the term of the log before the corrupt one
+	var prevTerm uint64
+	if idx-1 == r.getLastSnapshotIndex() {
+		prevTerm = r.getLastSnapshotTerm()
+	} else if idx > 1 {
+		var prev Log
+		if err := r.logs.GetLog(idx-1, &prev); err != nil {
+			panic(fmt.Errorf("failed to get log at index %d: %v", idx-1, err))
+		}
+		prevTerm = prev.Term
+	}
+
+	// Clear the suffix starting at the corrupt log
+	if err := r.logs.DeleteRange(idx, r.getLastLogIndex()); err != nil {
+		panic(fmt.Errorf("failed to clear corrupt log suffix: %v", err))
+	}
+	r.setLastLogIndex(idx - 1)
+	r.setLastLogTerm(prevTerm)
+
+	// Apply the logs again once the leader has sent them
+	r.setCommitIndex(idx - 1)
+}
+
+// checkLogRestored rejoins elections once the logs dropped as corrupt are
+// back
+func (r *Raft) checkLogRestored() {
+	if r.logRestoreIndex == 0 || r.getLastIndex() < r.logRestoreIndex {
+		return
+	}
+	if err := r.stable.SetUint64(keyLogRestoreIndex, 0); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to clear log restore index: " + err.Error())
+		return
+	}
+	r.wrapper_logger.print("[INFO] raft: Log restored up to index " + strconv.FormatUint(r.logRestoreIndex, 10))
+	r.logRestoreIndex = 0
+}
+
 // processLog is invoked to process the application of a single committed log
 func (r *Raft) processLog(l *Log, future *logFuture, precommit bool) {
 	switch l.Type {
@@ -1139,6 +1967,12 @@ func (r *Raft) processLog(l *Log, future *logFuture, precommit bool) {
 					r.startReplication(p)
 				}
 			}
+
+			// Peers being removed no longer vote, but we replicate to
+			// them until the removal is committed
+			for _, repl := range r.leaderState.replState {
+				repl.setVoter(PeerContained(r.peers, repl.peer))
+			}
 		}
 
 		// Stop replication for old nodes
@@ -1149,8 +1983,8 @@ func (r *Raft) processLog(l *Log, future *logFuture, precommit bool) {
 					r.wrapper_logger.print("[INFO] raft: Removed peer " + repl.peer.String() + ", stopping replication (Index:" + strconv.FormatUint(l.Index,10) +")")
 
 					// Replicate up to this index and stop
-					repl.stopCh <- l.Index
-					close(repl.stopCh)
+					repl.stop(l.Index)
+					r.untrackSnapshotSource(repl)
 					toDelete = append(toDelete, repl.peer.String())
 				}
 			}
@@ -1161,7 +1995,7 @@ func (r *Raft) processLog(l *Log, future *logFuture, precommit bool) {
 
 		// Handle removing ourself
 		if removeSelf && !precommit {
-			if r.conf.ShutdownOnRemove {
+			if r.config().ShutdownOnRemove {
 				r.wrapper_logger.print("[INFO] raft: Removed ourself, shutting down")
 				r.Shutdown()
 			} else {
@@ -1182,8 +2016,57 @@ func (r *Raft) processLog(l *Log, future *logFuture, precommit bool) {
 	}
 }
 
+// getRPCHeader returns an initialized RPCHeader struct for the given
+// Raft instance. This structure is sent along with RPC requests and
+// responses.
+func (r *Raft) getRPCHeader() RPCHeader {
+	return RPCHeader{
+		ProtocolVersion: r.config().ProtocolVersion,
+	}
+}
+
+// checkRPCHeader houses logic about whether this instance of Raft can process
+// the given RPC message.
+func (r *Raft) checkRPCHeader(rpc RPC) error {
+	// Get the header off the RPC message.
+	wh, ok := rpc.Command.(WithRPCHeader)
+	if !ok {
+		return fmt.Errorf("RPC does not have a header")
+	}
+	header := wh.GetRPCHeader()
+
+	// First check is to just make sure the code can understand the
+	// protocol at all.
+	if header.ProtocolVersion < ProtocolVersionMin ||
+		header.ProtocolVersion > ProtocolVersionMax {
+		return ErrUnsupportedProtocol
+	}
+	return nil
+}
+
+// minProtocolVersion returns the lowest protocol version spoken by the
+// leader and any of its followers. Followers that have not responded yet
+// are assumed to speak the oldest version. This must only be called from the
+// main thread while we are the leader, and can be used to gate features
+// that require every server to understand a newer protocol.
+func (r *Raft) minProtocolVersion() ProtocolVersion {
+	minVersion := r.config().ProtocolVersion
+	for _, repl := range r.leaderState.replState {
+		if v := repl.ProtocolVersion(); v < minVersion {
+			minVersion = v
+		}
+	}
+	return minVersion
+}
+
 // processRPC is called to handle an incoming RPC request
 func (r *Raft) processRPC(rpc RPC) {
+	if err := r.checkRPCHeader(rpc); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Rejecting RPC: " + err.Error())
+		rpc.Respond(nil, err)
+		return
+	}
+
 	switch cmd := rpc.Command.(type) {
 	case *AppendEntriesRequest:
 		//r.wrapper_logger.UnpackReceive("Received append entry command", appendEntrySend)
@@ -1194,6 +2077,10 @@ func (r *Raft) processRPC(rpc RPC) {
 	case *InstallSnapshotRequest:
 		//r.wrapper_logger.UnpackReceive("Received snapshot", snapshotSend)
 		r.installSnapshot(rpc, cmd)
+	case *TimeoutNowRequest:
+		r.timeoutNow(rpc, cmd)
+	case *FetchSnapshotRequest:
+		r.serveSnapshot(rpc, cmd)
 	default:
 		r.wrapper_logger.print("[ERR] raft: Got unexpected command")
 		rpc.Respond(nil, fmt.Errorf("unexpected command"))
@@ -1212,6 +2099,13 @@ func (r *Raft) processHeartbeat(rpc RPC) {
 	default:
 	}
 
+	// Ensure we can understand the sender
+	if err := r.checkRPCHeader(rpc); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Rejecting heartbeat: " + err.Error())
+		rpc.Respond(nil, err)
+		return
+	}
+
 	// Ensure we are only handling a heartbeat
 	switch cmd := rpc.Command.(type) {
 	case *AppendEntriesRequest:
@@ -1226,10 +2120,17 @@ func (r *Raft) processHeartbeat(rpc RPC) {
 func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	defer metrics.MeasureSince([]string{"raft", "rpc", "appendEntries"}, time.Now())
 	// Setup a response
+	snapshot := r.getLatestSnapshot()
 	resp := &AppendEntriesResponse{
-		Term:    r.getCurrentTerm(),
-		LastLog: r.getLastIndex(),
-		Success: false,
+		RPCHeader:     r.getRPCHeader(),
+		Term:          r.getCurrentTerm(),
+		LastLog:       r.getLastIndex(),
+		Success:       false,
+		Priority:      r.config().ElectionPriority,
+		SnapshotID:    snapshot.ID,
+		SnapshotIndex: snapshot.Index,
+		SnapshotTerm:  snapshot.Term,
+		SnapshotSize:  snapshot.Size,
 	}
 	var rpcErr error
 	defer rpc.Respond(resp, rpcErr)
@@ -1244,7 +2145,10 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 	if a.Term > r.getCurrentTerm() || r.getState() != Follower {
 		// Ensure transition to follower
 		r.setState(Follower)
-		r.setCurrentTerm(a.Term)
+		if err := r.setCurrentTerm(a.Term); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Rejecting AppendEntries: " + err.Error())
+			return
+		}
 		resp.Term = a.Term
 	}
 
@@ -1280,6 +2184,20 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		first := a.Entries[0]
 		last := a.Entries[n-1]
 
+		// Decompress entries and reject any that were corrupted in
+		// transit, the leader will send them again
+		for _, entry := range a.Entries {
+			if err := decompressLog(entry); err != nil {
+				r.wrapper_logger.print("[ERR] raft: Failed to decompress log at index " + strconv.FormatUint(entry.Index, 10) + " from leader: " + err.Error())
+				return
+			}
+			if err := entry.verifyCRC(); err != nil {
+				metrics.IncrCounter([]string{"raft", "rpc", "appendEntries", "corrupt"}, 1)
+				r.wrapper_logger.print("[ERR] raft: Rejecting log at index " + strconv.FormatUint(entry.Index, 10) + " from leader: " + err.Error())
+				return
+			}
+		}
+
 		// Delete any conflicting entries
 		lastLogIdx := r.getLastLogIndex()
 		if first.Index <= lastLogIdx {
@@ -1295,10 +2213,12 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 			r.wrapper_logger.print("[ERR] raft: Failed to append to logs: " + err.Error())
 			return
 		}
+		r.addSnapshotLogBytes(logDataBytes(a.Entries))
 
 		// Update the lastLog
 		r.setLastLogIndex(last.Index)
 		r.setLastLogTerm(last.Term)
+		r.checkLogRestored()
 		metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "storeLogs"}, start)
 	}
 
@@ -1309,6 +2229,12 @@ func (r *Raft) appendEntries(rpc RPC, a *AppendEntriesRequest) {
 		r.setCommitIndex(idx)
 		r.processLogs(idx, nil)
 		metrics.MeasureSince([]string{"raft", "rpc", "appendEntries", "processLogs"}, start)
+
+		// Have the leader send any logs we dropped as corrupt again
+		if last := r.getLastIndex(); last < idx {
+			resp.LastLog = last
+			return
+		}
 	}
 
 	// Everything went well, set success
@@ -1327,15 +2253,17 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 
 	// Setup a response
 	resp := &RequestVoteResponse{
-		Term:    r.getCurrentTerm(),
-		Peers:   encodePeers(r.peers, r.trans),
-		Granted: false,
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+		Peers:     encodePeers(r.peers, r.trans),
+		Granted:   false,
 	}
 	var rpcErr error
 	defer rpc.Respond(resp, rpcErr)
 
-	// Check if we have an existing leader
-	if leader := r.Leader(); leader != nil {
+	// Check if we have an existing leader, unless the leader itself asked
+	// the candidate to run
+	if leader := r.Leader(); leader != nil && !req.LeadershipTransfer {
 		r.wrapper_logger.print("[WARN] raft: Rejecting vote from " + r.trans.DecodePeer(req.Candidate).String() + " since we have a leader: " + leader.String())
 		return
 	}
@@ -1349,7 +2277,10 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 	if req.Term > r.getCurrentTerm() {
 		// Ensure transition to follower
 		r.setState(Follower)
-		r.setCurrentTerm(req.Term)
+		if err := r.setCurrentTerm(req.Term); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Rejecting vote request: " + err.Error())
+			return
+		}
 		resp.Term = req.Term
 	}
 
@@ -1375,6 +2306,13 @@ func (r *Raft) requestVote(rpc RPC, req *RequestVoteRequest) {
 		return
 	}
 
+	// Logs we dropped as corrupt may have counted towards commits, so we
+	// can't tell if the candidate has every committed log
+	if r.logRestoreIndex > 0 {
+		r.wrapper_logger.print("[WARN] raft: Rejecting vote from " + r.trans.DecodePeer(req.Candidate).String() + " since our log is being restored up to index " + strconv.FormatUint(r.logRestoreIndex, 10))
+		return
+	}
+
 	// Reject if their term is older
 	lastIdx, lastTerm := r.getLastEntry()
 	if lastTerm > req.LastLogTerm {
@@ -1404,8 +2342,9 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	defer metrics.MeasureSince([]string{"raft", "rpc", "installSnapshot"}, time.Now())
 	// Setup a response
 	resp := &InstallSnapshotResponse{
-		Term:    r.getCurrentTerm(),
-		Success: false,
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+		Success:   false,
 	}
 	var rpcErr error
 	defer rpc.Respond(resp, rpcErr)
@@ -1419,13 +2358,39 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	if req.Term > r.getCurrentTerm() {
 		// Ensure transition to follower
 		r.setState(Follower)
-		r.setCurrentTerm(req.Term)
+		if err := r.setCurrentTerm(req.Term); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Rejecting InstallSnapshot: " + err.Error())
+			return
+		}
 		resp.Term = req.Term
 	}
 
 	// Save the current leader
 	r.setLeader(r.trans.DecodePeer(req.Leader))
 
+	// Fetch the snapshot from the peer the leader pointed us at
+	reader := rpc.Reader
+	if req.Source != nil {
+		fetched, err := r.fetchSnapshot(req)
+		if err != nil {
+			r.wrapper_logger.print("[ERR] raft: Failed to fetch snapshot to install: " + err.Error())
+			rpcErr = err
+			return
+		}
+		defer fetched.Close()
+		reader = fetched
+	}
+
+	// Refuse a snapshot we can't restore, before spilling it to disk
+	if err := checkSnapshotHeader(r.fsm, req.Header); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Refusing to install snapshot: " + err.Error())
+		if req.Source == nil {
+			io.Copy(ioutil.Discard, reader)
+		}
+		rpcErr = err
+		return
+	}
+
 	// Create a new snapshot
 	sink, err := r.snapshots.Create(req.LastLogIndex, req.LastLogTerm, req.Peers)
 	if err != nil {
@@ -1433,9 +2398,15 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		rpcErr = fmt.Errorf("failed to create snapshot: %v", err)
 		return
 	}
+	if headerSink, ok := sink.(SnapshotHeaderSink); ok {
+		header := req.Header
+		header.Flags = 0
+		headerSink.SetHeader(header)
+	}
+	copySnapshotLabels(sink, req.Labels)
 
 	// Spill the remote snapshot to disk
-	n, err := io.Copy(sink, rpc.Reader)
+	n, err := io.Copy(sink, newThrottledReader(reader, r.snapshotReceiveLimiter))
 	if err != nil {
 		sink.Cancel()
 		r.wrapper_logger.print("[ERR] raft: Failed to copy snapshot: " + err.Error())
@@ -1482,6 +2453,9 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	// Update the last stable snapshot info
 	r.setLastSnapshotIndex(req.LastLogIndex)
 	r.setLastSnapshotTerm(req.LastLogTerm)
+	r.subSnapshotLogBytes(r.getSnapshotLogBytes())
+	r.setLastSnapshotTime(time.Now())
+	r.updateLatestSnapshot()
 
 	// Restore the peer set
 	peers := decodePeers(req.Peers, r.trans)
@@ -1493,6 +2467,8 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 		r.wrapper_logger.print("[ERR] raft: Failed to compact logs: " + err.Error())
 	}
 
+	r.checkLogRestored()
+
 	r.wrapper_logger.print("[INFO] raft: Installed remote snapshot")
 	resp.Success = true
 	r.lastContactLock.Lock()
@@ -1501,6 +2477,34 @@ func (r *Raft) installSnapshot(rpc RPC, req *InstallSnapshotRequest) {
 	return
 }
 
+// timeoutNow is invoked when we get a TimeoutNow RPC call. The leader uses
+// it to hand leadership to us, so we start an election immediately.
+func (r *Raft) timeoutNow(rpc RPC, req *TimeoutNowRequest) {
+	resp := &TimeoutNowResponse{
+		RPCHeader: r.getRPCHeader(),
+		Term:      r.getCurrentTerm(),
+	}
+	defer rpc.Respond(resp, nil)
+
+	// Only the leader we follow in the current term may hand over
+	// leadership, anyone else could force an election at will
+	from := r.trans.DecodePeer(req.Leader)
+	leader := r.Leader()
+	if req.Term != r.getCurrentTerm() || r.getState() != Follower ||
+		leader == nil || leader.String() != from.String() {
+		r.wrapper_logger.print("[WARN] raft: Ignoring TimeoutNow from " + from.String() + ", which is not our current leader")
+		return
+	}
+	if r.logRestoreIndex > 0 {
+		r.wrapper_logger.print("[WARN] raft: Ignoring TimeoutNow from " + from.String() + " while our log is being restored")
+		return
+	}
+
+	r.wrapper_logger.print("[INFO] raft: Received TimeoutNow from " + from.String() + ", starting election")
+	r.setState(Candidate)
+	r.candidateFromLeadershipTransfer = true
+}
+
 // electSelf is used to send a RequestVote RPC to all peers,
 // and vote for ourself. This has the side affecting of incrementing
 // the current term. The response channel returned is used to wait
@@ -1512,17 +2516,26 @@ func (r *Raft) electSelf() <-chan *RequestVoteResponse {
 	messagepayload := []byte("rpcRequestVote")
 	reqVoteSend = r.wrapper_logger.PrepareSend("Requesting vote", messagepayload)
 
-	// Increment the term
-	r.setCurrentTerm(r.getCurrentTerm() + 1)
+	// Increment the term and vote for ourselves
+	newTerm := r.getCurrentTerm() + 1
+	candidate := r.trans.EncodePeer(r.localAddr)
+	if err := r.persistTermAndVote(newTerm, candidate); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to persist vote: " + err.Error())
+		return nil
+	}
 
 	// Construct the request
 	lastIdx, lastTerm := r.getLastEntry()
 	req := &RequestVoteRequest{
-		Term:         r.getCurrentTerm(),
-		Candidate:    r.trans.EncodePeer(r.localAddr),
-		LastLogIndex: lastIdx,
-		LastLogTerm:  lastTerm,
+		RPCHeader:          r.getRPCHeader(),
+		Term:               newTerm,
+		Candidate:          candidate,
+		LastLogIndex:       lastIdx,
+		LastLogTerm:        lastTerm,
+		Priority:           r.config().ElectionPriority,
+		LeadershipTransfer: r.candidateFromLeadershipTransfer,
 	}
+	r.candidateFromLeadershipTransfer = false
 
 	// Construct a function to ask for a vote
 	askPeer := func(peer net.Addr) {
@@ -1555,12 +2568,6 @@ func (r *Raft) electSelf() <-chan *RequestVoteResponse {
 		askPeer(peer)
 	}
 
-	// Persist a vote for ourselves
-	if err := r.persistVote(req.Term, req.Candidate); err != nil {
-		r.wrapper_logger.print("[ERR] raft: Failed to persist vote: " + err.Error())
-		return nil
-	}
-
 	// Include our own vote
 	respCh <- &RequestVoteResponse{
 		Term:    req.Term,
@@ -1571,6 +2578,12 @@ func (r *Raft) electSelf() <-chan *RequestVoteResponse {
 
 // persistVote is used to persist our vote for safety
 func (r *Raft) persistVote(term uint64, candidate []byte) error {
+	if batch, ok := r.stable.(BatchStableStore); ok {
+		return batch.BatchSet(map[string][]byte{
+			string(keyLastVoteTerm): uint64ToBytes(term),
+			string(keyLastVoteCand): candidate,
+		})
+	}
 	if err := r.stable.SetUint64(keyLastVoteTerm, term); err != nil {
 		return err
 	}
@@ -1580,13 +2593,54 @@ func (r *Raft) persistVote(term uint64, candidate []byte) error {
 	return nil
 }
 
-// setCurrentTerm is used to set the current term in a durable manner
-func (r *Raft) setCurrentTerm(t uint64) {
+// persistTermAndVote is used when starting an election to move to a new
+// term and vote for ourselves. If the stable store supports batches both
+// are written atomically, otherwise the term is written first.
+func (r *Raft) persistTermAndVote(term uint64, candidate []byte) error {
+	batch, ok := r.stable.(BatchStableStore)
+	if !ok {
+		if err := r.setCurrentTerm(term); err != nil {
+			return err
+		}
+		return r.persistVote(term, candidate)
+	}
+	if err := batch.BatchSet(map[string][]byte{
+		string(keyCurrentTerm):  uint64ToBytes(term),
+		string(keyLastVoteTerm): uint64ToBytes(term),
+		string(keyLastVoteCand): candidate,
+	}); err != nil {
+		return err
+	}
+	r.raftState.setCurrentTerm(term)
+	return nil
+}
+
+// setCurrentTerm is used to set the current term in a durable manner.
+// The term only changes once it is persisted, so on an error we stay in
+// the old term, and callers step down and reject the request instead.
+func (r *Raft) setCurrentTerm(t uint64) error {
 	// Persist to disk first
 	if err := r.stable.SetUint64(keyCurrentTerm, t); err != nil {
-		panic(fmt.Errorf("failed to save current term: %v", err))
+		return fmt.Errorf("failed to save current term: %v", err)
 	}
 	r.raftState.setCurrentTerm(t)
+	return nil
+}
+
+// config returns the current configuration. The returned value must not
+// be modified, use setConfig to swap in a new copy instead.
+func (r *Raft) config() *Config {
+	r.confLock.RLock()
+	conf := r.conf
+	r.confLock.RUnlock()
+	return conf
+}
+
+// setConfig is used to replace the current configuration
+func (r *Raft) setConfig(conf *Config) {
+	r.confLock.Lock()
+	r.conf = conf
+	r.confLock.Unlock()
 }
 
 // setState is used to update the current state. Any state
@@ -1603,34 +2657,59 @@ func (r *Raft) setState(state RaftState) {
 func (r *Raft) runSnapshots() {
 	for {
 		select {
-		case <-randomTimeout(r.conf.SnapshotInterval):
+		case <-randomTimeout(r.config().SnapshotInterval):
 			// Check if we should snapshot
-			if !r.shouldSnapshot() {
+			reason := r.shouldSnapshot()
+			if reason == "" {
 				continue
 			}
 
 			// Trigger a snapshot
-			if err := r.takeSnapshot(); err != nil {
+			if _, err := r.takeSnapshot(reason); err != nil {
+				r.wrapper_logger.print("[ERR] raft: Failed to take snapshot: " + err.Error())
+			}
+
+		case reason := <-r.fsmSnapshotReqCh:
+			// Requested by the FSM, run immediately
+			r.wrapper_logger.print("[INFO] raft: FSM requested a snapshot: " + reason)
+			if _, err := r.takeSnapshot(snapshotReasonFSM); err != nil {
 				r.wrapper_logger.print("[ERR] raft: Failed to take snapshot: " + err.Error())
 			}
 
 		case future := <-r.snapshotCh:
 			// User-triggered, run immediately
-			err := r.takeSnapshot()
+			id, err := r.takeSnapshot(snapshotReasonUser)
 			if err != nil {
 				r.wrapper_logger.print("[ERR] raft: Failed to take snapshot: " + err.Error())
+			} else {
+				future.opener = func() (*SnapshotMeta, io.ReadCloser, error) {
+					return r.snapshots.Open(id)
+				}
 			}
 			future.respond(err)
 
+		case <-r.snapshotIntervalCh:
+			// Restart the timer with the reloaded interval
+
 		case <-r.shutdownCh:
 			return
 		}
 	}
 }
 
+// requestSnapshot is handed to a SnapshotRequestingFSM to ask for a
+// snapshot. A request is dropped if one is already pending.
+func (r *Raft) requestSnapshot(reason string) {
+	select {
+	case r.fsmSnapshotReqCh <- reason:
+	default:
+	}
+}
+
 // shouldSnapshot checks if we meet the conditions to take
-// a new snapshot
-func (r *Raft) shouldSnapshot() bool {
+// a new snapshot, and returns the reason, or an empty string
+// if we should not
+func (r *Raft) shouldSnapshot() string {
 	// Check the last snapshot index
 	lastSnap := r.getLastSnapshotIndex()
 
@@ -1638,17 +2717,35 @@ func (r *Raft) shouldSnapshot() bool {
 	lastIdx, err := r.logs.LastIndex()
 	if err != nil {
 		r.wrapper_logger.print("[ERR] raft: Failed to get last log index: " + err.Error())
-		return false
+		return ""
+	}
+
+	// Nothing was logged since the snapshot. A log store compacted up
+	// to the snapshot may also be empty, with no last index.
+	if lastIdx <= lastSnap {
+		return ""
 	}
 
-	// Compare the delta to the threshold
+	// Compare the delta to the thresholds
+	conf := r.config()
 	delta := lastIdx - lastSnap
-	return delta >= r.conf.SnapshotThreshold
+	switch {
+	case delta >= conf.SnapshotThreshold:
+		return snapshotReasonThreshold
+	case conf.SnapshotLogBytesThreshold > 0 && r.getSnapshotLogBytes() >= conf.SnapshotLogBytesThreshold:
+		return snapshotReasonLogBytes
+	case conf.MaxSnapshotAge > 0 && time.Since(r.getLastSnapshotTime()) >= conf.MaxSnapshotAge:
+		return snapshotReasonAge
+	}
+	return ""
 }
 
-// takeSnapshot is used to take a new snapshot
-func (r *Raft) takeSnapshot() error {
+// takeSnapshot is used to take a new snapshot for the given reason,
+// returning its ID
+func (r *Raft) takeSnapshot(reason string) (string, error) {
 	defer metrics.MeasureSince([]string{"raft", "snapshot", "takeSnapshot"}, time.Now())
+	metrics.IncrCounter([]string{"raft", "snapshot", "trigger", reason}, 1)
+
 	// Create a snapshot request
 	req := &reqSnapshotFuture{}
 	req.init()
@@ -1657,54 +2754,148 @@ func (r *Raft) takeSnapshot() error {
 	select {
 	case r.fsmSnapshotCh <- req:
 	case <-r.shutdownCh:
-		return ErrRaftShutdown
+		return "", ErrRaftShutdown
 	}
 
 	// Wait until we get a response
 	if err := req.Error(); err != nil {
-		return fmt.Errorf("failed to start snapshot: %v", err)
+		return "", fmt.Errorf("failed to start snapshot: %v", err)
 	}
 	defer req.snapshot.Release()
 
 	// Log that we are starting the snapshot
-	r.wrapper_logger.print("[INFO] raft: Starting snapshot up to " + strconv.FormatUint(req.index,10))
+	r.wrapper_logger.print("[INFO] raft: Starting snapshot up to " + strconv.FormatUint(req.index, 10) + ", triggered by " + reason)
 
 	// Encode the peerset
 	peerSet := encodePeers(req.peers, r.trans)
 
-	// Create a new snapshot
-	start := time.Now()
-	sink, err := r.snapshots.Create(req.index, req.term, peerSet)
+	// Persist only the changes since the newest snapshot if we can
+	sink, err := r.persistSnapshotDelta(req, peerSet)
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %v", err)
+		return "", err
 	}
-	metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
 
-	// Try to persist the snapshot
-	start = time.Now()
-	if err := req.snapshot.Persist(sink); err != nil {
-		sink.Cancel()
-		return fmt.Errorf("failed to persist snapshot: %v", err)
+	// Otherwise persist a full snapshot
+	if sink == nil {
+		start := time.Now()
+		sink, err = r.snapshots.Create(req.index, req.term, peerSet)
+		if err != nil {
+			return "", fmt.Errorf("failed to create snapshot: %v", err)
+		}
+		metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
+		sink = newThrottledSnapshotSink(sink, r.snapshotWriteLimiter)
+		r.setSnapshotHeader(sink, r.snapshotSchemaVersion())
+
+		// Try to persist the snapshot
+		start = time.Now()
+		if err := req.snapshot.Persist(sink); err != nil {
+			sink.Cancel()
+			return "", fmt.Errorf("failed to persist snapshot: %v", err)
+		}
+		metrics.MeasureSince([]string{"raft", "snapshot", "persist"}, start)
 	}
-	metrics.MeasureSince([]string{"raft", "snapshot", "persist"}, start)
 
 	// Close and check for error
 	if err := sink.Close(); err != nil {
-		return fmt.Errorf("failed to close snapshot: %v", err)
+		return "", fmt.Errorf("failed to close snapshot: %v", err)
 	}
+	r.updateLatestSnapshot()
 
-	// Update the last stable snapshot info
+	// Update the last stable snapshot info, unless a restore has moved
+	// past it while we were busy
+	if req.index < r.getLastSnapshotIndex() {
+		r.wrapper_logger.print("[WARN] raft: Snapshot to " + strconv.FormatUint(req.index, 10) + " superseded by a restored snapshot")
+		return sink.ID(), nil
+	}
 	r.setLastSnapshotIndex(req.index)
 	r.setLastSnapshotTerm(req.term)
+	r.subSnapshotLogBytes(r.snapshotCoveredBytes(req.index))
+	r.setLastSnapshotTime(time.Now())
 
 	// Compact the logs
 	if err := r.compactLogs(req.index); err != nil {
-		return err
+		return "", err
 	}
 
 	// Log completion
 	r.wrapper_logger.print("[INFO] raft: Snapshot to " + strconv.FormatUint(req.index,10) + " complete")
-	return nil
+	return sink.ID(), nil
+}
+
+// snapshotCoveredBytes returns how many of the counted bytes of log data
+// are covered by a snapshot up to the given index. Logs stored after the
+// index stay counted, as they are not compacted. A log stored while we
+// count may be counted twice, so the count errs on the high side. If a
+// log can not be read, all the bytes are taken to be covered.
+func (r *Raft) snapshotCoveredBytes(index uint64) uint64 {
+	logBytes := r.getSnapshotLogBytes()
+	var after uint64
+	for idx := index + 1; idx <= r.getLastIndex(); idx++ {
+		var l Log
+		if err := r.logs.GetLog(idx, &l); err != nil {
+			r.wrapper_logger.print("[WARN] raft: Failed to get log " + strconv.FormatUint(idx, 10) + " to count bytes after snapshot: " + err.Error())
+			return logBytes
+		}
+		after += uint64(len(l.Data))
+	}
+	if after >= logBytes {
+		return 0
+	}
+	return logBytes - after
+}
+
+// persistSnapshotDelta persists only the changes since the newest
+// snapshot, if the FSM and the snapshot store support it and the chain
+// of deltas is not too long yet. It returns a nil sink if a full
+// snapshot must be taken instead.
+func (r *Raft) persistSnapshotDelta(req *reqSnapshotFuture, peerSet []byte) (SnapshotSink, error) {
+	maxDeltas := r.config().MaxSnapshotDeltas
+	store, ok := r.snapshots.(DeltaSnapshotStore)
+	_, incFSM := r.fsm.(IncrementalFSM)
+	incSnap, incSnapOK := req.snapshot.(IncrementalFSMSnapshot)
+	if maxDeltas == 0 || !ok || !incFSM || !incSnapOK {
+		return nil, nil
+	}
+
+	// Base the delta on the newest snapshot, unless a restore has moved
+	// past us or a full snapshot is due
+	snapshots, err := store.List()
+	if err != nil || len(snapshots) == 0 || snapshots[0].Index > req.index {
+		return nil, nil
+	}
+	base := snapshots[0]
+	deltas, err := store.ChainLength(base.ID)
+	if err != nil || deltas >= maxDeltas {
+		return nil, nil
+	}
+
+	// A delta can't be layered on state of another schema version
+	if version := r.snapshotSchemaVersion(); base.Header.SchemaVersion != version {
+		r.wrapper_logger.print("[INFO] raft: Snapshot " + base.ID + " has schema version " + strconv.Itoa(base.Header.SchemaVersion) + ", not " + strconv.Itoa(version) + ", taking a full snapshot")
+		return nil, nil
+	}
+
+	start := time.Now()
+	sink, err := store.CreateDelta(base.ID, req.index, req.term, peerSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create delta snapshot: %v", err)
+	}
+	metrics.MeasureSince([]string{"raft", "snapshot", "create"}, start)
+	sink = newThrottledSnapshotSink(sink, r.snapshotWriteLimiter)
+	r.setSnapshotHeader(sink, r.snapshotSchemaVersion())
+
+	start = time.Now()
+	if err := incSnap.PersistDelta(base, sink); err == ErrSnapshotDeltaUnavailable {
+		sink.Cancel()
+		r.wrapper_logger.print("[INFO] raft: Snapshot delta on " + base.ID + " unavailable, taking a full snapshot")
+		return nil, nil
+	} else if err != nil {
+		sink.Cancel()
+		return nil, fmt.Errorf("failed to persist delta snapshot: %v", err)
+	}
+	metrics.MeasureSince([]string{"raft", "snapshot", "persistDelta"}, start)
+	r.wrapper_logger.print("[INFO] raft: Persisted snapshot delta on " + base.ID)
+	return sink, nil
 }
 
 // compactLogs takes the last inclusive index of a snapshot
@@ -1718,7 +2909,8 @@ func (r *Raft) compactLogs(snapIdx uint64) error {
 	}
 
 	// Check if we have enough logs to truncate
-	if r.getLastLogIndex() <= r.conf.TrailingLogs {
+	trailingLogs := r.config().TrailingLogs
+	if r.getLastLogIndex() <= trailingLogs {
 		return nil
 	}
 
@@ -1726,7 +2918,7 @@ func (r *Raft) compactLogs(snapIdx uint64) error {
 	// back from the head, which ever is futher back. This ensures
 	// at least `TrailingLogs` entries, but does not allow logs
 	// after the snapshot to be removed.
-	maxLog := min(snapIdx, r.getLastLogIndex()-r.conf.TrailingLogs)
+	maxLog := min(snapIdx, r.getLastLogIndex()-trailingLogs)
 
 	// Log this
 	r.wrapper_logger.print("[INFO] raft: Compacting logs from " + strconv.FormatUint(minLog,10) + " to " + strconv.FormatUint(maxLog,10))
@@ -1738,6 +2930,27 @@ func (r *Raft) compactLogs(snapIdx uint64) error {
 	return nil
 }
 
+// setSnapshotHeader records the header of a snapshot we write, if the
+// store supports it
+func (r *Raft) setSnapshotHeader(sink SnapshotSink, schemaVersion int) {
+	if headerSink, ok := sink.(SnapshotHeaderSink); ok {
+		headerSink.SetHeader(SnapshotHeader{
+			FormatVersion: SnapshotFormatVersion,
+			SchemaVersion: schemaVersion,
+			Created:       time.Now(),
+			NodeID:        r.localAddr.String(),
+		})
+	}
+}
+
+// snapshotSchemaVersion returns the schema version declared by the FSM
+func (r *Raft) snapshotSchemaVersion() int {
+	if versioned, ok := r.fsm.(VersionedFSM); ok {
+		return versioned.SnapshotSchemaVersion()
+	}
+	return 0
+}
+
 // restoreSnapshot attempts to restore the latest snapshots, and fails
 // if none of them can be restored. This is called at initialization time,
 // and is completely unsafe to call at any other time.
@@ -1757,7 +2970,11 @@ func (r *Raft) restoreSnapshot() error {
 		}
 		defer source.Close()
 
-		if err := r.fsm.Restore(source); err != nil {
+		if err := checkSnapshotHeader(r.fsm, snapshot.Header); err != nil {
+			r.wrapper_logger.print("[ERR] raft: Can't restore snapshot " + snapshot.ID + ": " + err.Error())
+			continue
+		}
+		if err := restoreFSM(r.fsm, source); err != nil {
 			r.wrapper_logger.print("[ERR] raft: Failed to restore snapshot " + snapshot.ID + ": " + err.Error())
 			continue
 		}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -54,6 +55,9 @@ func (m *MockFSM) Restore(inp io.ReadCloser) error {
 }
 
 func (m *MockSnapshot) Persist(sink SnapshotSink) error {
+	if labelSink, ok := sink.(SnapshotLabelSink); ok {
+		labelSink.SetLabel("logs", fmt.Sprint(m.maxIndex))
+	}
 	hd := codec.MsgpackHandle{}
 	enc := codec.NewEncoder(sink, &hd)
 	if err := enc.Encode(m.logs[:m.maxIndex]); err != nil {
@@ -67,6 +71,75 @@ func (m *MockSnapshot) Persist(sink SnapshotSink) error {
 func (m *MockSnapshot) Release() {
 }
 
+// MockIncrementalFSM is a MockFSM that can persist delta snapshots of
+// the logs applied since the snapshot it last persisted
+type MockIncrementalFSM struct {
+	MockFSM
+	baseID  string
+	baseLen int
+}
+
+type MockIncrementalSnapshot struct {
+	MockSnapshot
+	fsm *MockIncrementalFSM
+}
+
+func (m *MockIncrementalFSM) Snapshot() (FSMSnapshot, error) {
+	m.Lock()
+	defer m.Unlock()
+	return &MockIncrementalSnapshot{MockSnapshot{m.logs, len(m.logs)}, m}, nil
+}
+
+func (m *MockIncrementalFSM) Restore(inp io.ReadCloser) error {
+	m.Lock()
+	m.baseID = ""
+	m.Unlock()
+	return m.MockFSM.Restore(inp)
+}
+
+func (m *MockIncrementalFSM) RestoreDelta(inp io.Reader) error {
+	m.Lock()
+	defer m.Unlock()
+	hd := codec.MsgpackHandle{}
+	dec := codec.NewDecoder(inp, &hd)
+
+	var logs [][]byte
+	if err := dec.Decode(&logs); err != nil {
+		return err
+	}
+	m.logs = append(m.logs, logs...)
+	return nil
+}
+
+func (m *MockIncrementalSnapshot) Persist(sink SnapshotSink) error {
+	return m.persist(0, sink)
+}
+
+func (m *MockIncrementalSnapshot) PersistDelta(base *SnapshotMeta, sink SnapshotSink) error {
+	m.fsm.Lock()
+	baseID, baseLen := m.fsm.baseID, m.fsm.baseLen
+	m.fsm.Unlock()
+	if base.ID != baseID {
+		sink.Cancel()
+		return ErrSnapshotDeltaUnavailable
+	}
+	return m.persist(baseLen, sink)
+}
+
+func (m *MockIncrementalSnapshot) persist(from int, sink SnapshotSink) error {
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(sink, &hd)
+	if err := enc.Encode(m.logs[from:m.maxIndex]); err != nil {
+		sink.Cancel()
+		return err
+	}
+	m.fsm.Lock()
+	m.fsm.baseID, m.fsm.baseLen = sink.ID(), m.maxIndex
+	m.fsm.Unlock()
+	sink.Close()
+	return nil
+}
+
 // Return configurations optimized for in-memory
 func inmemConfig() *Config {
 	conf := DefaultConfig()
@@ -78,16 +151,14 @@ func inmemConfig() *Config {
 }
 
 type cluster struct {
-	dirs   []string
 	stores []*InmemStore
 	fsms   []*MockFSM
-	snaps  []*FileSnapshotStore
+	snaps  []*InmemSnapshotStore
 	trans  []*InmemTransport
 	rafts  []*Raft
 }
 
 func (c *cluster) Merge(other *cluster) {
-	c.dirs = append(c.dirs, other.dirs...)
 	c.stores = append(c.stores, other.stores...)
 	c.fsms = append(c.fsms, other.fsms...)
 	c.snaps = append(c.snaps, other.snaps...)
@@ -112,10 +183,6 @@ func (c *cluster) Close() {
 		}
 	}
 	timer.Stop()
-
-	for _, d := range c.dirs {
-		os.RemoveAll(d)
-	}
 }
 
 func (c *cluster) GetInState(s RaftState) []*Raft {
@@ -284,17 +351,14 @@ func MakeCluster(n int, t *testing.T, conf *Config) *cluster {
 
 	// Setup the stores and transports
 	for i := 0; i < n; i++ {
-		dir, err := ioutil.TempDir("", "raft")
-		if err != nil {
-			t.Fatalf("err: %v ", err)
-		}
 		store := NewInmemStore()
-		c.dirs = append(c.dirs, dir)
 		c.stores = append(c.stores, store)
 		c.fsms = append(c.fsms, &MockFSM{})
 
-		dir2, snap := FileSnapTest(t)
-		c.dirs = append(c.dirs, dir2)
+		snap, err := NewInmemSnapshotStore(3)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
 		c.snaps = append(c.snaps, snap)
 
 		addr, trans := NewInmemTransport()
@@ -335,17 +399,14 @@ func MakeClusterNoPeers(n int, t *testing.T, conf *Config) *cluster {
 
 	// Setup the stores and transports
 	for i := 0; i < n; i++ {
-		dir, err := ioutil.TempDir("", "raft")
-		if err != nil {
-			t.Fatalf("err: %v ", err)
-		}
 		store := NewInmemStore()
-		c.dirs = append(c.dirs, dir)
 		c.stores = append(c.stores, store)
 		c.fsms = append(c.fsms, &MockFSM{})
 
-		dir2, snap := FileSnapTest(t)
-		c.dirs = append(c.dirs, dir2)
+		snap, err := NewInmemSnapshotStore(3)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
 		c.snaps = append(c.snaps, snap)
 
 		_, trans := NewInmemTransport()
@@ -399,6 +460,8 @@ func TestRaft_AfterShutdown(t *testing.T) {
 	}
 	if f := raft.Snapshot(); f.Error() != ErrRaftShutdown {
 		t.Fatalf("should be shutdown: %v", f.Error())
+	} else if _, _, err := f.Open(); err == nil {
+		t.Fatalf("should not open a snapshot")
 	}
 
 	// Should be idempotent
@@ -443,6 +506,289 @@ func TestRaft_SingleNode(t *testing.T) {
 	}
 }
 
+func TestRaft_SingleNode_FileStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		t.Fatalf("err: %v ", err)
+	}
+	defer os.RemoveAll(dir)
+	stable, err := NewFileStableStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir2, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir2)
+
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	addr, trans := NewInmemTransport()
+	raft, err := NewRaft(conf, &MockFSM{}, NewInmemStore(), stable, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+
+	select {
+	case v := <-raft.LeaderCh():
+		if !v {
+			t.Fatalf("should become leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+
+	// The term and our vote should have been persisted together
+	stable, err = NewFileStableStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	term, _ := stable.GetUint64(keyCurrentTerm)
+	voteTerm, _ := stable.GetUint64(keyLastVoteTerm)
+	cand, _ := stable.Get(keyLastVoteCand)
+	if term == 0 || term != voteTerm || term != raft.getCurrentTerm() {
+		t.Fatalf("bad: %d %d", term, voteTerm)
+	}
+	if !bytes.Equal(cand, trans.EncodePeer(addr)) {
+		t.Fatalf("bad: %v", cand)
+	}
+}
+
+func TestRaft_BootstrapCluster(t *testing.T) {
+	conf := inmemConfig()
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+	peerStore := &StaticPeers{}
+
+	// Bootstrap requires the local node in the peer set
+	if err := BootstrapCluster(conf, store, store, snap, peerStore, trans,
+		[]net.Addr{NewInmemAddr()}); err == nil {
+		t.Fatalf("should fail without local node")
+	}
+
+	// Bootstrap a fresh node
+	peers := []net.Addr{addr}
+	if err := BootstrapCluster(conf, store, store, snap, peerStore, trans, peers); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Check the initial entry
+	var l Log
+	if err := store.GetLog(1, &l); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.Type != LogAddPeer || l.Term != 1 {
+		t.Fatalf("bad: %#v", l)
+	}
+	if term, _ := store.GetUint64(keyCurrentTerm); term != 1 {
+		t.Fatalf("bad term: %d", term)
+	}
+	if p, _ := peerStore.Peers(); len(p) != 1 {
+		t.Fatalf("bad peers: %v", p)
+	}
+
+	// A second bootstrap must fail
+	if err := BootstrapCluster(conf, store, store, snap, peerStore, trans, peers); err != ErrCantBootstrap {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRaft_BootstrapCluster_SingleNode(t *testing.T) {
+	conf := inmemConfig()
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+	peerStore := &StaticPeers{}
+	fsm := &MockFSM{}
+
+	if err := BootstrapCluster(conf, store, store, snap, peerStore, trans,
+		[]net.Addr{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should elect itself without EnableSingleNode
+	raft, err := NewRaft(conf, fsm, store, store, snap, peerStore, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case v := <-raft.LeaderCh():
+		if !v {
+			t.Fatalf("should become leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+	if err := raft.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := raft.Shutdown().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should elect itself again after a restart
+	raft, err = NewRaft(conf, fsm, store, store, snap, peerStore, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	select {
+	case v := <-raft.LeaderCh():
+		if !v {
+			t.Fatalf("should become leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+}
+
+// countingLogStore counts the logs read from an InmemStore
+type countingLogStore struct {
+	*InmemStore
+	gets int64
+}
+
+func (c *countingLogStore) GetLog(index uint64, log *Log) error {
+	atomic.AddInt64(&c.gets, 1)
+	return c.InmemStore.GetLog(index, log)
+}
+
+func TestRaft_SoleVoter_NoRescan(t *testing.T) {
+	conf := inmemConfig()
+	store := &countingLogStore{InmemStore: NewInmemStore()}
+	snap, _ := NewInmemSnapshotStore(3)
+	_, trans := NewInmemTransport()
+
+	// A log without any peer changes, which must be scanned in full
+	var logs []*Log
+	for i := 1; i <= 100; i++ {
+		logs = append(logs, &Log{Index: uint64(i), Term: 1, Type: LogCommand})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	raft, err := NewRaft(conf, &MockFSM{}, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+
+	// Sit through several heartbeat timeouts without electing ourselves,
+	// and scan the log only once
+	time.Sleep(conf.HeartbeatTimeout * 10)
+	if raft.State() != Follower {
+		t.Fatalf("bad: %v", raft.State())
+	}
+	if gets := atomic.LoadInt64(&store.gets); gets < 100 || gets > 150 {
+		t.Fatalf("bad: %d reads", gets)
+	}
+}
+
+// failingStableStore is an InmemStore whose terms can't be written while
+// fail is set
+type failingStableStore struct {
+	*InmemStore
+	fail int32
+}
+
+func (f *failingStableStore) SetUint64(key []byte, val uint64) error {
+	if atomic.LoadInt32(&f.fail) != 0 {
+		return fmt.Errorf("simulated failure")
+	}
+	return f.InmemStore.SetUint64(key, val)
+}
+
+func TestRaft_SetCurrentTerm_Failure(t *testing.T) {
+	conf := inmemConfig()
+	store := NewInmemStore()
+	stable := &failingStableStore{InmemStore: store}
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+	addr2, trans2 := NewInmemTransport()
+	trans.Connect(addr2, trans2)
+	trans2.Connect(addr, trans)
+
+	raft, err := NewRaft(conf, &MockFSM{}, store, stable, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+
+	// A newer term that can't be persisted is rejected, without taking it
+	// on or crashing
+	atomic.StoreInt32(&stable.fail, 1)
+	appendReq := &AppendEntriesRequest{
+		RPCHeader: raft.getRPCHeader(),
+		Term:      5,
+		Leader:    trans2.EncodePeer(addr2),
+	}
+	var appendResp AppendEntriesResponse
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if appendResp.Success || appendResp.Term == 5 || raft.getCurrentTerm() == 5 {
+		t.Fatalf("bad: %#v %d", appendResp, raft.getCurrentTerm())
+	}
+	vote := &RequestVoteRequest{
+		RPCHeader: raft.getRPCHeader(),
+		Term:      5,
+		Candidate: trans2.EncodePeer(addr2),
+	}
+	var voteResp RequestVoteResponse
+	if err := trans2.RequestVote(addr, vote, &voteResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if voteResp.Granted || raft.getCurrentTerm() == 5 {
+		t.Fatalf("bad: %#v %d", voteResp, raft.getCurrentTerm())
+	}
+
+	// Once the store recovers the term is taken on
+	atomic.StoreInt32(&stable.fail, 0)
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !appendResp.Success || raft.getCurrentTerm() != 5 {
+		t.Fatalf("bad: %#v %d", appendResp, raft.getCurrentTerm())
+	}
+}
+
+func TestRaft_BootstrapCluster_TripleNode(t *testing.T) {
+	// Make a cluster that does not know about its peers
+	c := MakeClusterNoPeers(3, t, nil)
+	defer c.Close()
+
+	// Bootstrap fresh stores with the shared peer set
+	var peers []net.Addr
+	for _, r := range c.rafts {
+		peers = append(peers, r.localAddr)
+	}
+	for _, r := range c.rafts {
+		r.Shutdown().Error()
+	}
+	for i, r := range c.rafts {
+		store := NewInmemStore()
+		snap, _ := NewInmemSnapshotStore(3)
+		peerStore := &StaticPeers{}
+		if err := BootstrapCluster(r.conf, store, store, snap, peerStore, r.trans, peers); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		c.fsms[i] = &MockFSM{}
+		raft, err := NewRaft(r.conf, c.fsms[i], store, store, snap, peerStore, r.trans)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		c.rafts[i] = raft
+	}
+
+	// Should be able to apply
+	leader := c.Leader()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+}
+
 func TestRaft_TripleNode(t *testing.T) {
 	// Make the cluster
 	c := MakeCluster(3, t, nil)
@@ -1090,6 +1436,107 @@ func TestRaft_SnapshotRestore_PeerChange(t *testing.T) {
 	}
 }
 
+func TestRaft_RecoverCluster(t *testing.T) {
+	// Make the cluster
+	conf := inmemConfig()
+	conf.TrailingLogs = 10
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Commit some things, with a snapshot in the middle
+	leader := c.Leader()
+	for i := 0; i < 20; i++ {
+		if err := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := leader.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 20; i < 30; i++ {
+		if err := leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Lose every server
+	for _, r := range c.rafts {
+		if err := r.Shutdown().Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Recover the old leader as a single node cluster
+	r := leader
+	fsm := &MockFSM{}
+	peerStore := &StaticPeers{}
+	peers := []net.Addr{r.localAddr}
+	err := RecoverCluster(r.conf, fsm, r.logs, r.stable, r.snapshots, peerStore, r.trans, peers)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The FSM should have been replayed in full
+	if len(fsm.logs) != 30 {
+		t.Fatalf("bad: %d", len(fsm.logs))
+	}
+
+	// The log should be empty, with the peers in the snapshot
+	first, _ := r.logs.FirstIndex()
+	last, _ := r.logs.LastIndex()
+	if first != 0 || last != 0 {
+		t.Fatalf("bad: %d %d", first, last)
+	}
+	snaps, err := r.snapshots.List()
+	if err != nil || len(snaps) == 0 {
+		t.Fatalf("err: %v %v", err, snaps)
+	}
+	if got := decodePeers(snaps[0].Peers, r.trans); !reflect.DeepEqual(got, peers) {
+		t.Fatalf("bad: %v", got)
+	}
+	if got, _ := peerStore.Peers(); !reflect.DeepEqual(got, peers) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// Restart and make sure the server comes up as the leader
+	conf.EnableSingleNode = false
+	fsm = &MockFSM{}
+	r, err = NewRaft(conf, fsm, r.logs, r.stable, r.snapshots, peerStore, r.trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.rafts = []*Raft{r}
+	select {
+	case v := <-r.LeaderCh():
+		if !v {
+			t.Fatalf("should become leader")
+		}
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+	if err := r.Apply([]byte("test30"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fsm.Lock()
+	defer fsm.Unlock()
+	if len(fsm.logs) != 31 {
+		t.Fatalf("bad: %d", len(fsm.logs))
+	}
+}
+
+func TestRaft_RecoverCluster_NoState(t *testing.T) {
+	conf := inmemConfig()
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+
+	err := RecoverCluster(conf, &MockFSM{}, store, store, snap, &StaticPeers{}, trans,
+		[]net.Addr{addr})
+	if err == nil {
+		t.Fatalf("should refuse to recover without state")
+	}
+}
+
 func TestRaft_AutoSnapshot(t *testing.T) {
 	// Make the cluster
 	conf := inmemConfig()
@@ -1120,16 +1567,234 @@ func TestRaft_AutoSnapshot(t *testing.T) {
 	}
 }
 
-func TestRaft_SendSnapshotFollower(t *testing.T) {
-	// Make the cluster
+func TestRaft_Snapshot_LogBytesAfterIndex(t *testing.T) {
 	conf := inmemConfig()
-	conf.TrailingLogs = 10
-	c := MakeCluster(3, t, conf)
-	defer c.Close()
+	conf.SnapshotThreshold = 1 << 30
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+	addr2, trans2 := NewInmemTransport()
+	trans.Connect(addr2, trans2)
+	trans2.Connect(addr, trans)
+	fsm := &MockFSM{}
+	raft, err := NewRaft(conf, fsm, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
 
-	// Disconnect one follower
-	followers := c.GetInState(Follower)
-	behind := followers[0]
+	// Replicate four logs, but only commit the first two
+	var logs []*Log
+	for i := 1; i <= 4; i++ {
+		logs = append(logs, &Log{Index: uint64(i), Term: 1, Type: LogCommand, Data: make([]byte, 300)})
+	}
+	appendReq := &AppendEntriesRequest{
+		RPCHeader:         raft.getRPCHeader(),
+		Term:              1,
+		Leader:            trans2.EncodePeer(addr2),
+		Entries:           logs,
+		LeaderCommitIndex: 2,
+	}
+	var appendResp AppendEntriesResponse
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !appendResp.Success {
+		t.Fatalf("bad: %#v", appendResp)
+	}
+	for i := 0; ; i++ {
+		fsm.Lock()
+		applied := len(fsm.logs)
+		fsm.Unlock()
+		if applied == 2 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("bad: %d", applied)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The snapshot only covers the bytes of the logs it includes
+	if err := raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx := raft.getLastSnapshotIndex(); idx != 2 {
+		t.Fatalf("bad: %d", idx)
+	}
+	if n := raft.getSnapshotLogBytes(); n != 600 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestRaft_AutoSnapshot_LogBytesAndAge(t *testing.T) {
+	conf := inmemConfig()
+	conf.SnapshotInterval = 5 * time.Millisecond
+	conf.SnapshotThreshold = 1 << 30
+	conf.SnapshotLogBytesThreshold = 1000
+	conf.TrailingLogs = 10
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// A few huge logs should trigger a snapshot, a couple should not
+	apply := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := leader.Apply(make([]byte, 300), 0).Error(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+	apply(2)
+	time.Sleep(50 * time.Millisecond)
+	if snaps, _ := leader.snapshots.List(); len(snaps) != 0 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	apply(2)
+	time.Sleep(50 * time.Millisecond)
+	if snaps, _ := leader.snapshots.List(); len(snaps) != 1 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	if n := leader.getSnapshotLogBytes(); n >= 1000 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Once the last snapshot is old enough, any new log triggers one
+	rc := leader.ReloadableConfig()
+	rc.MaxSnapshotAge = 100 * time.Millisecond
+	if err := leader.ReloadConfig(rc).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reason := leader.shouldSnapshot(); reason != "" {
+		t.Fatalf("bad: %s", reason)
+	}
+	apply(1)
+	time.Sleep(200 * time.Millisecond)
+	if snaps, _ := leader.snapshots.List(); len(snaps) != 2 {
+		t.Fatalf("bad: %v", snaps)
+	}
+}
+
+// snapshotRequestingFSM asks for a snapshot when it applies an import
+type snapshotRequestingFSM struct {
+	MockFSM
+	request func(reason string)
+}
+
+func (s *snapshotRequestingFSM) SetSnapshotRequestFunc(request func(reason string)) {
+	s.request = request
+}
+
+func (s *snapshotRequestingFSM) Apply(log *Log) interface{} {
+	if string(log.Data) == "import" {
+		s.request("bulk import")
+	}
+	return s.MockFSM.Apply(log)
+}
+
+func TestRaft_AutoSnapshot_FSMRequest(t *testing.T) {
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	_, trans := NewInmemTransport()
+	fsm := &snapshotRequestingFSM{}
+	raft, err := NewRaft(conf, fsm, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	if fsm.request == nil {
+		t.Fatalf("request func not set")
+	}
+	select {
+	case <-raft.LeaderCh():
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+
+	// Regular logs don't snapshot, an import does
+	for _, data := range []string{"test", "import"} {
+		if err := raft.Apply([]byte(data), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	snaps, _ := snap.List()
+	if len(snaps) != 1 || snaps[0].Index != raft.getLastIndex() {
+		t.Fatalf("bad: %v", snaps)
+	}
+}
+
+func TestRaft_SnapshotWriteRate(t *testing.T) {
+	conf := inmemConfig()
+	conf.SnapshotWriteRate = 20 * 1024
+	c := MakeCluster(1, t, conf)
+	defer c.Close()
+	leader := c.Leader()
+
+	// Commit about 10KB
+	var future Future
+	for i := 0; i < 10; i++ {
+		future = leader.Apply(bytes.Repeat([]byte{'x'}, 1024), 0)
+	}
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Writing the snapshot is paced to the rate
+	start := time.Now()
+	if err := leader.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("too fast: %v", d)
+	}
+
+	// Lifting the limit at runtime takes effect
+	rc := leader.ReloadableConfig()
+	rc.SnapshotWriteRate = 0
+	if err := leader.ReloadConfig(rc).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	start = time.Now()
+	if err := leader.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("too slow: %v", d)
+	}
+
+	// Negative rates are rejected, as are rates too low for a transfer
+	// to finish before the transport times out
+	rc.SnapshotSendRate = -1
+	if err := leader.ReloadConfig(rc).Error(); err == nil {
+		t.Fatalf("should fail")
+	}
+	rc.SnapshotSendRate = MinSnapshotRate
+	if err := leader.ReloadConfig(rc).Error(); err == nil {
+		t.Fatalf("should fail")
+	}
+	rc.SnapshotSendRate = 0
+	rc.SnapshotReceiveRate = MinSnapshotRate - 1
+	if err := leader.ReloadConfig(rc).Error(); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestRaft_SendSnapshotFollower(t *testing.T) {
+	// Make the cluster
+	conf := inmemConfig()
+	conf.TrailingLogs = 10
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Disconnect one follower
+	followers := c.GetInState(Follower)
+	behind := followers[0]
 	c.Disconnect(behind.localAddr)
 
 	// Commit a lot of things
@@ -1159,6 +1824,204 @@ func TestRaft_SendSnapshotFollower(t *testing.T) {
 
 	// Ensure all the logs are the same
 	c.EnsureSame(t)
+
+	// The installed snapshot should keep the labels set by the leader
+	for i, r := range c.rafts {
+		if r != behind {
+			continue
+		}
+		snaps, _ := c.snaps[i].List()
+		if len(snaps) == 0 || snaps[0].Labels["logs"] != "100" {
+			t.Fatalf("bad: %v", snaps)
+		}
+	}
+}
+
+func TestRaft_SendSnapshotFollower_Queued(t *testing.T) {
+	// Make the cluster, sending one snapshot at a time
+	conf := inmemConfig()
+	conf.TrailingLogs = 10
+	conf.MaxConcurrentSnapshotSends = 1
+	c := MakeCluster(5, t, conf)
+	defer c.Close()
+
+	// Disconnect two followers
+	followers := c.GetInState(Follower)
+	c.Disconnect(followers[0].localAddr)
+	c.Disconnect(followers[1].localAddr)
+
+	// Commit a lot of things and snapshot, truncating the logs
+	leader := c.Leader()
+	var future Future
+	for i := 0; i < 100; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := leader.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Hold the only turn, so both sends have to queue
+	if !leader.snapshotSendQueue.acquire(true, nil, nil) {
+		t.Fatalf("should acquire")
+	}
+	c.FullyConnect()
+	for i := 0; ; i++ {
+		stats := leader.Stats()
+		if stats["snapshot_sends_active"] == "1" && stats["snapshot_sends_queued"] == "2" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("bad: %v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Both get their snapshot in turn once we let go
+	leader.snapshotSendQueue.release()
+	c.EnsureSame(t)
+	if stats := leader.Stats(); stats["snapshot_sends_queued"] != "0" {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+// behindWithPeerSnapshot sets up a cluster where one follower has to
+// install a snapshot, which the other follower has too. It returns the
+// cluster, the source follower and the follower that is behind.
+func behindWithPeerSnapshot(t *testing.T) (*cluster, *Raft, *Raft) {
+	conf := inmemConfig()
+	conf.TrailingLogs = 10
+	conf.PeerSnapshotSourcing = true
+	c := MakeCluster(3, t, conf)
+
+	// Wait until we have 2 followers, and disconnect one
+	leader := c.Leader()
+	limit := time.Now().Add(200 * time.Millisecond)
+	followers := c.GetInState(Follower)
+	for time.Now().Before(limit) && len(followers) != 2 {
+		time.Sleep(10 * time.Millisecond)
+		followers = c.GetInState(Follower)
+	}
+	if len(followers) != 2 {
+		c.Close()
+		t.Fatalf("expected two followers: %v", followers)
+	}
+	source, behind := followers[0], followers[1]
+	c.Disconnect(behind.localAddr)
+
+	// Commit a lot of things
+	var future Future
+	for i := 0; i < 100; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	if err := future.Error(); err != nil {
+		c.Close()
+		t.Fatalf("err: %v", err)
+	}
+
+	// Snapshot the leader and the source, once it applied everything,
+	// this will truncate logs!
+	for i := 0; source.getLastApplied() != leader.getLastApplied(); i++ {
+		if i == 100 {
+			c.Close()
+			t.Fatalf("source did not catch up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, r := range []*Raft{leader, source} {
+		if err := r.Snapshot().Error(); err != nil {
+			c.Close()
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Wait for the source to advertise its snapshot
+	for i := 0; ; i++ {
+		picked := leader.pickSnapshotSource(nil, leader.getLatestSnapshot().Index)
+		if picked != nil && picked.peer.String() == source.localAddr.String() {
+			break
+		}
+		if i == 100 {
+			c.Close()
+			t.Fatalf("source not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c, source, behind
+}
+
+func TestRaft_SendSnapshotFollower_FromPeer(t *testing.T) {
+	c, source, behind := behindWithPeerSnapshot(t)
+	defer c.Close()
+	leader := c.Leader()
+
+	// A fetch must match the index and term of the snapshot
+	snap := source.getLatestSnapshot()
+	var resp FetchSnapshotResponse
+	args := &FetchSnapshotRequest{ID: snap.ID, LastLogIndex: snap.Index, LastLogTerm: snap.Term + 1}
+	if _, err := leader.trans.FetchSnapshot(source.localAddr, args, &resp); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// Truncate the snapshot of the leader, so the behind node can only
+	// catch up with the snapshot of the source
+	for i, r := range c.rafts {
+		if r != leader {
+			continue
+		}
+		c.snaps[i].l.Lock()
+		for _, sink := range c.snaps[i].snapshots {
+			if sink.meta.ID == leader.getLatestSnapshot().ID {
+				sink.contents.Truncate(0)
+			}
+		}
+		c.snaps[i].l.Unlock()
+	}
+
+	// Reconnect the behind node
+	c.FullyConnect()
+
+	// Ensure all the logs are the same
+	c.EnsureSame(t)
+	if got := behind.getLatestSnapshot(); got.Index != snap.Index || got.Term != snap.Term {
+		t.Fatalf("bad: %#v %#v", got, snap)
+	}
+}
+
+func TestRaft_SendSnapshotFollower_FromPeerFallback(t *testing.T) {
+	c, source, behind := behindWithPeerSnapshot(t)
+	defer c.Close()
+
+	// Reconnect the behind node, except to the source, so it falls back
+	// to the snapshot of the leader
+	c.FullyConnect()
+	for i, r := range c.rafts {
+		if r == behind {
+			c.trans[i].Disconnect(source.localAddr)
+		}
+	}
+
+	// Ensure all the logs are the same
+	c.EnsureSame(t)
+}
+
+func TestRaft_SendSnapshotFollower_FromPeerUnheard(t *testing.T) {
+	c, _, behind := behindWithPeerSnapshot(t)
+	defer c.Close()
+	leader := c.Leader()
+
+	// A follower that has not responded yet may be too old to fetch from
+	// a peer, so the leader must send the snapshot itself
+	s := &followerReplication{
+		peer:            behind.localAddr,
+		currentTerm:     leader.getCurrentTerm(),
+		protocolVersion: ProtocolVersionMin,
+	}
+	if stop, ok := leader.sendSnapshotFromPeer(s); stop || ok {
+		t.Fatalf("should not use a peer before the follower responds")
+	}
 }
 
 func TestRaft_ReJoinFollower(t *testing.T) {
@@ -1373,7 +2236,9 @@ func TestRaft_VerifyLeader_Fail(t *testing.T) {
 
 	// Force follower to different term
 	follower := followers[0]
-	follower.setCurrentTerm(follower.getCurrentTerm() + 1)
+	if err := follower.setCurrentTerm(follower.getCurrentTerm() + 1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
 	// Verify we are leader
 	verify := leader.VerifyLeader()
@@ -1423,28 +2288,853 @@ func TestRaft_VerifyLeader_ParitalConnect(t *testing.T) {
 	}
 }
 
-func TestRaft_SettingPeers(t *testing.T) {
-	// Make the cluster
-	c := MakeClusterNoPeers(3, t, nil)
+func TestRaft_ReloadConfig(t *testing.T) {
+	conf := inmemConfig()
+	c := MakeCluster(1, t, conf)
 	defer c.Close()
+	raft := c.rafts[0]
 
-	peers := make([]net.Addr, 0)
-	for _, v := range c.rafts {
-		peers = append(peers, v.localAddr)
+	// Make sure the reloadable values match the config
+	rc := raft.ReloadableConfig()
+	if rc.HeartbeatTimeout != conf.HeartbeatTimeout ||
+		rc.MaxAppendEntries != conf.MaxAppendEntries {
+		t.Fatalf("bad: %#v", rc)
+	}
+
+	// Reload with new values
+	rc.TrailingLogs = 5
+	rc.SnapshotThreshold = 10
+	rc.SnapshotInterval = 10 * time.Millisecond
+	rc.HeartbeatTimeout = 60 * time.Millisecond
+	rc.ElectionTimeout = 70 * time.Millisecond
+	rc.MaxAppendEntries = 16
+	if err := raft.ReloadConfig(rc).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := raft.ReloadableConfig(); out != rc {
+		t.Fatalf("bad: %#v", out)
 	}
 
-	for _, v := range c.rafts {
-		future := v.SetPeers(peers)
-		if err := future.Error(); err != nil {
-			t.Fatalf("error setting peers: %v", err)
-		}
+	// The caller's config must not be changed
+	if conf.TrailingLogs == 5 {
+		t.Fatalf("should not modify caller config")
 	}
 
-	// Wait a while
-	time.Sleep(20 * time.Millisecond)
+	// Invalid values should be rejected without changes
+	bad := rc
+	bad.MaxAppendEntries = 0
+	if err := raft.ReloadConfig(bad).Error(); err == nil {
+		t.Fatalf("should fail")
+	}
+	if out := raft.ReloadableConfig(); out != rc {
+		t.Fatalf("bad: %#v", out)
+	}
 
-	// Should have a new leader
-	if leader := c.Leader(); leader == nil {
-		t.Fatalf("no leader?")
+	// The new snapshot settings should take effect
+	leader := c.Leader()
+	var future Future
+	for i := 0; i < 20; i++ {
+		future = leader.Apply([]byte(fmt.Sprintf("test%d", i)), 0)
+	}
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if snaps, _ := leader.snapshots.List(); len(snaps) == 0 {
+		t.Fatalf("should have a snapshot")
+	}
+}
+
+func TestRaft_ProtocolVersion_RejectNewer(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	raft := c.rafts[0]
+
+	// Send an RPC from the future
+	respCh := make(chan RPCResponse, 1)
+	raft.processRPC(RPC{
+		Command: &RequestVoteRequest{
+			RPCHeader: RPCHeader{
+				ProtocolVersion: ProtocolVersionMax + 1,
+			},
+			Term:      raft.getCurrentTerm() + 1,
+			Candidate: []byte("future"),
+		},
+		RespChan: respCh,
+	})
+	resp := <-respCh
+	if resp.Error != ErrUnsupportedProtocol {
+		t.Fatalf("err: %v", resp.Error)
+	}
+}
+
+func TestRaft_ProtocolVersion_Mixed(t *testing.T) {
+	// Run the whole cluster at the oldest version
+	conf := inmemConfig()
+	conf.ProtocolVersion = ProtocolVersionMin
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Upgrade a follower's speaking version
+	leader := c.Leader()
+	for _, r := range c.rafts {
+		if r != leader {
+			newConf := *r.config()
+			newConf.ProtocolVersion = ProtocolVersionMax
+			r.setConfig(&newConf)
+			break
+		}
+	}
+
+	// Should be able to apply
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+
+	// The leader stats should reflect its own version
+	if v := leader.Stats()["protocol_version"]; v != fmt.Sprintf("%d", ProtocolVersionMin) {
+		t.Fatalf("bad: %v", v)
+	}
+}
+
+func TestRaft_ElectionPriority_Transfer(t *testing.T) {
+	// Make the cluster with every server at a low priority
+	conf := inmemConfig()
+	conf.ElectionPriority = 1
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Prefer one of the followers
+	leader := c.Leader()
+	var preferred *Raft
+	for _, r := range c.rafts {
+		if r != leader {
+			preferred = r
+			break
+		}
+	}
+	newConf := *preferred.config()
+	newConf.ElectionPriority = MaxElectionPriority
+	preferred.setConfig(&newConf)
+
+	// Keep replicating so the leader learns the new priority
+	for i := 0; i < 10; i++ {
+		if err := c.Leader().Apply([]byte("test"), 0).Error(); err != nil && err != ErrLeadershipLost && err != ErrNotLeader {
+			t.Fatalf("err: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The preferred server should have taken over
+	if l := c.Leader(); l != preferred {
+		t.Fatalf("bad: %v %v", l, preferred)
+	}
+	c.EnsureSame(t)
+}
+
+func TestRaft_TimeoutNow(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Let the cluster settle
+	leader := c.Leader()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+
+	// Ask a follower to start an election
+	var follower *Raft
+	for _, r := range c.rafts {
+		if r != leader {
+			follower = r
+			break
+		}
+	}
+
+	// Requests not from the current leader, or for another term, are
+	// ignored
+	var other *Raft
+	for _, r := range c.rafts {
+		if r != leader && r != follower {
+			other = r
+		}
+	}
+	bad := []*TimeoutNowRequest{
+		{
+			RPCHeader: other.getRPCHeader(),
+			Term:      leader.getCurrentTerm(),
+			Leader:    other.trans.EncodePeer(other.localAddr),
+		},
+		{
+			RPCHeader: leader.getRPCHeader(),
+			Term:      leader.getCurrentTerm() + 1,
+			Leader:    leader.trans.EncodePeer(leader.localAddr),
+		},
+	}
+	for _, req := range bad {
+		var resp TimeoutNowResponse
+		if err := other.trans.TimeoutNow(follower.localAddr, req, &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if l := c.Leader(); l != leader {
+		t.Fatalf("bad: %v %v", l, leader)
+	}
+
+	req := &TimeoutNowRequest{
+		RPCHeader: leader.getRPCHeader(),
+		Term:      leader.getCurrentTerm(),
+		Leader:    leader.trans.EncodePeer(leader.localAddr),
+	}
+	var resp TimeoutNowResponse
+	if err := leader.trans.TimeoutNow(follower.localAddr, req, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The follower should win, since its log is up to date
+	time.Sleep(100 * time.Millisecond)
+	if l := c.Leader(); l != follower {
+		t.Fatalf("bad: %v %v", l, follower)
+	}
+	if follower.getCurrentTerm() <= req.Term {
+		t.Fatalf("expected newer term! %d %d", follower.getCurrentTerm(), req.Term)
+	}
+}
+
+func TestRaft_FollowerTimeout_Priority(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+	raft := c.rafts[0]
+
+	// The highest priority waits the least
+	base := raft.config().HeartbeatTimeout
+	if to := raft.followerTimeout(); to != base {
+		t.Fatalf("bad: %v", to)
+	}
+
+	newConf := *raft.config()
+	newConf.ElectionPriority = 0
+	raft.setConfig(&newConf)
+	if to := raft.followerTimeout(); to != 2*base {
+		t.Fatalf("bad: %v", to)
+	}
+
+	// Out of range priorities are rejected
+	newConf.ElectionPriority = MaxElectionPriority + 1
+	if err := ValidateConfig(&newConf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRaft_LogCRC(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	leader := c.Leader()
+	if err := leader.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+
+	// The leader should have checksummed the log
+	idx := leader.getLastIndex()
+	var l Log
+	if err := leader.logs.GetLog(idx, &l); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if l.CRC == 0 || l.verifyCRC() != nil {
+		t.Fatalf("bad: %#v", l)
+	}
+
+	// Send a follower a log that was corrupted in transit
+	var follower *Raft
+	for _, r := range c.rafts {
+		if r != leader {
+			follower = r
+			break
+		}
+	}
+	bad := &Log{Index: idx + 1, Term: l.Term, Type: LogCommand, Data: []byte("test")}
+	bad.setCRC()
+	bad.Data = []byte("tost")
+	req := &AppendEntriesRequest{
+		RPCHeader:         leader.getRPCHeader(),
+		Term:              leader.getCurrentTerm(),
+		Leader:            leader.trans.EncodePeer(leader.localAddr),
+		PrevLogEntry:      idx,
+		PrevLogTerm:       l.Term,
+		Entries:           []*Log{bad},
+		LeaderCommitIndex: leader.getCommitIndex(),
+	}
+	var resp AppendEntriesResponse
+	if err := leader.trans.AppendEntries(follower.localAddr, req, &resp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Success {
+		t.Fatalf("should reject corrupt log")
+	}
+	if last := follower.getLastIndex(); last != idx {
+		t.Fatalf("bad: %d", last)
+	}
+}
+
+func TestRaft_CorruptLog_NoVote(t *testing.T) {
+	conf := inmemConfig()
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	fsm := &MockFSM{}
+	addr, trans := NewInmemTransport()
+	addr2, trans2 := NewInmemTransport()
+	trans.Connect(addr2, trans2)
+	trans2.Connect(addr, trans)
+	raft, err := NewRaft(conf, fsm, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+
+	// Replicate some logs, without committing them yet
+	var logs []*Log
+	for i := 1; i <= 5; i++ {
+		l := &Log{Index: uint64(i), Term: 1, Type: LogCommand, Data: []byte(fmt.Sprintf("test %d", i))}
+		l.setCRC()
+		logs = append(logs, l)
+	}
+	appendReq := &AppendEntriesRequest{
+		RPCHeader: raft.getRPCHeader(),
+		Term:      1,
+		Leader:    trans2.EncodePeer(addr2),
+		Entries:   logs,
+	}
+	var appendResp AppendEntriesResponse
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !appendResp.Success {
+		t.Fatalf("bad: %#v", appendResp)
+	}
+
+	// Corrupt a log on disk, and commit them all
+	var stored Log
+	store.GetLog(3, &stored)
+	stored.Data = []byte("tost 3")
+	store.StoreLog(&stored)
+	appendReq = &AppendEntriesRequest{
+		RPCHeader:         raft.getRPCHeader(),
+		Term:              1,
+		Leader:            trans2.EncodePeer(addr2),
+		PrevLogEntry:      5,
+		PrevLogTerm:       1,
+		LeaderCommitIndex: 5,
+	}
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if appendResp.Success || appendResp.LastLog != 2 {
+		t.Fatalf("bad: %#v", appendResp)
+	}
+	if idx, _ := store.GetUint64(keyLogRestoreIndex); idx != 5 {
+		t.Fatalf("bad: %d", idx)
+	}
+
+	// The follower acknowledged logs it no longer has, so it must not
+	// vote for a candidate whose log is only as long as its own now
+	voteReq := &RequestVoteRequest{
+		RPCHeader:          raft.getRPCHeader(),
+		Term:               2,
+		Candidate:          trans2.EncodePeer(NewInmemAddr()),
+		LastLogIndex:       2,
+		LastLogTerm:        1,
+		LeadershipTransfer: true,
+	}
+	var voteResp RequestVoteResponse
+	if err := trans2.RequestVote(addr, voteReq, &voteResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if voteResp.Granted {
+		t.Fatalf("should not grant vote")
+	}
+
+	// Once the leader sent the logs again it votes again
+	appendReq = &AppendEntriesRequest{
+		RPCHeader:         raft.getRPCHeader(),
+		Term:              2,
+		Leader:            trans2.EncodePeer(addr2),
+		PrevLogEntry:      2,
+		PrevLogTerm:       1,
+		Entries:           logs[2:],
+		LeaderCommitIndex: 5,
+	}
+	if err := trans2.AppendEntries(addr, appendReq, &appendResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !appendResp.Success {
+		t.Fatalf("bad: %#v", appendResp)
+	}
+	if idx, _ := store.GetUint64(keyLogRestoreIndex); idx != 0 {
+		t.Fatalf("bad: %d", idx)
+	}
+	var applied int
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		fsm.Lock()
+		applied = len(fsm.logs)
+		fsm.Unlock()
+		if applied == 5 {
+			break
+		}
+	}
+	if applied != 5 {
+		t.Fatalf("bad: %d", applied)
+	}
+	voteReq.Term = 3
+	voteReq.LastLogIndex = 5
+	if err := trans2.RequestVote(addr, voteReq, &voteResp); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !voteResp.Granted {
+		t.Fatalf("should grant vote")
+	}
+}
+
+func TestRaft_ReplicationCompression(t *testing.T) {
+	conf := inmemConfig()
+	conf.ReplicationCompressionThreshold = 64
+	c := MakeCluster(3, t, conf)
+	defer c.Close()
+
+	// Replicate a compressible log
+	leader := c.Leader()
+	big := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	if err := leader.Apply(big, 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+
+	// Followers should have stored plain data
+	idx := leader.getLastIndex()
+	for _, r := range c.rafts {
+		var l Log
+		if err := r.logs.GetLog(idx, &l); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if l.Codec != LogCodecNone || !bytes.Equal(l.Data, big) {
+			t.Fatalf("bad: %#v", l)
+		}
+	}
+
+	// Entries should only be compressed for followers that support it
+	s := &followerReplication{}
+	req := &AppendEntriesRequest{Entries: []*Log{&Log{Index: 1, Data: big}}}
+	leader.compressEntries(s, req)
+	if req.Entries[0].Codec != LogCodecNone {
+		t.Fatalf("should not compress for an old follower")
+	}
+	s.setProtocolVersion(RPCHeader{ProtocolVersion: 3})
+	leader.compressEntries(s, req)
+	if req.Entries[0].Codec != LogCodecFlate || len(req.Entries[0].Data) >= len(big) {
+		t.Fatalf("should compress: %#v", req.Entries[0])
+	}
+}
+
+func TestRaft_ReplicationCompression_FirstBatch(t *testing.T) {
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	conf.ProtocolVersion = 3
+	conf.ReplicationCompressionThreshold = 64
+	conf.HeartbeatTimeout = 500 * time.Millisecond
+	conf.ElectionTimeout = 500 * time.Millisecond
+	conf.LeaderLeaseTimeout = 500 * time.Millisecond
+	store := NewInmemStore()
+	snap, _ := NewInmemSnapshotStore(3)
+	addr, trans := NewInmemTransport()
+	addr2, trans2 := NewInmemTransport()
+	trans.Connect(addr2, trans2)
+	trans2.Connect(addr, trans)
+	raft, err := NewRaft(conf, &MockFSM{}, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	for start := time.Now(); raft.State() != Leader; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("no leader")
+		}
+	}
+
+	// An old follower that never answers, so the leader has not heard
+	// its version when it sends the first batch with a large log
+	codecCh := make(chan LogCodec, 1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		for {
+			select {
+			case rpc := <-trans2.Consumer():
+				req, ok := rpc.Command.(*AppendEntriesRequest)
+				if !ok {
+					continue
+				}
+				for _, l := range req.Entries {
+					if l.Type == LogCommand {
+						codecCh <- l.Codec
+						return
+					}
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	raft.AddPeer(addr2)
+	big := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+	raft.Apply(big, 0)
+
+	select {
+	case codec := <-codecCh:
+		if codec != LogCodecNone {
+			t.Fatalf("should not compress before the follower responds")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestRaft_SettingPeers(t *testing.T) {
+	// Make the cluster
+	c := MakeClusterNoPeers(3, t, nil)
+	defer c.Close()
+
+	peers := make([]net.Addr, 0)
+	for _, v := range c.rafts {
+		peers = append(peers, v.localAddr)
+	}
+
+	for _, v := range c.rafts {
+		future := v.SetPeers(peers)
+		if err := future.Error(); err != nil {
+			t.Fatalf("error setting peers: %v", err)
+		}
+	}
+
+	// Wait a while
+	time.Sleep(20 * time.Millisecond)
+
+	// Should have a new leader
+	if leader := c.Leader(); leader == nil {
+		t.Fatalf("no leader?")
+	}
+}
+
+func TestRaft_UserRestore(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+
+	// Commit some things
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		if err := leader.Apply([]byte(fmt.Sprintf("test %d", i)), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Build an external snapshot
+	var restored [][]byte
+	for i := 0; i < 5; i++ {
+		restored = append(restored, []byte(fmt.Sprintf("restored %d", i)))
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(restored); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := &SnapshotMeta{Index: 3, Term: 1, Size: int64(buf.Len())}
+
+	// Only the leader can restore
+	for _, r := range c.GetInState(Follower) {
+		if err := r.Restore(meta, bytes.NewReader(buf.Bytes()), 0); err != ErrNotLeader {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// A short snapshot should be refused
+	short := &SnapshotMeta{Size: meta.Size + 1}
+	if err := leader.Restore(short, bytes.NewReader(buf.Bytes()), 0); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Restore and check the index moved past the log
+	lastIndex := leader.getLastIndex()
+	if err := leader.Restore(meta, bytes.NewReader(buf.Bytes()), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snaps, _ := leader.snapshots.List()
+	if len(snaps) == 0 || snaps[0].Index != lastIndex+1 {
+		t.Fatalf("bad: %v", snaps)
+	}
+	if idx := leader.getLastSnapshotIndex(); idx != lastIndex+1 {
+		t.Fatalf("bad: %d", idx)
+	}
+
+	// Every node should have the restored state, and keep going
+	if err := leader.Apply([]byte("after"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.EnsureSame(t)
+	expect := append(restored, []byte("after"))
+	for i, fsm := range c.fsms {
+		fsm.Lock()
+		if !reflect.DeepEqual(fsm.logs, expect) {
+			t.Fatalf("fsm %d bad: %q", i, fsm.logs)
+		}
+		fsm.Unlock()
+	}
+}
+
+func TestRaft_SnapshotOpen_Backup(t *testing.T) {
+	c := MakeCluster(1, t, nil)
+	defer c.Close()
+
+	// Commit some things
+	leader := c.Leader()
+	for i := 0; i < 10; i++ {
+		if err := leader.Apply([]byte(fmt.Sprintf("test %d", i)), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Take a snapshot and back it up
+	future := leader.Snapshot()
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.Index != leader.getLastSnapshotIndex() {
+		t.Fatalf("bad: %v", meta)
+	}
+	var backup bytes.Buffer
+	err = ExportSnapshot(&backup, meta, r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Restore the backup into another cluster
+	c2 := MakeCluster(3, t, nil)
+	defer c2.Close()
+	meta, state, err := OpenSnapshotArchive(&backup)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c2.Leader().Restore(meta, state, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c2.EnsureSame(t)
+	for i, fsm := range c2.fsms {
+		fsm.Lock()
+		if len(fsm.logs) != 10 || string(fsm.logs[9]) != "test 9" {
+			t.Fatalf("fsm %d bad: %q", i, fsm.logs)
+		}
+		fsm.Unlock()
+	}
+}
+
+func TestRaft_IncrementalSnapshot(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	conf.MaxSnapshotDeltas = 2
+	store := NewInmemStore()
+	_, trans := NewInmemTransport()
+	fsm := &MockIncrementalFSM{}
+	raft, err := NewRaft(conf, fsm, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	select {
+	case <-raft.LeaderCh():
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+
+	// Take a full snapshot, then deltas up to the limit, and then a full
+	// snapshot again
+	for i, deltas := range []int{0, 1, 2, 0} {
+		for j := 0; j < 5; j++ {
+			if err := raft.Apply([]byte(fmt.Sprintf("test %d", i*5+j)), 0).Error(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if err := raft.Snapshot().Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		snaps, _ := snap.List()
+		if n, _ := snap.ChainLength(snaps[0].ID); n != deltas {
+			t.Fatalf("snapshot %d: bad chain length: %d", i, n)
+		}
+	}
+
+	// Add a delta on top, and check that a restart restores the chain
+	for j := 0; j < 5; j++ {
+		if err := raft.Apply([]byte(fmt.Sprintf("test %d", 20+j)), 0).Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := raft.Snapshot().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := raft.Shutdown().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	fsm2 := &MockIncrementalFSM{}
+	_, trans2 := NewInmemTransport()
+	raft2, err := NewRaft(conf, fsm2, NewInmemStore(), store, snap, &StaticPeers{}, trans2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft2.Shutdown()
+	fsm2.Lock()
+	defer fsm2.Unlock()
+	if len(fsm2.logs) != 25 {
+		t.Fatalf("bad: %q", fsm2.logs)
+	}
+	for i, log := range fsm2.logs {
+		if string(log) != fmt.Sprintf("test %d", i) {
+			t.Fatalf("bad: %q", fsm2.logs)
+		}
+	}
+}
+
+// versionedIncrementalFSM is a MockIncrementalFSM with a schema version
+// that can be upgraded
+type versionedIncrementalFSM struct {
+	MockIncrementalFSM
+	version int
+}
+
+func (v *versionedIncrementalFSM) SnapshotSchemaVersion() int {
+	v.Lock()
+	defer v.Unlock()
+	return v.version
+}
+
+func (v *versionedIncrementalFSM) CheckSnapshotSchema(version int) error {
+	v.Lock()
+	defer v.Unlock()
+	if version > v.version {
+		return fmt.Errorf("newer than %d", v.version)
+	}
+	return nil
+}
+
+func TestRaft_IncrementalSnapshot_SchemaChange(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	conf.MaxSnapshotDeltas = 2
+	store := NewInmemStore()
+	_, trans := NewInmemTransport()
+	fsm := &versionedIncrementalFSM{}
+	raft, err := NewRaft(conf, fsm, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	select {
+	case <-raft.LeaderCh():
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+
+	// Take a full snapshot, then upgrade the schema before the next one,
+	// which must be full as well
+	for i, deltas := range []int{0, 0, 1} {
+		if i == 1 {
+			fsm.Lock()
+			fsm.version = 1
+			fsm.Unlock()
+		}
+		for j := 0; j < 5; j++ {
+			if err := raft.Apply([]byte(fmt.Sprintf("test %d", i*5+j)), 0).Error(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if err := raft.Snapshot().Error(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		snaps, _ := snap.List()
+		if n, _ := snap.ChainLength(snaps[0].ID); n != deltas {
+			t.Fatalf("snapshot %d: bad chain length: %d", i, n)
+		}
+		if snaps[0].Header.SchemaVersion != fsm.SnapshotSchemaVersion() {
+			t.Fatalf("snapshot %d: bad: %v", i, snaps[0].Header)
+		}
+	}
+}
+
+func TestRaft_SnapshotHeader(t *testing.T) {
+	dir, snap := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+
+	conf := inmemConfig()
+	conf.EnableSingleNode = true
+	store := NewInmemStore()
+	addr, trans := NewInmemTransport()
+	raft, err := NewRaft(conf, &versionedTestFSM{version: 2}, store, store, snap, &StaticPeers{}, trans)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer raft.Shutdown()
+	select {
+	case <-raft.LeaderCh():
+	case <-time.After(conf.HeartbeatTimeout * 3):
+		t.Fatalf("timeout becoming leader")
+	}
+	if err := raft.Apply([]byte("test"), 0).Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The snapshot should describe itself
+	future := raft.Snapshot()
+	if err := future.Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state, _ := ioutil.ReadAll(r)
+	r.Close()
+	header := meta.Header
+	if header.FormatVersion != SnapshotFormatVersion || header.SchemaVersion != 2 ||
+		header.NodeID != addr.String() || time.Since(header.Created) > time.Minute {
+		t.Fatalf("bad: %v", header)
+	}
+
+	// A snapshot with a newer schema is refused up front
+	meta.Header.SchemaVersion = 3
+	err = raft.Restore(meta, bytes.NewReader(state), 0)
+	if err == nil || !strings.Contains(err.Error(), "schema version 3") {
+		t.Fatalf("err: %v", err)
+	}
+	if err := raft.Shutdown().Error(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A node whose FSM is older can't start from the snapshot
+	_, trans2 := NewInmemTransport()
+	_, err = NewRaft(conf, &versionedTestFSM{version: 1}, store, store, snap, &StaticPeers{}, trans2)
+	if err == nil {
+		t.Fatalf("expected error")
 	}
 }
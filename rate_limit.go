@@ -0,0 +1,151 @@
+package raft
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleChunk is the most a throttled stream moves at once, so a
+	// new rate takes effect quickly
+	throttleChunk = 32 * 1024
+
+	// throttleBurst is how long a throttled stream may run at full speed
+	// after being idle, and caps how far behind the rate it may fall
+	throttleBurst = 100 * time.Millisecond
+
+	// throttleSlice is the longest a throttled stream sleeps before it
+	// reads the rate again
+	throttleSlice = 10 * time.Millisecond
+)
+
+// rateLimiter paces byte streams to a rate in bytes per second, using a
+// token bucket. A limiter shared by several streams caps their combined
+// rate. The rate is read on every use, so it can be changed at any time,
+// and zero is unlimited.
+type rateLimiter struct {
+	rate func() int64
+
+	l      sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate func() int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// chunk returns how much of n bytes to move at once
+func (r *rateLimiter) chunk(n int) int {
+	limit := throttleChunk
+	if rate := r.rate(); rate > 0 && rate/10 < int64(limit) {
+		limit = int(rate / 10)
+		if limit < 1 {
+			limit = 1
+		}
+	}
+	if n > limit {
+		return limit
+	}
+	return n
+}
+
+// wait blocks until n more bytes may pass. Bytes pass once the bucket
+// is no longer in debt, and the rate is read again after every slice of
+// sleep, so a new rate applies to streams that are already waiting.
+func (r *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	for {
+		rate := r.rate()
+		if rate <= 0 {
+			return
+		}
+
+		r.l.Lock()
+		now := time.Now()
+		if r.last.IsZero() {
+			r.last = now
+		}
+		r.tokens += now.Sub(r.last).Seconds() * float64(rate)
+		r.last = now
+
+		// Debt run up at a higher rate is capped, so lowering the rate
+		// doesn't stall streams for long
+		burst := float64(rate) * throttleBurst.Seconds()
+		if r.tokens > burst {
+			r.tokens = burst
+		} else if r.tokens < -burst {
+			r.tokens = -burst
+		}
+		if r.tokens >= 0 {
+			r.tokens -= float64(n)
+			r.l.Unlock()
+			return
+		}
+		delay := time.Duration(-r.tokens / float64(rate) * float64(time.Second))
+		r.l.Unlock()
+
+		if delay > throttleSlice {
+			delay = throttleSlice
+		}
+		time.Sleep(delay)
+	}
+}
+
+// throttledReader paces reads through a rate limiter
+type throttledReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func newThrottledReader(reader io.Reader, limiter *rateLimiter) io.Reader {
+	return &throttledReader{reader: reader, limiter: limiter}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.reader.Read(p[:t.limiter.chunk(len(p))])
+	t.limiter.wait(n)
+	return n, err
+}
+
+// throttledSnapshotSink paces writes to a snapshot through a rate limiter
+type throttledSnapshotSink struct {
+	SnapshotSink
+	limiter *rateLimiter
+}
+
+func newThrottledSnapshotSink(sink SnapshotSink, limiter *rateLimiter) SnapshotSink {
+	return &throttledSnapshotSink{SnapshotSink: sink, limiter: limiter}
+}
+
+func (t *throttledSnapshotSink) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := t.limiter.chunk(len(p))
+		t.limiter.wait(n)
+		n, err := t.SnapshotSink.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// SetHeader records the header in the wrapped sink if it can.
+func (t *throttledSnapshotSink) SetHeader(header SnapshotHeader) {
+	if sink, ok := t.SnapshotSink.(SnapshotHeaderSink); ok {
+		sink.SetHeader(header)
+	}
+}
+
+// SetLabel records a label in the wrapped sink if it can.
+func (t *throttledSnapshotSink) SetLabel(key, value string) {
+	if sink, ok := t.SnapshotSink.(SnapshotLabelSink); ok {
+		sink.SetLabel(key, value)
+	}
+}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var rate int64
+	limiter := newRateLimiter(func() int64 { return atomic.LoadInt64(&rate) })
+	data := make([]byte, 50*1024)
+
+	// Unlimited by default
+	start := time.Now()
+	if _, err := ioutil.ReadAll(newThrottledReader(bytes.NewReader(data), limiter)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("too slow: %v", d)
+	}
+
+	// 50KB at 100KB/s, less the burst, takes at least 400ms
+	atomic.StoreInt64(&rate, 100*1024)
+	start = time.Now()
+	out, err := ioutil.ReadAll(newThrottledReader(bytes.NewReader(data), limiter))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("bad data")
+	}
+	if d := time.Since(start); d < 350*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("bad duration: %v", d)
+	}
+
+	// Lifting the limit speeds up a stream already underway
+	atomic.StoreInt64(&rate, 10*1024)
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		var out bytes.Buffer
+		sink := newThrottledSnapshotSink(&bufferSink{&out}, limiter)
+		if n, err := sink.Write(data); err != nil || n != len(data) {
+			t.Errorf("err: %d %v", n, err)
+		}
+		done <- time.Since(start)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt64(&rate, 0)
+	select {
+	case d := <-done:
+		if d > 2*time.Second {
+			t.Fatalf("too slow: %v", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Lowering the limit doesn't charge what was sent at the old rate at
+	// the new one
+	atomic.StoreInt64(&rate, 1024*1024)
+	go func() {
+		start := time.Now()
+		limiter.wait(256 * 1024)
+		limiter.wait(256 * 1024)
+		done <- time.Since(start)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt64(&rate, 1024)
+	select {
+	case d := <-done:
+		if d > time.Second {
+			t.Fatalf("too slow: %v", d)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
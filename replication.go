@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"compress/flate"
 	"errors"
 	"fmt"
 	"net"
@@ -33,6 +34,10 @@ type followerReplication struct {
 	stopCh    chan uint64
 	triggerCh chan struct{}
 
+	// stoppedCh is closed along with stopCh, for waits which must not
+	// take the index from stopCh
+	stoppedCh chan struct{}
+
 	currentTerm uint64
 	matchIndex  uint64
 	nextIndex   uint64
@@ -53,6 +58,33 @@ type followerReplication struct {
 	// allowPipeline is used to control it seems like
 	// pipeline replication should be enabled
 	allowPipeline bool
+
+	// transferCh is used to indicate to the leader that this follower
+	// is caught up and preferred as leader
+	transferCh chan *followerReplication
+
+	// protocolVersion and priority are the last values advertised
+	// by the follower in a response. Until it has responded, the
+	// follower is assumed to speak ProtocolVersionMin.
+	protocolVersion ProtocolVersion
+	priority        int
+	infoLock        sync.RWMutex
+
+	// voter is false once the follower is being removed from the peers
+	voter bool
+
+	// snapshot is the newest snapshot the follower advertised
+	snapshot snapshotInfo
+}
+
+// stop ends replication to the follower, after a best effort to
+// replicate up to the given index if it is not zero
+func (s *followerReplication) stop(index uint64) {
+	if index > 0 {
+		s.stopCh <- index
+	}
+	close(s.stopCh)
+	close(s.stoppedCh)
 }
 
 // notifyAll is used to notify all the waiting verify futures
@@ -85,6 +117,71 @@ func (s *followerReplication) setLastContact() {
 	s.lastContactLock.Unlock()
 }
 
+// ProtocolVersion returns the last protocol version seen from the follower
+func (s *followerReplication) ProtocolVersion() ProtocolVersion {
+	s.infoLock.RLock()
+	v := s.protocolVersion
+	s.infoLock.RUnlock()
+	return v
+}
+
+// setProtocolVersion records the protocol version from a follower response
+func (s *followerReplication) setProtocolVersion(header RPCHeader) {
+	s.infoLock.Lock()
+	s.protocolVersion = header.ProtocolVersion
+	s.infoLock.Unlock()
+}
+
+// Priority returns the last election priority seen from the follower
+func (s *followerReplication) Priority() int {
+	s.infoLock.RLock()
+	p := s.priority
+	s.infoLock.RUnlock()
+	return p
+}
+
+// setPriority records the election priority from a follower response
+func (s *followerReplication) setPriority(priority int) {
+	s.infoLock.Lock()
+	s.priority = priority
+	s.infoLock.Unlock()
+}
+
+// Snapshot returns the newest snapshot advertised by the follower
+func (s *followerReplication) Snapshot() snapshotInfo {
+	s.infoLock.RLock()
+	info := s.snapshot
+	s.infoLock.RUnlock()
+	return info
+}
+
+// setSnapshot records the newest snapshot from a follower response
+func (s *followerReplication) setSnapshot(resp *AppendEntriesResponse) {
+	s.infoLock.Lock()
+	s.snapshot = snapshotInfo{
+		ID:    resp.SnapshotID,
+		Index: resp.SnapshotIndex,
+		Term:  resp.SnapshotTerm,
+		Size:  resp.SnapshotSize,
+	}
+	s.infoLock.Unlock()
+}
+
+// Voter returns whether the follower is still a voting peer
+func (s *followerReplication) Voter() bool {
+	s.infoLock.RLock()
+	v := s.voter
+	s.infoLock.RUnlock()
+	return v
+}
+
+// setVoter records whether the follower is still a voting peer
+func (s *followerReplication) setVoter(voter bool) {
+	s.infoLock.Lock()
+	s.voter = voter
+	s.infoLock.Unlock()
+}
+
 // replicate is a long running routine that is used to manage
 // the process of replicating logs to our followers
 func (r *Raft) replicate(s *followerReplication) {
@@ -105,7 +202,7 @@ RPC:
 			return
 		case <-s.triggerCh:
 			shouldStop = r.replicateTo(s, r.getLastLogIndex())
-		case <-randomTimeout(r.conf.CommitTimeout):
+		case <-randomTimeout(r.config().CommitTimeout):
 			shouldStop = r.replicateTo(s, r.getLastLogIndex())
 		}
 
@@ -171,11 +268,15 @@ START:
 
 	// Update the last contact
 	s.setLastContact()
+	s.setProtocolVersion(resp.RPCHeader)
+	s.setPriority(resp.Priority)
+	s.setSnapshot(&resp)
 
 	// Update the s based on success
 	if resp.Success {
 		// Update our replication state
 		updateLastAppended(s, &req)
+		r.checkPreferredLeader(s)
 
 		// Clear any failures, allow pipelining
 		s.failures = 0
@@ -211,6 +312,19 @@ SEND_SNAP:
 // sendLatestSnapshot is used to send the latest snapshot we have
 // down to our follower
 func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
+	// Point the follower at a peer with the snapshot if we can
+	if stop, ok := r.sendSnapshotFromPeer(s); ok {
+		return stop, nil
+	}
+
+	// Wait for our turn, so only so many snapshots are sent at once
+	wait := time.Now()
+	if !r.snapshotSendQueue.acquire(s.Voter(), s.stoppedCh, r.shutdownCh) {
+		return true, nil
+	}
+	defer r.snapshotSendQueue.release()
+	metrics.MeasureSince([]string{"raft", "replication", "installSnapshot", "wait"}, wait)
+
 	// Get the snapshots
 	snapshots, err := r.snapshots.List()
 	if err != nil {
@@ -234,18 +348,21 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 
 	// Setup the request
 	req := InstallSnapshotRequest{
+		RPCHeader:    r.getRPCHeader(),
 		Term:         s.currentTerm,
 		Leader:       r.trans.EncodePeer(r.localAddr),
 		LastLogIndex: meta.Index,
 		LastLogTerm:  meta.Term,
 		Peers:        meta.Peers,
 		Size:         meta.Size,
+		Header:       meta.Header,
+		Labels:       meta.Labels,
 	}
 
 	// Make the call
 	start := time.Now()
 	var resp InstallSnapshotResponse
-	if err := r.trans.InstallSnapshot(s.peer, &req, &resp, snapshot); err != nil {
+	if err := r.trans.InstallSnapshot(s.peer, &req, &resp, newThrottledReader(snapshot, r.snapshotSendLimiter)); err != nil {
 		r.wrapper_logger.print("[ERR] raft: Failed to install snapshot " + snapID + ": " + err.Error())
 		s.failures++
 		return false, err
@@ -260,21 +377,11 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 
 	// Update the last contact
 	s.setLastContact()
+	s.setProtocolVersion(resp.RPCHeader)
 
 	// Check for success
 	if resp.Success {
-		// Mark any inflight logs as committed
-		s.inflight.CommitRange(s.matchIndex+1, meta.Index)
-
-		// Update the indexes
-		s.matchIndex = meta.Index
-		s.nextIndex = s.matchIndex + 1
-
-		// Clear any failures
-		s.failures = 0
-
-		// Notify we are still leader
-		s.notifyAll(true)
+		r.snapshotInstalled(s, meta.Index)
 	} else {
 		s.failures++
 		r.wrapper_logger.print("[WARN] raft: InstallSnapshot to " + s.peer.String() + " rejected")
@@ -282,21 +389,39 @@ func (r *Raft) sendLatestSnapshot(s *followerReplication) (bool, error) {
 	return false, nil
 }
 
+// snapshotInstalled updates the replication state once a follower has
+// installed a snapshot up to the given index
+func (r *Raft) snapshotInstalled(s *followerReplication, index uint64) {
+	// Mark any inflight logs as committed
+	s.inflight.CommitRange(s.matchIndex+1, index)
+
+	// Update the indexes
+	s.matchIndex = index
+	s.nextIndex = s.matchIndex + 1
+
+	// Clear any failures
+	s.failures = 0
+
+	// Notify we are still leader
+	s.notifyAll(true)
+}
+
 // hearbeat is used to periodically invoke AppendEntries on a peer
 // to ensure they don't time out. This is done async of replicate(),
 // since that routine could potentially be blocked on disk IO
 func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 	var failures uint64
 	req := AppendEntriesRequest{
-		Term:   s.currentTerm,
-		Leader: r.trans.EncodePeer(r.localAddr),
+		RPCHeader: r.getRPCHeader(),
+		Term:      s.currentTerm,
+		Leader:    r.trans.EncodePeer(r.localAddr),
 	}
 	var resp AppendEntriesResponse
 	for {
 		// Wait for the next heartbeat interval or forced notify
 		select {
 		case <-s.notifyCh:
-		case <-randomTimeout(r.conf.HeartbeatTimeout / 10):
+		case <-randomTimeout(r.config().HeartbeatTimeout / 10):
 		case <-stopCh:
 			return
 		}
@@ -311,6 +436,9 @@ func (r *Raft) heartbeat(s *followerReplication, stopCh chan struct{}) {
 			}
 		} else {
 			s.setLastContact()
+			s.setProtocolVersion(resp.RPCHeader)
+			s.setPriority(resp.Priority)
+			s.setSnapshot(&resp)
 			failures = 0
 			metrics.MeasureSince([]string{"raft", "replication", "heartbeat", s.peer.String()}, start)
 			s.notifyAll(resp.Success)
@@ -357,7 +485,7 @@ SEND:
 			break SEND
 		case <-s.triggerCh:
 			shouldStop = r.pipelineSend(s, pipeline, &nextIndex, r.getLastLogIndex())
-		case <-randomTimeout(r.conf.CommitTimeout):
+		case <-randomTimeout(r.config().CommitTimeout):
 			shouldStop = r.pipelineSend(s, pipeline, &nextIndex, r.getLastLogIndex())
 		}
 	}
@@ -411,6 +539,9 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 
 			// Update the last contact
 			s.setLastContact()
+			s.setProtocolVersion(resp.RPCHeader)
+			s.setPriority(resp.Priority)
+			s.setSnapshot(resp)
 
 			// Abort pipeline if not successful
 			if !resp.Success {
@@ -419,6 +550,7 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 
 			// Update our replication state
 			updateLastAppended(s, req)
+			r.checkPreferredLeader(s)
 		case <-stopCh:
 			return
 		}
@@ -427,6 +559,7 @@ func (r *Raft) pipelineDecode(s *followerReplication, p AppendPipeline, stopCh,
 
 // setupAppendEntries is used to setup an append entries request
 func (r *Raft) setupAppendEntries(s *followerReplication, req *AppendEntriesRequest, nextIndex, lastIndex uint64) error {
+	req.RPCHeader = r.getRPCHeader()
 	req.Term = s.currentTerm
 	req.Leader = r.trans.EncodePeer(r.localAddr)
 	req.LeaderCommitIndex = r.getCommitIndex()
@@ -436,9 +569,34 @@ func (r *Raft) setupAppendEntries(s *followerReplication, req *AppendEntriesRequ
 	if err := r.setNewLogs(req, nextIndex, lastIndex); err != nil {
 		return err
 	}
+	r.compressEntries(s, req)
 	return nil
 }
 
+// compressEntries compresses the data of large logs in a request, if
+// enabled and the follower is known to understand compressed logs.
+func (r *Raft) compressEntries(s *followerReplication, req *AppendEntriesRequest) {
+	conf := r.config()
+	threshold := conf.ReplicationCompressionThreshold
+	if threshold == 0 || conf.ProtocolVersion < 3 || s.ProtocolVersion() < 3 {
+		return
+	}
+	for _, entry := range req.Entries {
+		if len(entry.Data) < threshold || entry.Codec != LogCodecNone {
+			continue
+		}
+		size := len(entry.Data)
+		compressed, err := compressLog(entry, flate.DefaultCompression)
+		if err != nil {
+			r.wrapper_logger.print("[ERR] raft: Failed to compress log at index " + strconv.FormatUint(entry.Index, 10) + ": " + err.Error())
+			continue
+		}
+		if compressed {
+			metrics.IncrCounter([]string{"raft", "replication", "compressedBytesSaved"}, float32(size-len(entry.Data)))
+		}
+	}
+}
+
 // setPreviousLog is used to setup the PrevLogEntry and PrevLogTerm for an
 // AppendEntriesRequest given the next index to replicate
 func (r *Raft) setPreviousLog(req *AppendEntriesRequest, nextIndex uint64) error {
@@ -469,14 +627,20 @@ func (r *Raft) setPreviousLog(req *AppendEntriesRequest, nextIndex uint64) error
 // setNewLogs is used to setup the logs which should be appended for a request
 func (r *Raft) setNewLogs(req *AppendEntriesRequest, nextIndex, lastIndex uint64) error {
 	// Append up to MaxAppendEntries or up to the lastIndex
-	req.Entries = make([]*Log, 0, r.conf.MaxAppendEntries)
-	maxIndex := min(nextIndex+uint64(r.conf.MaxAppendEntries)-1, lastIndex)
+	maxAppendEntries := r.config().MaxAppendEntries
+	req.Entries = make([]*Log, 0, maxAppendEntries)
+	maxIndex := min(nextIndex+uint64(maxAppendEntries)-1, lastIndex)
 	for i := nextIndex; i <= maxIndex; i++ {
 		oldLog := new(Log)
 		if err := r.logs.GetLog(i, oldLog); err != nil {
 			r.wrapper_logger.print("[ERR] raft: Failed to get log at index " + strconv.FormatUint(i,10) + ": " + err.Error())
 			return err
 		}
+		if err := oldLog.verifyCRC(); err != nil {
+			metrics.IncrCounter([]string{"raft", "log", "corrupt"}, 1)
+			r.wrapper_logger.print("[ERR] raft: Log at index " + strconv.FormatUint(i, 10) + " is corrupt, not replicating it: " + err.Error())
+			return err
+		}
 		req.Entries = append(req.Entries, oldLog)
 	}
 	return nil
@@ -495,6 +659,22 @@ func (r *Raft) handleStaleTerm(s *followerReplication) {
 	asyncNotifyCh(s.stepDown)
 }
 
+// checkPreferredLeader is used after a successful AppendEntries RPC to
+// signal the leader if the follower has caught up and has a higher election
+// priority than us. The leader decides if leadership should be transferred.
+func (r *Raft) checkPreferredLeader(s *followerReplication) {
+	if s.Priority() <= r.config().ElectionPriority {
+		return
+	}
+	if s.matchIndex < r.getLastLogIndex() {
+		return
+	}
+	select {
+	case s.transferCh <- s:
+	default:
+	}
+}
+
 // updateLastAppended is used to update follower replication state after a successful
 // AppendEntries RPC
 func updateLastAppended(s *followerReplication, req *AppendEntriesRequest) {
@@ -1,7 +1,22 @@
 package raft
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"time"
+)
+
+const (
+	// SnapshotFormatVersion is the version of the snapshot format this
+	// library writes. Snapshots with a newer format are refused.
+	SnapshotFormatVersion = 1
+)
+
+var (
+	// ErrSnapshotDeltaUnavailable is returned by an IncrementalFSMSnapshot
+	// which can not persist the changes since the given base snapshot.
+	ErrSnapshotDeltaUnavailable = errors.New("snapshot delta unavailable")
 )
 
 // SnapshotMeta is for meta data of a snaphot.
@@ -11,12 +26,68 @@ type SnapshotMeta struct {
 	Term  uint64
 	Peers []byte
 	Size  int64
+
+	// Header describes the format of the snapshot. It is only recorded
+	// by stores whose sinks implement SnapshotHeaderSink.
+	Header SnapshotHeader
+
+	// Labels are set by the FSM to describe the contents of the snapshot,
+	// through a SnapshotLabelSink.
+	Labels map[string]string `json:",omitempty"`
+}
+
+// SnapshotFlags describe how a store encodes the state of a snapshot.
+type SnapshotFlags uint32
+
+const (
+	// SnapshotCompressed is set by stores which compress the state.
+	SnapshotCompressed SnapshotFlags = 1 << iota
+
+	// SnapshotEncrypted is set by stores which encrypt the state.
+	SnapshotEncrypted
+)
+
+// SnapshotHeader makes a snapshot self-describing, so a node can tell
+// whether it is able to restore it before reading the state. Snapshots
+// taken before the header was recorded have a zero header.
+type SnapshotHeader struct {
+	// FormatVersion is the SnapshotFormatVersion of the writer.
+	FormatVersion int
+
+	// SchemaVersion is the version of the FSM state, as declared by a
+	// VersionedFSM. It is zero for other FSMs.
+	SchemaVersion int
+
+	// Flags are set by the store the snapshot is kept in.
+	Flags SnapshotFlags
+
+	// Created is when the snapshot was taken.
+	Created time.Time
+
+	// NodeID is the address of the server which took the snapshot.
+	NodeID string
+}
+
+// checkSnapshotHeader returns an error if a snapshot with the given
+// header can't be restored into the FSM.
+func checkSnapshotHeader(fsm FSM, header SnapshotHeader) error {
+	if header.FormatVersion > SnapshotFormatVersion {
+		return fmt.Errorf("snapshot format version %d is not supported, the newest supported is %d",
+			header.FormatVersion, SnapshotFormatVersion)
+	}
+	if versioned, ok := fsm.(VersionedFSM); ok {
+		if err := versioned.CheckSnapshotSchema(header.SchemaVersion); err != nil {
+			return fmt.Errorf("snapshot schema version %d is not supported: %v", header.SchemaVersion, err)
+		}
+	}
+	return nil
 }
 
 // SnapshotStore interface is used to allow for flexible implementations
 // of snapshot storage and retrieval. For example, a client could implement
 // a shared state store such as S3, allowing new nodes to restore snapshots
-// without steaming from the leader.
+// without steaming from the leader. ObjectSnapshotStore provides this on
+// top of any BlobStore.
 type SnapshotStore interface {
 	// Create is used to begin a snapshot at a given index and term,
 	// with the current peer set already encoded
@@ -31,6 +102,28 @@ type SnapshotStore interface {
 	Open(id string) (*SnapshotMeta, io.ReadCloser, error)
 }
 
+// DeltaSnapshotStore is an optional interface for SnapshotStores that
+// can hold delta snapshots, which only contain the changes since a base
+// snapshot. Opening a delta returns the whole chain, starting with the
+// full snapshot it is based on, which an IncrementalFSM can restore.
+type DeltaSnapshotStore interface {
+	SnapshotStore
+
+	// CreateDelta is used to begin a delta snapshot on top of the base
+	// snapshot with the given ID.
+	CreateDelta(base string, index, term uint64, peers []byte) (SnapshotSink, error)
+
+	// ChainLength returns how many deltas lead from the full snapshot the
+	// given snapshot is based on up to it, which is zero for a full one.
+	ChainLength(id string) (int, error)
+}
+
+// snapshotNoSyncSetter is implemented by stores that can skip fsyncing
+// finished snapshots, for Config.NoSnapshotSync.
+type snapshotNoSyncSetter interface {
+	setNoSync()
+}
+
 // SnapshotSink is returned by StartSnapshot. The FSM will Write state
 // to the sink and call Close on completion. On error, Cancel will be invoked
 type SnapshotSink interface {
@@ -38,3 +131,60 @@ type SnapshotSink interface {
 	ID() string
 	Cancel() error
 }
+
+// SnapshotHeaderSink is an optional interface for SnapshotSinks that can
+// record a SnapshotHeader in the meta data of the snapshot, to return it
+// from List and Open.
+type SnapshotHeaderSink interface {
+	SnapshotSink
+
+	// SetHeader is called before the sink is closed. The store adds its
+	// own flags to the header.
+	SetHeader(header SnapshotHeader)
+}
+
+// SnapshotLabelSink is an optional interface for SnapshotSinks that can
+// record application defined labels with a snapshot, such as the number
+// of records or the tenant it belongs to. An FSMSnapshot can set labels
+// from Persist, which lets tools tell what a snapshot holds without
+// reading the state. Labels are copied along with the snapshot when it is
+// installed on another server.
+type SnapshotLabelSink interface {
+	SnapshotSink
+
+	// SetLabel sets a label, replacing any earlier value. It must be
+	// called before the sink is closed.
+	SetLabel(key, value string)
+}
+
+// openSnapshotAt opens a snapshot, checking that it includes the logs up
+// to the given index and term, as the caller expects
+func openSnapshotAt(store SnapshotStore, id string, index, term uint64) (*SnapshotMeta, io.ReadCloser, error) {
+	meta, source, err := store.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Index != index || meta.Term != term {
+		source.Close()
+		return nil, nil, fmt.Errorf("snapshot %s is at index %d term %d, not index %d term %d",
+			id, meta.Index, meta.Term, index, term)
+	}
+	return meta, source, nil
+}
+
+// setSnapshotLabel sets a label in the meta data
+func setSnapshotLabel(meta *SnapshotMeta, key, value string) {
+	if meta.Labels == nil {
+		meta.Labels = make(map[string]string)
+	}
+	meta.Labels[key] = value
+}
+
+// copySnapshotLabels sets the labels on a sink, if it supports them
+func copySnapshotLabels(sink SnapshotSink, labels map[string]string) {
+	if labelSink, ok := sink.(SnapshotLabelSink); ok {
+		for key, value := range labels {
+			labelSink.SetLabel(key, value)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package raft
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	archiveMetaName  = "meta.json"
+	archiveStateName = "state.bin"
+	archiveCRCName   = "state.crc"
+)
+
+// ExportSnapshot writes a snapshot to an archive, which can be stored
+// anywhere and later loaded with ImportSnapshot or OpenSnapshotArchive.
+// The archive is a tar stream holding the meta data, the state and a
+// CRC of the state. The size in the meta data must be accurate.
+func ExportSnapshot(w io.Writer, meta *SnapshotMeta, state io.Reader) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	// Write out the meta data
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, archiveMetaName, metaJSON, now); err != nil {
+		return err
+	}
+
+	// Stream the state, hashing as we go
+	header := &tar.Header{
+		Name:    archiveStateName,
+		Mode:    0600,
+		Size:    meta.Size,
+		ModTime: now,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	stateHash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	if _, err := io.CopyN(io.MultiWriter(tw, stateHash), state, meta.Size); err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+
+	// Write out the CRC
+	if err := writeArchiveFile(tw, archiveCRCName, stateHash.Sum(nil), now); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeArchiveFile writes a small file into an archive
+func writeArchiveFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// OpenSnapshotArchive reads the meta data of an archive written by
+// ExportSnapshot, and returns a reader for the state. The reader fails
+// instead of returning io.EOF if the state does not match its CRC. The
+// returned meta data and reader can be given to Raft.Restore.
+func OpenSnapshotArchive(r io.Reader) (*SnapshotMeta, io.Reader, error) {
+	tr := tar.NewReader(r)
+
+	// Read the meta data
+	metaJSON, err := readArchiveFile(tr, archiveMetaName, 1024*1024)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &SnapshotMeta{}
+	if err := json.Unmarshal(metaJSON, meta); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode snapshot meta data: %v", err)
+	}
+
+	// Find the state
+	header, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot archive: %v", err)
+	}
+	if header.Name != archiveStateName {
+		return nil, nil, fmt.Errorf("unexpected %q in snapshot archive", header.Name)
+	}
+	if header.Size != meta.Size {
+		return nil, nil, fmt.Errorf("snapshot size mismatch (%d != %d)", header.Size, meta.Size)
+	}
+
+	state := &archiveStateReader{
+		tr:        tr,
+		stateHash: crc64.New(crc64.MakeTable(crc64.ECMA)),
+	}
+	return meta, state, nil
+}
+
+// readArchiveFile reads the next file of an archive, which must have the
+// given name and be at most max bytes
+func readArchiveFile(tr *tar.Reader, name string, max int64) ([]byte, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot archive: %v", err)
+	}
+	if header.Name != name {
+		return nil, fmt.Errorf("unexpected %q in snapshot archive", header.Name)
+	}
+	if header.Size > max {
+		return nil, fmt.Errorf("%q is too large", name)
+	}
+	return ioutil.ReadAll(tr)
+}
+
+// archiveStateReader reads the state of an archive, and checks the CRC
+// which follows it before returning io.EOF.
+type archiveStateReader struct {
+	tr        *tar.Reader
+	stateHash hash.Hash64
+	done      bool
+}
+
+func (a *archiveStateReader) Read(p []byte) (int, error) {
+	if a.done {
+		return 0, io.EOF
+	}
+	n, err := a.tr.Read(p)
+	a.stateHash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	// Verify the state before returning the EOF
+	crc, err := readArchiveFile(a.tr, archiveCRCName, 8)
+	if err != nil {
+		return n, err
+	}
+	computed := a.stateHash.Sum(nil)
+	if !bytes.Equal(crc, computed) {
+		return n, fmt.Errorf("CRC mismatch (stored: %x computed: %x)", crc, computed)
+	}
+	a.done = true
+	return n, io.EOF
+}
+
+// ImportSnapshot reads an archive written by ExportSnapshot into a
+// snapshot store, verifying its size and CRC. The snapshot keeps its
+// index, term and peers, but gets a new ID in the store, which is
+// returned in the meta data.
+func ImportSnapshot(store SnapshotStore, r io.Reader) (*SnapshotMeta, error) {
+	meta, state, err := OpenSnapshotArchive(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := store.Create(meta.Index, meta.Term, meta.Peers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	if headerSink, ok := sink.(SnapshotHeaderSink); ok {
+		header := meta.Header
+		header.Flags = 0
+		headerSink.SetHeader(header)
+	}
+	copySnapshotLabels(sink, meta.Labels)
+	n, err := io.Copy(sink, state)
+	if err != nil {
+		sink.Cancel()
+		return nil, fmt.Errorf("failed to import snapshot: %v", err)
+	}
+	if n != meta.Size {
+		sink.Cancel()
+		return nil, fmt.Errorf("snapshot size mismatch (%d != %d)", n, meta.Size)
+	}
+	if err := sink.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close snapshot: %v", err)
+	}
+
+	imported := *meta
+	imported.ID = sink.ID()
+	return &imported, nil
+}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshotArchive(t *testing.T) {
+	// Take a snapshot in memory
+	src, _ := NewInmemSnapshotStore(1)
+	sink, _ := src.Create(10, 3, []byte("peers"))
+	sink.(SnapshotLabelSink).SetLabel("tenant", "acme")
+	state := bytes.Repeat([]byte("state "), 1000)
+	sink.Write(state)
+	sink.Close()
+
+	// Export it
+	meta, r, err := src.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var archive bytes.Buffer
+	if err := ExportSnapshot(&archive, meta, r); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Import it into a file store
+	dir, dst := FileSnapTest(t)
+	defer os.RemoveAll(dir)
+	imported, err := ImportSnapshot(dst, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if imported.Index != 10 || imported.Term != 3 || imported.Size != int64(len(state)) ||
+		string(imported.Peers) != "peers" || imported.ID == sink.ID() {
+		t.Fatalf("bad: %v", imported)
+	}
+	meta, r, err = dst.Open(imported.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	if meta.Labels["tenant"] != "acme" {
+		t.Fatalf("bad: %v", meta.Labels)
+	}
+	if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, state) {
+		t.Fatalf("bad state")
+	}
+
+	// A corrupt state must fail its CRC
+	corrupt := append([]byte{}, archive.Bytes()...)
+	idx := bytes.Index(corrupt, []byte("state state"))
+	corrupt[idx] = 'X'
+	_, stateReader, err := OpenSnapshotArchive(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := ioutil.ReadAll(stateReader); err == nil {
+		t.Fatalf("expected CRC error")
+	}
+	if _, err := ImportSnapshot(dst, bytes.NewReader(corrupt)); err == nil {
+		t.Fatalf("expected error")
+	}
+	if snaps, _ := dst.List(); len(snaps) != 1 {
+		t.Fatalf("bad: %v", snaps)
+	}
+
+	// So must a truncated archive
+	if _, err := ImportSnapshot(dst, bytes.NewReader(archive.Bytes()[:archive.Len()/2])); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// The size must be right to export
+	meta, r, _ = src.Open(sink.ID())
+	meta.Size++
+	if err := ExportSnapshot(ioutil.Discard, meta, r); err == nil {
+		t.Fatalf("expected error")
+	}
+}
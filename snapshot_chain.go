@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// snapshotChainMagic starts the stream of a delta snapshot chain, and
+// includes the format version in its last byte. It is followed by the
+// number of parts, then each part prefixed by its length, starting with
+// the full snapshot the chain is based on.
+const snapshotChainMagic = "raftchn\x01"
+
+// snapshotChainSize returns the size of a chain stream with parts of
+// the given sizes
+func snapshotChainSize(sizes []int64) int64 {
+	size := int64(len(snapshotChainMagic) + 4)
+	for _, s := range sizes {
+		size += 8 + s
+	}
+	return size
+}
+
+// newSnapshotChainReader returns a stream of the chain of the given
+// parts, which must have the given sizes
+func newSnapshotChainReader(parts []io.Reader, sizes []int64) io.Reader {
+	header := make([]byte, len(snapshotChainMagic)+4)
+	copy(header, snapshotChainMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotChainMagic):], uint32(len(parts)))
+
+	readers := []io.Reader{bytes.NewReader(header)}
+	for i, part := range parts {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(sizes[i]))
+		readers = append(readers, bytes.NewReader(size[:]), part)
+	}
+	return io.MultiReader(readers...)
+}
+
+// restoreFSM restores the FSM from a snapshot, which may be either a
+// full snapshot or a delta chain
+func restoreFSM(fsm FSM, source io.ReadCloser) error {
+	buffered := bufio.NewReader(source)
+	if !isSnapshotChain(buffered) {
+		return fsm.Restore(&readCloser{buffered, source})
+	}
+	inc, ok := fsm.(IncrementalFSM)
+	if !ok {
+		return fmt.Errorf("snapshot is a delta chain, but the FSM does not implement IncrementalFSM")
+	}
+	return restoreSnapshotChain(inc, buffered)
+}
+
+// isSnapshotChain checks if a stream starts with a delta chain
+func isSnapshotChain(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(snapshotChainMagic))
+	return string(magic) == snapshotChainMagic
+}
+
+// restoreSnapshotChain restores the full snapshot at the start of a
+// chain, then applies each delta
+func restoreSnapshotChain(fsm IncrementalFSM, r io.Reader) error {
+	header := make([]byte, len(snapshotChainMagic)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read snapshot chain: %v", err)
+	}
+	count := binary.BigEndian.Uint32(header[len(snapshotChainMagic):])
+	if count == 0 {
+		return fmt.Errorf("snapshot chain is empty")
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var size [8]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return fmt.Errorf("failed to read snapshot chain: %v", err)
+		}
+		part := io.LimitReader(r, int64(binary.BigEndian.Uint64(size[:])))
+
+		var err error
+		if i == 0 {
+			// The base may be a chain itself, if it was installed from
+			// another server
+			base := bufio.NewReader(part)
+			if isSnapshotChain(base) {
+				err = restoreSnapshotChain(fsm, base)
+			} else {
+				err = fsm.Restore(ioutil.NopCloser(base))
+			}
+		} else {
+			err = fsm.RestoreDelta(part)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Skip anything the FSM did not read
+		if _, err := io.Copy(ioutil.Discard, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
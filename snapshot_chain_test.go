@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// chainTestFSM records what it is restored from
+type chainTestFSM struct {
+	MockFSM
+	restored []string
+}
+
+func (c *chainTestFSM) Restore(r io.ReadCloser) error {
+	data, err := ioutil.ReadAll(r)
+	c.restored = []string{string(data)}
+	return err
+}
+
+func (c *chainTestFSM) RestoreDelta(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	c.restored = append(c.restored, string(data))
+	return err
+}
+
+func chainTestStream(parts ...string) []byte {
+	var readers []io.Reader
+	var sizes []int64
+	for _, part := range parts {
+		readers = append(readers, bytes.NewReader([]byte(part)))
+		sizes = append(sizes, int64(len(part)))
+	}
+	stream, _ := ioutil.ReadAll(newSnapshotChainReader(readers, sizes))
+	if int64(len(stream)) != snapshotChainSize(sizes) {
+		panic("bad chain size")
+	}
+	return stream
+}
+
+func TestSnapshotChain_Restore(t *testing.T) {
+	// A plain snapshot is restored as is
+	fsm := &chainTestFSM{}
+	if err := restoreFSM(fsm, ioutil.NopCloser(bytes.NewReader([]byte("full")))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(fsm.restored) != 1 || fsm.restored[0] != "full" {
+		t.Fatalf("bad: %v", fsm.restored)
+	}
+
+	// A chain is restored part by part, including a base that is a
+	// chain itself
+	base := string(chainTestStream("full", "delta 1"))
+	stream := chainTestStream(base, "delta 2", "")
+	if err := restoreFSM(fsm, ioutil.NopCloser(bytes.NewReader(stream))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect := []string{"full", "delta 1", "delta 2", ""}
+	if len(fsm.restored) != len(expect) {
+		t.Fatalf("bad: %v", fsm.restored)
+	}
+	for i := range expect {
+		if fsm.restored[i] != expect[i] {
+			t.Fatalf("bad: %v", fsm.restored)
+		}
+	}
+
+	// A truncated chain fails
+	if err := restoreFSM(fsm, ioutil.NopCloser(bytes.NewReader(stream[:len(stream)-10]))); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// An FSM without incremental support can not restore a chain
+	if err := restoreFSM(&MockFSM{}, ioutil.NopCloser(bytes.NewReader(stream))); err == nil {
+		t.Fatalf("expected error")
+	}
+}
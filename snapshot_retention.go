@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"time"
+)
+
+// SnapshotRetentionInfo describes a snapshot being considered by a
+// SnapshotRetentionPolicy.
+type SnapshotRetentionInfo struct {
+	SnapshotMeta
+
+	// Created is when the snapshot was started.
+	Created time.Time
+}
+
+// SnapshotRetentionPolicy decides which snapshots a store keeps. The
+// newest snapshot and any pinned snapshots are always kept, whatever
+// the policy says.
+type SnapshotRetentionPolicy interface {
+	// Retain is given the snapshots newest first, and returns a slice
+	// of the same length marking the ones to keep.
+	Retain(now time.Time, snapshots []*SnapshotRetentionInfo) []bool
+}
+
+// SnapshotRetentionFunc adapts a function to a SnapshotRetentionPolicy.
+type SnapshotRetentionFunc func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool
+
+// Retain implements the SnapshotRetentionPolicy interface.
+func (f SnapshotRetentionFunc) Retain(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+	return f(now, snapshots)
+}
+
+// RetainCount keeps the newest n snapshots.
+func RetainCount(n int) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		for i := range snapshots {
+			keep[i] = i < n
+		}
+		return keep
+	})
+}
+
+// RetainNewerThan keeps the snapshots created within the given duration.
+func RetainNewerThan(d time.Duration) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		for i, snap := range snapshots {
+			keep[i] = now.Sub(snap.Created) < d
+		}
+		return keep
+	})
+}
+
+// RetainBytes keeps the newest snapshots whose sizes add up to at most
+// maxBytes.
+func RetainBytes(maxBytes int64) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		var total int64
+		for i, snap := range snapshots {
+			total += snap.Size
+			if total > maxBytes {
+				break
+			}
+			keep[i] = true
+		}
+		return keep
+	})
+}
+
+// RetainBuckets keeps the newest snapshot in each of the last count
+// periods, with periods aligned to multiples of the period since the
+// zero time. For example RetainBuckets(24*time.Hour, 7) keeps a daily
+// snapshot for a week, with days starting at midnight UTC.
+func RetainBuckets(period time.Duration, count int) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		oldest := now.Truncate(period).Add(-time.Duration(count-1) * period)
+		seen := make(map[time.Time]bool)
+		for i, snap := range snapshots {
+			bucket := snap.Created.Truncate(period)
+			if bucket.Before(oldest) || seen[bucket] {
+				continue
+			}
+			seen[bucket] = true
+			keep[i] = true
+		}
+		return keep
+	})
+}
+
+// RetainAny keeps the snapshots kept by any of the given policies.
+func RetainAny(policies ...SnapshotRetentionPolicy) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		for _, p := range policies {
+			for i, k := range p.Retain(now, snapshots) {
+				keep[i] = keep[i] || k
+			}
+		}
+		return keep
+	})
+}
+
+// RetainAll keeps only the snapshots kept by every one of the given
+// policies. It can be used to cap another policy, for example with
+// RetainBytes.
+func RetainAll(policies ...SnapshotRetentionPolicy) SnapshotRetentionPolicy {
+	return SnapshotRetentionFunc(func(now time.Time, snapshots []*SnapshotRetentionInfo) []bool {
+		keep := make([]bool, len(snapshots))
+		for i := range keep {
+			keep[i] = true
+		}
+		for _, p := range policies {
+			for i, k := range p.Retain(now, snapshots) {
+				keep[i] = keep[i] && k
+			}
+		}
+		return keep
+	})
+}
@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// retentionTestSnaps returns snapshots newest first, taken at the given
+// ages before now, each of the given size.
+func retentionTestSnaps(now time.Time, size int64, ages ...time.Duration) []*SnapshotRetentionInfo {
+	var snaps []*SnapshotRetentionInfo
+	for i, age := range ages {
+		snaps = append(snaps, &SnapshotRetentionInfo{
+			SnapshotMeta: SnapshotMeta{Index: uint64(100 - i), Size: size},
+			Created:      now.Add(-age),
+		})
+	}
+	return snaps
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	now := time.Date(2016, 5, 10, 12, 30, 0, 0, time.UTC)
+	snaps := retentionTestSnaps(now, 10,
+		time.Minute, 20*time.Minute, 50*time.Minute, 2*time.Hour,
+		25*time.Hour, 30*time.Hour, 4*24*time.Hour, 10*24*time.Hour)
+
+	cases := []struct {
+		name   string
+		policy SnapshotRetentionPolicy
+		expect []bool
+	}{
+		{"count", RetainCount(3),
+			[]bool{true, true, true, false, false, false, false, false}},
+		{"newer than", RetainNewerThan(time.Hour),
+			[]bool{true, true, true, false, false, false, false, false}},
+		{"bytes", RetainBytes(45),
+			[]bool{true, true, true, true, false, false, false, false}},
+		// 12:29, 12:10, 11:40 and 10:30 fall in the last three hours
+		{"hourly", RetainBuckets(time.Hour, 3),
+			[]bool{true, false, true, true, false, false, false, false}},
+		// One a day for a week covers today, yesterday and 4 days ago
+		{"daily", RetainBuckets(24*time.Hour, 7),
+			[]bool{true, false, false, false, true, false, true, false}},
+		{"any", RetainAny(RetainCount(1), RetainBuckets(24*time.Hour, 7)),
+			[]bool{true, false, false, false, true, false, true, false}},
+		{"all", RetainAll(RetainBuckets(24*time.Hour, 7), RetainBytes(50)),
+			[]bool{true, false, false, false, true, false, false, false}},
+	}
+	for _, c := range cases {
+		if keep := c.policy.Retain(now, snaps); !reflect.DeepEqual(keep, c.expect) {
+			t.Fatalf("%s: bad: %v", c.name, keep)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package raft
+
+import (
+	"sync"
+)
+
+// snapshotSendQueue limits how many snapshots the leader sends to its
+// followers at once. Sends over the limit wait in line, where voters go
+// before non-voters and otherwise first come, first served. The limit is
+// read whenever a turn may be given, and zero is unlimited.
+type snapshotSendQueue struct {
+	limit func() int
+
+	l       sync.Mutex
+	active  int
+	waiting []*snapshotSendWaiter
+}
+
+// snapshotSendWaiter is a send waiting in line
+type snapshotSendWaiter struct {
+	voter   bool
+	readyCh chan struct{}
+}
+
+func newSnapshotSendQueue(limit func() int) *snapshotSendQueue {
+	return &snapshotSendQueue{limit: limit}
+}
+
+// acquire waits for a turn to send a snapshot, which must be given back
+// with release. It returns false without a turn if stopCh or shutdownCh
+// is closed first.
+func (q *snapshotSendQueue) acquire(voter bool, stopCh, shutdownCh <-chan struct{}) bool {
+	w := &snapshotSendWaiter{voter: voter, readyCh: make(chan struct{})}
+	q.l.Lock()
+	q.waiting = append(q.waiting, w)
+	q.grant()
+	q.l.Unlock()
+
+	select {
+	case <-w.readyCh:
+		return true
+	case <-stopCh:
+	case <-shutdownCh:
+	}
+
+	q.l.Lock()
+	defer q.l.Unlock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return false
+		}
+	}
+
+	// We were given a turn meanwhile, so pass it on
+	q.active--
+	q.grant()
+	return false
+}
+
+// release gives back a turn
+func (q *snapshotSendQueue) release() {
+	q.l.Lock()
+	q.active--
+	q.grant()
+	q.l.Unlock()
+}
+
+// update gives out any turns freed up by a raised limit
+func (q *snapshotSendQueue) update() {
+	q.l.Lock()
+	q.grant()
+	q.l.Unlock()
+}
+
+// stats returns the number of sends in progress and waiting
+func (q *snapshotSendQueue) stats() (int, int) {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return q.active, len(q.waiting)
+}
+
+// grant gives turns to waiting sends while the limit allows, the first
+// voter in line first. The lock must be held.
+func (q *snapshotSendQueue) grant() {
+	for len(q.waiting) > 0 {
+		if limit := q.limit(); limit > 0 && q.active >= limit {
+			return
+		}
+		next := 0
+		for i, w := range q.waiting {
+			if w.voter {
+				next = i
+				break
+			}
+		}
+		w := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.active++
+		close(w.readyCh)
+	}
+}
@@ -0,0 +1,83 @@
+package raft
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSendQueue(t *testing.T) {
+	var limit int64 = 1
+	q := newSnapshotSendQueue(func() int { return int(atomic.LoadInt64(&limit)) })
+	shutdownCh := make(chan struct{})
+
+	if !q.acquire(true, nil, shutdownCh) {
+		t.Fatalf("should acquire")
+	}
+
+	// Queue a non-voter, then a voter
+	order := make(chan string, 2)
+	wait := func(name string, voter bool) {
+		if q.acquire(voter, nil, shutdownCh) {
+			order <- name
+		}
+	}
+	go wait("nonvoter", false)
+	waitQueued(t, q, 1)
+	go wait("voter", true)
+	waitQueued(t, q, 2)
+
+	// The voter goes first, though it queued last
+	q.release()
+	if name := <-order; name != "voter" {
+		t.Fatalf("bad: %s", name)
+	}
+	select {
+	case name := <-order:
+		t.Fatalf("should wait: %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.release()
+	if name := <-order; name != "nonvoter" {
+		t.Fatalf("bad: %s", name)
+	}
+	if active, queued := q.stats(); active != 1 || queued != 0 {
+		t.Fatalf("bad: %d %d", active, queued)
+	}
+
+	// A stopped wait leaves the queue
+	stopCh := make(chan struct{})
+	doneCh := make(chan bool)
+	go func() { doneCh <- q.acquire(true, stopCh, shutdownCh) }()
+	waitQueued(t, q, 1)
+	close(stopCh)
+	if <-doneCh {
+		t.Fatalf("should not acquire")
+	}
+	if active, queued := q.stats(); active != 1 || queued != 0 {
+		t.Fatalf("bad: %d %d", active, queued)
+	}
+
+	// Raising the limit lets waits through
+	go wait("raised", true)
+	waitQueued(t, q, 1)
+	atomic.StoreInt64(&limit, 0)
+	q.update()
+	if name := <-order; name != "raised" {
+		t.Fatalf("bad: %s", name)
+	}
+	if active, queued := q.stats(); active != 2 || queued != 0 {
+		t.Fatalf("bad: %d %d", active, queued)
+	}
+}
+
+// waitQueued waits for the given number of sends to queue up
+func waitQueued(t *testing.T, q *snapshotSendQueue, n int) {
+	for i := 0; i < 100; i++ {
+		if _, queued := q.stats(); queued == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d queued", n)
+}
@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// snapshotInfo describes the newest snapshot of a server, which followers
+// advertise so the leader can point other followers at it
+type snapshotInfo struct {
+	ID    string
+	Index uint64
+	Term  uint64
+	Size  int64
+}
+
+// getLatestSnapshot returns our newest snapshot
+func (r *Raft) getLatestSnapshot() snapshotInfo {
+	r.latestSnapshotLock.Lock()
+	defer r.latestSnapshotLock.Unlock()
+	return r.latestSnapshot
+}
+
+// updateLatestSnapshot looks up our newest snapshot after it changed
+func (r *Raft) updateLatestSnapshot() {
+	var info snapshotInfo
+	if snapshots, err := r.snapshots.List(); err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to list snapshots: " + err.Error())
+	} else if len(snapshots) > 0 {
+		info = snapshotInfo{
+			ID:    snapshots[0].ID,
+			Index: snapshots[0].Index,
+			Term:  snapshots[0].Term,
+			Size:  snapshots[0].Size,
+		}
+	}
+	r.latestSnapshotLock.Lock()
+	r.latestSnapshot = info
+	r.latestSnapshotLock.Unlock()
+}
+
+// trackSnapshotSource makes a follower we replicate to available as a
+// source of snapshots for the others
+func (r *Raft) trackSnapshotSource(s *followerReplication) {
+	r.snapshotSourcesLock.Lock()
+	r.snapshotSources[s.peer.String()] = s
+	r.snapshotSourcesLock.Unlock()
+}
+
+// untrackSnapshotSource stops using a follower as a source of snapshots
+func (r *Raft) untrackSnapshotSource(s *followerReplication) {
+	r.snapshotSourcesLock.Lock()
+	if r.snapshotSources[s.peer.String()] == s {
+		delete(r.snapshotSources, s.peer.String())
+	}
+	r.snapshotSourcesLock.Unlock()
+}
+
+// pickSnapshotSource picks a random healthy follower, other than the
+// target, with a snapshot at least as new as the given index
+func (r *Raft) pickSnapshotSource(target *followerReplication, index uint64) *followerReplication {
+	timeout := r.config().HeartbeatTimeout
+	r.snapshotSourcesLock.Lock()
+	defer r.snapshotSourcesLock.Unlock()
+
+	// Sources must have advertised version 4 in a response to serve
+	// FetchSnapshot
+	var sources []*followerReplication
+	for _, s := range r.snapshotSources {
+		snapshot := s.Snapshot()
+		if s == target || !s.Voter() || s.ProtocolVersion() < 4 ||
+			time.Since(s.LastContact()) > timeout ||
+			snapshot.ID == "" || snapshot.Index < index {
+			continue
+		}
+		sources = append(sources, s)
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	return sources[rand.Intn(len(sources))]
+}
+
+// sendSnapshotFromPeer points a follower at another follower to fetch a
+// snapshot from, to spare us streaming it. It returns whether this
+// worked, and otherwise we send the snapshot ourselves.
+func (r *Raft) sendSnapshotFromPeer(s *followerReplication) (stop, ok bool) {
+	// Only once the follower advertised version 4 in a response, as an
+	// older one would take the empty stream as the snapshot. Followers
+	// that have not responded yet are assumed to speak the oldest version.
+	conf := r.config()
+	if !conf.PeerSnapshotSourcing || conf.ProtocolVersion < 4 || s.ProtocolVersion() < 4 {
+		return false, false
+	}
+
+	// The source must have our newest snapshot or a newer one, so we
+	// still have the logs which follow it
+	latest := r.getLatestSnapshot()
+	if latest.ID == "" {
+		return false, false
+	}
+	source := r.pickSnapshotSource(s, latest.Index)
+	if source == nil {
+		return false, false
+	}
+	snapshot := source.Snapshot()
+
+	// Setup the request
+	req := InstallSnapshotRequest{
+		RPCHeader:    r.getRPCHeader(),
+		Term:         s.currentTerm,
+		Leader:       r.trans.EncodePeer(r.localAddr),
+		LastLogIndex: snapshot.Index,
+		LastLogTerm:  snapshot.Term,
+		Source:       r.trans.EncodePeer(source.peer),
+		SourceID:     snapshot.ID,
+		SourceSize:   snapshot.Size,
+	}
+
+	// Make the call
+	start := time.Now()
+	var resp InstallSnapshotResponse
+	if err := r.trans.InstallSnapshot(s.peer, &req, &resp, bytes.NewReader(nil)); err != nil {
+		r.wrapper_logger.print("[WARN] raft: Failed to have " + s.peer.String() + " fetch snapshot from " + source.peer.String() + ", sending it ourselves: " + err.Error())
+		return false, false
+	}
+	metrics.MeasureSince([]string{"raft", "replication", "installSnapshot", "fromPeer", s.peer.String()}, start)
+
+	// Check for a newer term, stop running
+	if resp.Term > req.Term {
+		r.handleStaleTerm(s)
+		return true, true
+	}
+
+	// Update the last contact
+	s.setLastContact()
+	s.setProtocolVersion(resp.RPCHeader)
+
+	if !resp.Success {
+		r.wrapper_logger.print("[WARN] raft: " + s.peer.String() + " failed to fetch snapshot from " + source.peer.String() + ", sending it ourselves")
+		return false, false
+	}
+	r.wrapper_logger.print("[INFO] raft: " + s.peer.String() + " installed snapshot " + snapshot.ID + " from " + source.peer.String())
+	r.snapshotInstalled(s, snapshot.Index)
+	return false, true
+}
+
+// fetchSnapshot fetches the snapshot an InstallSnapshotRequest points us
+// at from its source, and fills in the request from the snapshot meta
+// data. The returned reader streams the snapshot.
+func (r *Raft) fetchSnapshot(req *InstallSnapshotRequest) (io.ReadCloser, error) {
+	source := r.trans.DecodePeer(req.Source)
+	args := FetchSnapshotRequest{
+		RPCHeader:    r.getRPCHeader(),
+		ID:           req.SourceID,
+		LastLogIndex: req.LastLogIndex,
+		LastLogTerm:  req.LastLogTerm,
+	}
+	var resp FetchSnapshotResponse
+	reader, err := r.trans.FetchSnapshot(source, &args, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch snapshot %s from %v: %v", req.SourceID, source, err)
+	}
+
+	// Make sure we got the snapshot the leader asked for
+	if resp.LastLogIndex != req.LastLogIndex || resp.LastLogTerm != req.LastLogTerm {
+		reader.Close()
+		return nil, fmt.Errorf("fetched snapshot %s is at index %d term %d, not index %d term %d",
+			req.SourceID, resp.LastLogIndex, resp.LastLogTerm, req.LastLogIndex, req.LastLogTerm)
+	}
+	req.Peers = resp.Peers
+	req.Size = resp.Size
+	req.Header = resp.Header
+	req.Labels = resp.Labels
+	r.wrapper_logger.print("[INFO] raft: Fetching snapshot " + req.SourceID + " (" + strconv.FormatInt(resp.Size, 10) + " bytes) from " + source.String())
+	return reader, nil
+}
+
+// serveSnapshot is invoked when we get a FetchSnapshot RPC call. The
+// snapshot is streamed after the response, paced like our other sends.
+func (r *Raft) serveSnapshot(rpc RPC, req *FetchSnapshotRequest) {
+	resp := &FetchSnapshotResponse{
+		RPCHeader: r.getRPCHeader(),
+	}
+	meta, source, err := openSnapshotAt(r.snapshots, req.ID, req.LastLogIndex, req.LastLogTerm)
+	if err != nil {
+		r.wrapper_logger.print("[ERR] raft: Failed to serve snapshot " + req.ID + ": " + err.Error())
+		rpc.Respond(resp, err)
+		return
+	}
+	resp.LastLogIndex = meta.Index
+	resp.LastLogTerm = meta.Term
+	resp.Peers = meta.Peers
+	resp.Size = meta.Size
+	resp.Header = meta.Header
+	resp.Labels = meta.Labels
+	metrics.IncrCounter([]string{"raft", "rpc", "fetchSnapshot"}, 1)
+	rpc.RespondWithReader(resp, &throttledReadCloser{
+		Reader: newThrottledReader(source, r.snapshotSendLimiter),
+		Closer: source,
+	})
+}
+
+// throttledReadCloser closes the reader under a throttledReader
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+}
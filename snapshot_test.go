@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sameSnapshotHeader compares headers, which may have been through a
+// serialization that drops the location of the creation time
+func sameSnapshotHeader(a, b SnapshotHeader) bool {
+	if !a.Created.Equal(b.Created) {
+		return false
+	}
+	a.Created, b.Created = time.Time{}, time.Time{}
+	return a == b
+}
+
+// testSnapshotStore checks the behavior every SnapshotStore must share.
+// The store must be empty, and retain the given number of snapshots.
+func testSnapshotStore(t *testing.T, store SnapshotStore, retain int) {
+	// Check no snapshots
+	if snaps, err := store.List(); err != nil || len(snaps) != 0 {
+		t.Fatalf("did not expect any snapshots: %v %v", snaps, err)
+	}
+
+	// The sink should not be listed until it is closed
+	peers := []byte("all my lovely friends")
+	sink, err := store.Create(10, 3, peers)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	header := SnapshotHeader{
+		FormatVersion: SnapshotFormatVersion,
+		SchemaVersion: 7,
+		Created:       time.Unix(1500000000, 0),
+		NodeID:        "node",
+	}
+	headerSink, recordsHeader := sink.(SnapshotHeaderSink)
+	if recordsHeader {
+		headerSink.SetHeader(header)
+	}
+	labels := map[string]string{"rows": "2", "tenant": "acme"}
+	labelSink, recordsLabels := sink.(SnapshotLabelSink)
+	if recordsLabels {
+		labelSink.SetLabel("rows", "1")
+		labelSink.SetLabel("rows", "2")
+		labelSink.SetLabel("tenant", "acme")
+	}
+	if _, err := sink.Write([]byte("first\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := sink.Write([]byte("second\n")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snaps, _ := store.List(); len(snaps) != 0 {
+		t.Fatalf("did not expect any snapshots: %v", snaps)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Should have a snapshot
+	snaps, err := store.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snaps) != 1 {
+		t.Fatalf("expect a snapshot: %v", snaps)
+	}
+	latest := snaps[0]
+	if latest.ID != sink.ID() || latest.Index != 10 || latest.Term != 3 ||
+		!bytes.Equal(latest.Peers, peers) || latest.Size != 13 {
+		t.Fatalf("bad snapshot: %v", *latest)
+	}
+	if recordsHeader && !sameSnapshotHeader(latest.Header, header) {
+		t.Fatalf("bad header: %v", latest.Header)
+	}
+	if recordsLabels && !reflect.DeepEqual(latest.Labels, labels) {
+		t.Fatalf("bad labels: %v", latest.Labels)
+	}
+
+	// Read the snapshot back
+	meta, r, err := store.Open(latest.ID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "first\nsecond\n" {
+		t.Fatalf("bad: %q", data)
+	}
+	if meta.ID != latest.ID || meta.Index != 10 || meta.Term != 3 || meta.Size != 13 {
+		t.Fatalf("bad snapshot: %v", *meta)
+	}
+	if recordsHeader && !sameSnapshotHeader(meta.Header, header) {
+		t.Fatalf("bad header: %v", meta.Header)
+	}
+	if recordsLabels && !reflect.DeepEqual(meta.Labels, labels) {
+		t.Fatalf("bad labels: %v", meta.Labels)
+	}
+
+	// A cancelled snapshot should not be listed
+	sink, err = store.Create(11, 3, peers)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.Write([]byte("cancelled"))
+	if err := sink.Cancel(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snaps, _ := store.List(); len(snaps) != 1 {
+		t.Fatalf("bad: %v", snaps)
+	}
+
+	// Create more snapshots than are retained
+	for i := 0; i < retain+2; i++ {
+		sink, err := store.Create(uint64(20+i), 4, peers)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		fmt.Fprintf(sink, "snapshot %d", i)
+		if err := sink.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Only the newest should be listed, highest index first
+	snaps, err = store.List()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snaps) != retain {
+		t.Fatalf("bad: %v", snaps)
+	}
+	for i, snap := range snaps {
+		if expect := uint64(20 + retain + 1 - i); snap.Index != expect {
+			t.Fatalf("bad: %d %v", i, *snap)
+		}
+		_, r, err := store.Open(snap.ID)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(data) != fmt.Sprintf("snapshot %d", retain+1-i) {
+			t.Fatalf("bad: %q", data)
+		}
+	}
+
+	// Unknown snapshots should fail to open
+	if _, _, err := store.Open("nope"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// versionedTestFSM accepts snapshot schemas up to its own version
+type versionedTestFSM struct {
+	MockFSM
+	version int
+}
+
+func (v *versionedTestFSM) SnapshotSchemaVersion() int {
+	return v.version
+}
+
+func (v *versionedTestFSM) CheckSnapshotSchema(version int) error {
+	if version > v.version {
+		return fmt.Errorf("newer than %d", v.version)
+	}
+	return nil
+}
+
+func TestCheckSnapshotHeader(t *testing.T) {
+	fsm := &versionedTestFSM{version: 2}
+	cases := []struct {
+		header SnapshotHeader
+		fsm    FSM
+		ok     bool
+	}{
+		{SnapshotHeader{}, fsm, true},
+		{SnapshotHeader{FormatVersion: SnapshotFormatVersion, SchemaVersion: 2}, fsm, true},
+		{SnapshotHeader{FormatVersion: SnapshotFormatVersion, SchemaVersion: 3}, fsm, false},
+		{SnapshotHeader{FormatVersion: SnapshotFormatVersion + 1}, fsm, false},
+		{SnapshotHeader{FormatVersion: SnapshotFormatVersion, SchemaVersion: 3}, &MockFSM{}, true},
+		{SnapshotHeader{FormatVersion: SnapshotFormatVersion + 1}, &MockFSM{}, false},
+	}
+	for i, c := range cases {
+		if err := checkSnapshotHeader(c.fsm, c.header); (err == nil) != c.ok {
+			t.Fatalf("case %d: err: %v", i, err)
+		}
+	}
+}
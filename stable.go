@@ -13,3 +13,14 @@ type StableStore interface {
 	// GetUint64 returns the uint64 value for key, or 0 if key was not found.
 	GetUint64(key []byte) (uint64, error)
 }
+
+// BatchStableStore is an optional interface for a StableStore that can
+// set several keys atomically. Raft uses it to persist its term and vote
+// together, so a crash can never leave a vote half recorded.
+type BatchStableStore interface {
+	StableStore
+
+	// BatchSet sets all the keys or none of them. A uint64 value is
+	// given as 8 big-endian bytes, and must be readable with GetUint64.
+	BatchSet(kvs map[string][]byte) error
+}
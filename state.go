@@ -2,6 +2,7 @@ package raft
 
 import (
 	"sync/atomic"
+	"time"
 )
 
 // RaftState captures the state of a Raft node: Follower, Candidate, Leader,
@@ -58,6 +59,11 @@ type raftState struct {
 	lastSnapshotIndex uint64
 	lastSnapshotTerm  uint64
 
+	// Bytes of log data stored since the last snapshot, and when that
+	// snapshot was taken in Unix nanoseconds
+	snapshotLogBytes uint64
+	lastSnapshotTime int64
+
 	// Tracks the number of live routines
 	runningRoutines int32
 
@@ -131,6 +137,37 @@ func (r *raftState) setLastSnapshotTerm(term uint64) {
 	atomic.StoreUint64(&r.lastSnapshotTerm, term)
 }
 
+func (r *raftState) getSnapshotLogBytes() uint64 {
+	return atomic.LoadUint64(&r.snapshotLogBytes)
+}
+
+func (r *raftState) addSnapshotLogBytes(n uint64) {
+	atomic.AddUint64(&r.snapshotLogBytes, n)
+}
+
+// subSnapshotLogBytes takes the bytes covered by a snapshot off the
+// count, without dropping below zero if it was reset in the meantime
+func (r *raftState) subSnapshotLogBytes(n uint64) {
+	for {
+		old := atomic.LoadUint64(&r.snapshotLogBytes)
+		new := uint64(0)
+		if old > n {
+			new = old - n
+		}
+		if atomic.CompareAndSwapUint64(&r.snapshotLogBytes, old, new) {
+			return
+		}
+	}
+}
+
+func (r *raftState) getLastSnapshotTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastSnapshotTime))
+}
+
+func (r *raftState) setLastSnapshotTime(t time.Time) {
+	atomic.StoreInt64(&r.lastSnapshotTime, t.UnixNano())
+}
+
 func (r *raftState) incrRoutines() {
 	atomic.AddInt32(&r.runningRoutines, 1)
 }
@@ -10,6 +10,7 @@ import (
 type RPCResponse struct {
 	Response interface{}
 	Error    error
+	Reader   io.ReadCloser // Set only for FetchSnapshot
 }
 
 // RPC has a command, and provides a Reponse mechanism
@@ -21,7 +22,13 @@ type RPC struct {
 
 // Respond is used to respond with a response, error or both
 func (r *RPC) Respond(resp interface{}, err error) {
-	r.RespChan <- RPCResponse{resp, err}
+	r.RespChan <- RPCResponse{Response: resp, Error: err}
+}
+
+// RespondWithReader is used to respond with a response followed by the
+// contents of the reader, which the transport streams and closes
+func (r *RPC) RespondWithReader(resp interface{}, reader io.ReadCloser) {
+	r.RespChan <- RPCResponse{Response: resp, Reader: reader}
 }
 
 // Transport provides an interface for network transports
@@ -48,6 +55,14 @@ type Transport interface {
 	// the ReadCloser and streamed to the client.
 	InstallSnapshot(target net.Addr, args *InstallSnapshotRequest, resp *InstallSnapshotResponse, data io.Reader) error
 
+	// TimeoutNow is used to start a leadership transfer to the target node.
+	TimeoutNow(target net.Addr, args *TimeoutNowRequest, resp *TimeoutNowResponse) error
+
+	// FetchSnapshot is used to pull a snapshot from the target node. The
+	// returned ReadCloser streams the snapshot described by the response,
+	// and must be closed.
+	FetchSnapshot(target net.Addr, args *FetchSnapshotRequest, resp *FetchSnapshotResponse) (io.ReadCloser, error)
+
 	// EncodePeer is used to serialize a peer name
 	EncodePeer(net.Addr) []byte
 